@@ -0,0 +1,312 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 使用统计按时间分桶存储在哈希表 usage_ts:<粒度>:<时间桶> 中
+// 字段格式为 <分组>|<分组值>|<指标>，例如 token|<tokenID>|requests
+const usageSeriesPrefix = "usage_ts:"
+
+// 统计粒度
+const (
+	AnalyticsHourly = "hour"
+	AnalyticsDaily  = "day"
+)
+
+// 统计分组
+const (
+	AnalyticsGroupTotal = "total"
+	AnalyticsGroupToken = "token"
+	AnalyticsGroupKey   = "key"
+	AnalyticsGroupModel = "model"
+)
+
+// 单次查询允许的最大时间桶数量
+const analyticsMaxBuckets = 1000
+
+// UsageSeries 某个分组值的时间序列，各指标切片与时间桶一一对应
+type UsageSeries struct {
+	Group    string  `json:"group"`
+	Value    string  `json:"value"`
+	Label    string  `json:"label,omitempty"`
+	Requests []int64 `json:"requests"`
+	Errors   []int64 `json:"errors"`
+	Blocks   []int64 `json:"blocks"`
+	Tokens   []int64 `json:"tokens"`
+
+	CacheHits   []int64 `json:"cache_hits"`
+	CacheMisses []int64 `json:"cache_misses"`
+}
+
+// analyticsBucket 返回时间所在的时间桶开始时间和对应的键
+func analyticsBucket(interval string, t time.Time) (time.Time, string) {
+	if interval == AnalyticsDaily {
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		return start, usageSeriesPrefix + AnalyticsDaily + ":" + start.Format("20060102")
+	}
+	start := t.Truncate(time.Hour)
+	return start, usageSeriesPrefix + AnalyticsHourly + ":" + start.Format("2006010215")
+}
+
+// nextAnalyticsBucket 返回下一个时间桶的开始时间
+func nextAnalyticsBucket(interval string, t time.Time) time.Time {
+	if interval == AnalyticsDaily {
+		return t.AddDate(0, 0, 1)
+	}
+	return t.Add(time.Hour)
+}
+
+// recordUsageAnalytics 将一次请求计入各分组的小时和天统计
+func recordUsageAnalytics(entry *RequestLog) {
+	dimensions := map[string]string{
+		AnalyticsGroupTotal: "all",
+		AnalyticsGroupToken: entry.TokenID,
+		AnalyticsGroupKey:   entry.APIKey,
+		AnalyticsGroupModel: strings.ToLower(entry.Model),
+	}
+
+	values := map[string]int64{
+		"requests": 1,
+		"tokens":   int64(entry.PromptTokens + entry.CompletionTokens),
+	}
+	if entry.Status >= 400 {
+		values["errors"] = 1
+	}
+	if entry.BlockDetected {
+		values["blocks"] = 1
+	}
+	switch entry.Cache {
+	case cacheHit:
+		values["cache_hits"] = 1
+	case cacheMiss:
+		values["cache_misses"] = 1
+	}
+
+	increments := make(map[string]int64)
+	for group, value := range dimensions {
+		if value == "" {
+			continue
+		}
+		for metric, count := range values {
+			if count != 0 {
+				increments[group+"|"+value+"|"+metric] = count
+			}
+		}
+	}
+
+	retention := map[string]time.Duration{
+		AnalyticsHourly: config.AppConfig.AnalyticsHourlyRetention,
+		AnalyticsDaily:  config.AppConfig.AnalyticsDailyRetention,
+	}
+	for interval, ttl := range retention {
+		_, key := analyticsBucket(interval, entry.Time)
+		if err := config.RedisHIncrByFields(key, increments, ttl); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				logger.RequestIDKey: entry.RequestID,
+				"interval":          interval,
+				"error":             err.Error(),
+			}).Error("记录使用统计失败")
+		}
+	}
+}
+
+// QueryUsageAnalytics 查询时间范围内指定分组的时间序列，value 不为空时只返回该分组值
+func QueryUsageAnalytics(interval, group, value string, from, to time.Time) ([]time.Time, []*UsageSeries, error) {
+	buckets := make([]time.Time, 0)
+	seriesMap := make(map[string]*UsageSeries)
+
+	start, _ := analyticsBucket(interval, from)
+	for bucket := start; !bucket.After(to); bucket = nextAnalyticsBucket(interval, bucket) {
+		_, key := analyticsBucket(interval, bucket)
+		fields, err := config.RedisHGetAll(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		index := len(buckets)
+		buckets = append(buckets, bucket)
+		// 新的时间桶，所有已有序列补零
+		for _, series := range seriesMap {
+			series.appendBucket()
+		}
+
+		for field, raw := range fields {
+			parts := strings.SplitN(field, "|", 3)
+			if len(parts) != 3 || parts[0] != group || (value != "" && parts[1] != value) {
+				continue
+			}
+			count, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			series, exists := seriesMap[parts[1]]
+			if !exists {
+				series = &UsageSeries{Group: group, Value: parts[1]}
+				for i := 0; i <= index; i++ {
+					series.appendBucket()
+				}
+				seriesMap[parts[1]] = series
+			}
+			series.add(index, parts[2], count)
+		}
+	}
+
+	list := make([]*UsageSeries, 0, len(seriesMap))
+	for _, series := range seriesMap {
+		list = append(list, series)
+	}
+	// 请求量大的排在前面
+	sort.Slice(list, func(i, j int) bool {
+		ti, tj := sumInt64(list[i].Requests), sumInt64(list[j].Requests)
+		if ti != tj {
+			return ti > tj
+		}
+		return list[i].Value < list[j].Value
+	})
+	return buckets, list, nil
+}
+
+func (s *UsageSeries) appendBucket() {
+	s.Requests = append(s.Requests, 0)
+	s.Errors = append(s.Errors, 0)
+	s.Blocks = append(s.Blocks, 0)
+	s.Tokens = append(s.Tokens, 0)
+	s.CacheHits = append(s.CacheHits, 0)
+	s.CacheMisses = append(s.CacheMisses, 0)
+}
+
+func (s *UsageSeries) add(index int, metric string, count int64) {
+	switch metric {
+	case "requests":
+		s.Requests[index] += count
+	case "errors":
+		s.Errors[index] += count
+	case "blocks":
+		s.Blocks[index] += count
+	case "tokens":
+		s.Tokens[index] += count
+	case "cache_hits":
+		s.CacheHits[index] += count
+	case "cache_misses":
+		s.CacheMisses[index] += count
+	}
+}
+
+func sumInt64(values []int64) int64 {
+	var total int64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// GetUsageAnalyticsHandler 查询使用统计时间序列
+// 支持参数: interval（hour/day）、group（total/token/key/model）、value、from、to（RFC3339或Unix秒）
+func GetUsageAnalyticsHandler(c *gin.Context) {
+	interval := c.DefaultQuery("interval", AnalyticsHourly)
+	if interval != AnalyticsHourly && interval != AnalyticsDaily {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "interval 必须为 hour 或 day",
+		})
+		return
+	}
+
+	group := c.DefaultQuery("group", AnalyticsGroupTotal)
+	switch group {
+	case AnalyticsGroupTotal, AnalyticsGroupToken, AnalyticsGroupKey, AnalyticsGroupModel:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "group 必须为 total、token、key 或 model",
+		})
+		return
+	}
+
+	// 默认查询最近24小时或最近30天
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	if interval == AnalyticsDaily {
+		from = to.AddDate(0, 0, -30)
+	}
+	for param, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := c.Query(param); value != "" {
+			parsed, err := parseTimeParam(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": "error",
+					"error":  "无效的时间参数 " + param,
+				})
+				return
+			}
+			*target = parsed
+		}
+	}
+	from, to = from.In(time.Local), to.In(time.Local)
+
+	bucketSize := time.Hour
+	if interval == AnalyticsDaily {
+		bucketSize = 24 * time.Hour
+	}
+	if to.Before(from) || to.Sub(from)/bucketSize > analyticsMaxBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "时间范围无效或过大",
+		})
+		return
+	}
+
+	// 分组值支持传入token原文和API密钥原文
+	value := c.Query("value")
+	switch {
+	case value == "":
+	case group == AnalyticsGroupToken:
+		value = ResolveTokenID(value)
+	case group == AnalyticsGroupKey && !strings.HasPrefix(value, "fp:"):
+		value = logger.Fingerprint(value)
+	case group == AnalyticsGroupModel:
+		value = strings.ToLower(value)
+	}
+
+	buckets, series, err := QueryUsageAnalytics(interval, group, value, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "查询使用统计失败: " + err.Error(),
+		})
+		return
+	}
+
+	// token分组显示备注或脱敏token，便于图表展示
+	if group == AnalyticsGroupToken {
+		for _, s := range series {
+			fields, err := config.RedisHGetAll("token:" + s.Value)
+			if err != nil {
+				continue
+			}
+			s.Label = fields["remark"]
+			if s.Label == "" {
+				s.Label = fields["token_masked"]
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"interval": interval,
+		"group":    group,
+		"buckets":  buckets,
+		"series":   series,
+	})
+}
@@ -3,11 +3,11 @@ package api
 import (
 	"augment2api/config"
 	"augment2api/pkg/logger"
-	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
 // AuthMiddleware 验证请求的Authorization header
@@ -21,7 +21,7 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			logger.Log.Error("Authorization is empty")
+			logger.WithContext(c).Error("Authorization is empty")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
 			c.Abort()
 			return
@@ -32,7 +32,10 @@ func AuthMiddleware() gin.HandlerFunc {
 		token = strings.TrimSpace(token)
 
 		if token != config.AppConfig.AuthToken {
-			logger.Log.Error(fmt.Sprintf("Invalid authorization token:%s", token))
+			logger.WithContext(c).WithFields(logrus.Fields{
+				"token_fingerprint": logger.Fingerprint(token),
+				"client_ip":         c.ClientIP(),
+			}).Error("Invalid authorization token")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization token"})
 			c.Abort()
 			return
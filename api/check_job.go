@@ -0,0 +1,470 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// 批量检测任务状态
+const (
+	CheckJobRunning   = "running"
+	CheckJobCompleted = "completed"
+	CheckJobCancelled = "cancelled"
+)
+
+// 批量检测任务报告在Redis中的保留时间
+const checkJobRetention = 24 * time.Hour
+
+// 同时运行的批量检测任务上限，每个任务都会按健康检查并发数请求上游
+const maxRunningCheckJobs = 2
+
+// CheckJobResult 单个token的检测结果
+type CheckJobResult struct {
+	TokenID      string    `json:"token_id"`
+	Token        string    `json:"token"` // 脱敏后的token
+	OldTenantURL string    `json:"old_tenant_url"`
+	NewTenantURL string    `json:"new_tenant_url"`
+	Result       string    `json:"result"` // updated / unchanged / disabled / failed
+	Error        string    `json:"error,omitempty"`
+	CheckedAt    time.Time `json:"checked_at"`
+}
+
+// CheckJob 批量检测任务
+type CheckJob struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	Total      int              `json:"total"`
+	Done       int              `json:"done"`
+	Updated    int              `json:"updated"`
+	Disabled   int              `json:"disabled"`
+	Failed     int              `json:"failed"`
+	Results    []CheckJobResult `json:"results"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt time.Time        `json:"finished_at,omitempty"`
+
+	mu          sync.Mutex
+	cancel      context.CancelFunc
+	subscribers map[chan CheckJobEvent]struct{}
+}
+
+// CheckJobEvent 推送给SSE订阅者的事件
+type CheckJobEvent struct {
+	Type   string          `json:"type"` // result / done
+	Result *CheckJobResult `json:"result,omitempty"`
+	Job    *CheckJob       `json:"job,omitempty"`
+}
+
+// 运行中的批量检测任务
+var (
+	checkJobs   = make(map[string]*CheckJob)
+	checkJobsMu sync.Mutex
+)
+
+// snapshot 返回任务当前状态的副本，调用方需持有锁
+func (j *CheckJob) snapshot() *CheckJob {
+	return &CheckJob{
+		ID:         j.ID,
+		Status:     j.Status,
+		Total:      j.Total,
+		Done:       j.Done,
+		Updated:    j.Updated,
+		Disabled:   j.Disabled,
+		Failed:     j.Failed,
+		Results:    append([]CheckJobResult(nil), j.Results...),
+		CreatedAt:  j.CreatedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+// broadcast 向所有订阅者推送事件，调用方需持有锁
+func (j *CheckJob) broadcast(event CheckJobEvent) {
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// 订阅者处理过慢，丢弃事件，可通过查询接口获取完整结果
+		}
+	}
+}
+
+// addResult 记录单个token的检测结果
+func (j *CheckJob) addResult(result CheckJobResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Done++
+	switch result.Result {
+	case "updated":
+		j.Updated++
+	case "disabled":
+		j.Disabled++
+	case "failed":
+		j.Failed++
+	}
+	j.Results = append(j.Results, result)
+	j.broadcast(CheckJobEvent{Type: "result", Result: &result})
+}
+
+// subscribe 订阅任务事件，返回已完成的结果和事件通道
+func (j *CheckJob) subscribe() (*CheckJob, chan CheckJobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ch := make(chan CheckJobEvent, 64)
+	if j.Status != CheckJobRunning {
+		close(ch)
+	} else {
+		j.subscribers[ch] = struct{}{}
+	}
+	return j.snapshot(), ch
+}
+
+func (j *CheckJob) unsubscribe(ch chan CheckJobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.subscribers[ch]; ok {
+		delete(j.subscribers, ch)
+		close(ch)
+	}
+}
+
+// finish 结束任务，保存报告并通知订阅者
+func (j *CheckJob) finish(status string) {
+	j.mu.Lock()
+	j.Status = status
+	j.FinishedAt = time.Now()
+	snapshot := j.snapshot()
+	j.broadcast(CheckJobEvent{Type: "done", Job: snapshot})
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+	j.mu.Unlock()
+	j.cancel()
+
+	if err := saveCheckJob(snapshot); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"job_id": j.ID,
+			"error":  err.Error(),
+		}).Error("保存批量检测报告失败")
+	}
+
+	checkJobsMu.Lock()
+	delete(checkJobs, j.ID)
+	checkJobsMu.Unlock()
+
+	logger.Log.WithFields(logrus.Fields{
+		"job_id":   j.ID,
+		"status":   status,
+		"total":    snapshot.Total,
+		"updated":  snapshot.Updated,
+		"disabled": snapshot.Disabled,
+		"failed":   snapshot.Failed,
+	}).Info("批量检测任务结束")
+}
+
+// saveCheckJob 将任务报告保存到Redis
+func saveCheckJob(job *CheckJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return config.RedisSet("check_job:"+job.ID, string(data), checkJobRetention)
+}
+
+// getCheckJob 获取任务状态，运行中的任务从内存读取，已结束的任务从Redis读取
+func getCheckJob(id string) (*CheckJob, error) {
+	checkJobsMu.Lock()
+	job, ok := checkJobs[id]
+	checkJobsMu.Unlock()
+	if ok {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		return job.snapshot(), nil
+	}
+
+	data, err := config.RedisGet("check_job:" + id)
+	if err != nil {
+		return nil, err
+	}
+	var report CheckJob
+	if err := json.Unmarshal([]byte(data), &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// CheckToken 检测单个token并返回结果
+func CheckToken(ctx context.Context, tokenID string) CheckJobResult {
+	oldTenantURL, _ := config.RedisHGet("token:"+tokenID, "tenant_url")
+	maskedToken, _ := config.RedisHGet("token:"+tokenID, "token_masked")
+
+	newTenantURL, err := CheckTokenTenantURLContext(ctx, tokenID)
+	result := CheckJobResult{
+		TokenID:      tokenID,
+		Token:        maskedToken,
+		OldTenantURL: oldTenantURL,
+		NewTenantURL: newTenantURL,
+		CheckedAt:    time.Now(),
+	}
+
+	switch {
+	case errors.Is(err, ErrTokenDisabled):
+		result.Result = "disabled"
+		result.Error = err.Error()
+	case err != nil:
+		result.Result = "failed"
+		result.Error = err.Error()
+	case newTenantURL != oldTenantURL:
+		result.Result = "updated"
+	default:
+		result.Result = "unchanged"
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"token_id":       tokenID,
+		"old_tenant_url": oldTenantURL,
+		"new_tenant_url": newTenantURL,
+		"result":         result.Result,
+	}).Info("检测token租户地址")
+
+	return result
+}
+
+// run 使用有限并发执行批量检测
+func (j *CheckJob) run(ctx context.Context, tokens []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error":  r,
+				"job_id": j.ID,
+			}).Error("批量检测任务发生panic")
+		}
+	}()
+
+	concurrency := config.AppConfig.HealthCheckConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	tokenChan := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for token := range tokenChan {
+				j.addResult(CheckToken(ctx, token))
+			}
+		}()
+	}
+
+	cancelled := false
+	for _, token := range tokens {
+		select {
+		case <-ctx.Done():
+			cancelled = true
+		case tokenChan <- token:
+		}
+		if cancelled {
+			break
+		}
+	}
+	close(tokenChan)
+	wg.Wait()
+
+	if cancelled {
+		j.finish(CheckJobCancelled)
+	} else {
+		j.finish(CheckJobCompleted)
+	}
+}
+
+// CreateCheckJobHandler 创建批量检测任务
+func CreateCheckJobHandler(c *gin.Context) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token列表失败: " + err.Error(),
+		})
+		return
+	}
+
+	// 跳过已禁用或隔离的token
+	tokens := make([]string, 0, len(keys))
+	for _, key := range keys {
+		status, _ := config.RedisHGet(key, "status")
+		if !isTokenSelectable(status) {
+			continue
+		}
+		tokens = append(tokens, key[6:]) // 去掉前缀 "token:"，得到tokenID
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &CheckJob{
+		ID:          uuid.New().String(),
+		Status:      CheckJobRunning,
+		Total:       len(tokens),
+		Results:     make([]CheckJobResult, 0, len(tokens)),
+		CreatedAt:   time.Now(),
+		cancel:      cancel,
+		subscribers: make(map[chan CheckJobEvent]struct{}),
+	}
+
+	checkJobsMu.Lock()
+	if len(checkJobs) >= maxRunningCheckJobs {
+		checkJobsMu.Unlock()
+		cancel()
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"status": "error",
+			"error":  fmt.Sprintf("已有%d个检测任务正在运行，请等待结束或取消后再试", maxRunningCheckJobs),
+		})
+		return
+	}
+	checkJobs[job.ID] = job
+	checkJobsMu.Unlock()
+
+	go job.run(ctx, tokens)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"job_id": job.ID,
+		"total":  job.Total,
+	})
+}
+
+// GetCheckJobHandler 查询批量检测任务进度
+func GetCheckJobHandler(c *gin.Context) {
+	job, err := getCheckJob(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"error":  "检测任务不存在或已过期",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取检测任务失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"job":    job,
+	})
+}
+
+// CancelCheckJobHandler 取消批量检测任务
+func CancelCheckJobHandler(c *gin.Context) {
+	checkJobsMu.Lock()
+	job, ok := checkJobs[c.Param("id")]
+	checkJobsMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "检测任务不存在或已结束",
+		})
+		return
+	}
+
+	job.cancel()
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// CheckJobEventsHandler 以SSE方式推送批量检测结果
+func CheckJobEventsHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	checkJobsMu.Lock()
+	job, ok := checkJobs[id]
+	checkJobsMu.Unlock()
+
+	var snapshot *CheckJob
+	var events chan CheckJobEvent
+	if ok {
+		snapshot, events = job.subscribe()
+		defer job.unsubscribe(events)
+	} else {
+		// 任务已结束，直接推送最终报告
+		report, err := getCheckJob(id)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "error",
+				"error":  "检测任务不存在或已过期",
+			})
+			return
+		}
+		snapshot = report
+	}
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "流式传输不支持"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	writeEvent := func(event CheckJobEvent) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, data)
+		flusher.Flush()
+	}
+
+	// 先推送已完成的结果
+	for i := range snapshot.Results {
+		writeEvent(CheckJobEvent{Type: "result", Result: &snapshot.Results[i]})
+	}
+	if events == nil || snapshot.Status != CheckJobRunning {
+		writeEvent(CheckJobEvent{Type: "done", Job: snapshot})
+		return
+	}
+
+	sentDone := false
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// 结束事件可能因订阅者过慢被丢弃，补发最终报告
+				if !sentDone {
+					if report, err := getCheckJob(id); err == nil {
+						writeEvent(CheckJobEvent{Type: "done", Job: report})
+					}
+				}
+				return
+			}
+			writeEvent(event)
+			if event.Type == "done" {
+				sentDone = true
+			}
+		}
+	}
+}
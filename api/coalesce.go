@@ -0,0 +1,282 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 合并中的上游请求在gin上下文中的键名，发起请求的一方据此向其他请求转发回复
+const coalesceFlightKey = "coalesce_flight"
+
+// flight 一次进行中的上游请求，同时到达的相同请求订阅它的回复而不再占用token
+type flight struct {
+	key string
+
+	mu           sync.Mutex
+	chunks       []string      // 已发送给发起方的回复片段
+	text         string        // 成功完成时的完整回复
+	promptTokens int           // 估算的提示词token数量
+	done         bool          // 上游请求已结束
+	ok           bool          // 上游请求成功完成
+	updated      chan struct{} // 有新片段或请求结束时关闭并替换，用于通知订阅者
+	finished     chan struct{} // 请求结束时关闭
+
+	// 上游请求使用的context，发起方断开后仍为其他订阅者继续，所有请求都断开时取消
+	ctx          context.Context
+	cancel       context.CancelFunc
+	participants int // 仍在等待回复的请求数，由flightsMu保护
+}
+
+var (
+	flights   = make(map[string]*flight)
+	flightsMu sync.Mutex
+)
+
+// joinFlight 加入相同请求的进行中上游请求，没有时创建一个并由本请求发起
+func joinFlight(key string) (f *flight, leader bool) {
+	flightsMu.Lock()
+	defer flightsMu.Unlock()
+
+	if f, exists := flights[key]; exists {
+		f.participants++
+		return f, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f = &flight{
+		key:          key,
+		updated:      make(chan struct{}),
+		finished:     make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		participants: 1,
+	}
+	flights[key] = f
+	return f, true
+}
+
+// watch 请求断开时退出，所有请求都断开后取消上游请求
+func (f *flight) watch(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.leave()
+		case <-f.finished:
+		}
+	}()
+}
+
+func (f *flight) leave() {
+	flightsMu.Lock()
+	defer flightsMu.Unlock()
+
+	f.participants--
+	if f.participants > 0 {
+		return
+	}
+	// 不再接受新的订阅者，上游请求随之结束
+	if flights[f.key] == f {
+		delete(flights, f.key)
+	}
+	f.cancel()
+}
+
+// publish 转发一个回复片段给订阅者
+func (f *flight) publish(text string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.chunks = append(f.chunks, text)
+	close(f.updated)
+	f.updated = make(chan struct{})
+}
+
+// finish 结束上游请求，result为nil表示请求失败或被block
+func (f *flight) finish(result *chatResult) {
+	flightsMu.Lock()
+	if flights[f.key] == f {
+		delete(flights, f.key)
+	}
+	flightsMu.Unlock()
+
+	f.mu.Lock()
+	f.done = true
+	if result != nil {
+		f.ok = true
+		f.text = result.Text
+		f.promptTokens = result.PromptTokens
+	}
+	close(f.updated)
+	close(f.finished)
+	f.mu.Unlock()
+	f.cancel()
+}
+
+// upstreamContext 返回上游请求使用的context
+// 合并了相同请求时使用flight的context，发起方断开后上游请求继续为其他订阅者进行
+func upstreamContext(c *gin.Context) context.Context {
+	if value, exists := c.Get(coalesceFlightKey); exists {
+		return value.(*flight).ctx
+	}
+	return c.Request.Context()
+}
+
+// publishChunk 发起方将已发送的流式片段转发给订阅者，没有合并请求时不做任何事
+func publishChunk(c *gin.Context, text string) {
+	if value, exists := c.Get(coalesceFlightKey); exists {
+		value.(*flight).publish(text)
+	}
+}
+
+// follow 等待发起方的回复并按本请求的格式返回
+// 流式请求逐个转发片段，非流式请求等待完整回复；发起方失败且尚未返回任何内容时返回false，由本请求单独请求上游
+func (f *flight) follow(c *gin.Context, req *OpenAIRequest) bool {
+	reqLog := requestLogFrom(c)
+	var promptText string
+	if len(req.Messages) > 0 {
+		promptText = req.Messages[len(req.Messages)-1].GetContent()
+	}
+	if reqLog != nil {
+		reqLog.Model = req.Model
+		reqLog.Stream = req.Stream
+		reqLog.Coalesced = true
+	}
+
+	if !req.Stream {
+		select {
+		case <-f.finished:
+		case <-c.Request.Context().Done():
+			return true
+		}
+		if !f.ok {
+			return false
+		}
+		reqLog.markFirstByte()
+		reqLog.setUsage(f.promptTokens, estimateTokenCount(f.text))
+		reqLog.setBodies(promptText, f.text)
+		c.JSON(http.StatusOK, chatCompletionResponse(req.Model, f.text, f.promptTokens))
+		return true
+	}
+
+	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
+	var sent strings.Builder
+	started := false
+	next := 0
+	for {
+		f.mu.Lock()
+		chunks := f.chunks[next:]
+		next = len(f.chunks)
+		done, ok, text, promptTokens, updated := f.done, f.ok, f.text, f.promptTokens, f.updated
+		f.mu.Unlock()
+
+		// 非流式的发起方只在结束时提供完整回复
+		if done && ok && next == 0 {
+			chunks = []string{text}
+		}
+		if len(chunks) > 0 && !started {
+			startEventStream(c)
+			reqLog.markFirstByte()
+			started = true
+		}
+		for _, chunk := range chunks {
+			writeStreamChunk(c, responseID, req.Model, chunk, nil)
+			sent.WriteString(chunk)
+		}
+
+		if done {
+			if !started && !ok {
+				return false
+			}
+			reqLog.setUsage(promptTokens, estimateTokenCount(sent.String()))
+			reqLog.setBodies(promptText, sent.String())
+			if ok {
+				if !started {
+					startEventStream(c)
+				}
+				finishReason := "stop"
+				writeStreamChunk(c, responseID, req.Model, "", &finishReason)
+			} else {
+				// 发起方的回复中途失败，告知客户端回复不完整
+				writeStreamError(c, "上游请求中途失败，回复不完整")
+			}
+			fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+			c.Writer.Flush()
+			return true
+		}
+
+		select {
+		case <-updated:
+		case <-c.Request.Context().Done():
+			return true
+		}
+	}
+}
+
+// writeStreamError 发送一个流式错误事件，客户端据此区分正常结束和中途失败
+func writeStreamError(c *gin.Context, message string) {
+	jsonResp, err := json.Marshal(gin.H{"error": message})
+	if err != nil {
+		logger.WithContext(c).Errorf("序列化错误事件失败: %v", err)
+		return
+	}
+	fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+	c.Writer.Flush()
+}
+
+// RequestCoalescingMiddleware 相同的聊天请求同时进行时只发送一次上游请求，只占用一个token
+// 第一个请求正常请求上游，之后到达的相同请求订阅它的回复；通过 REQUEST_COALESCING 开启，请求头 Cache-Control: no-cache 跳过合并
+func RequestCoalescingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.Current().RequestCoalescing || !isChatCompletionsRoute(c) {
+			c.Next()
+			return
+		}
+		req := peekChatRequest(c)
+		if len(req.Messages) == 0 {
+			c.Next()
+			return
+		}
+		if noCache, _ := cacheControl(c); noCache {
+			c.Next()
+			return
+		}
+
+		// 与回复缓存使用相同的请求匹配规则
+		f, leader := joinFlight(responseCacheKey(c, req))
+		f.watch(c.Request.Context())
+		log := logger.WithContext(c).WithField("model", req.Model)
+
+		if !leader {
+			log.Info("合并到进行中的相同请求")
+			if f.follow(c, req) {
+				c.Abort()
+				return
+			}
+			log.Warn("进行中的相同请求失败，单独请求上游")
+			if reqLog := requestLogFrom(c); reqLog != nil {
+				reqLog.Coalesced = false
+			}
+			c.Next()
+			return
+		}
+
+		c.Set(coalesceFlightKey, f)
+		var result *chatResult
+		// 无论请求如何结束都要通知订阅者
+		defer func() { f.finish(result) }()
+		c.Next()
+
+		if value, exists := c.Get(chatResultKey); exists && c.Writer.Status() == http.StatusOK {
+			chat := value.(chatResult)
+			result = &chat
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package api
+
+import (
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// 发送给上游的补全指令，prompt和suffix分别作为光标前后的代码
+const completionInstruction = "Complete the code at the cursor, between the prefix and the suffix. " +
+	"Reply with only the text to insert, without explanations or markdown code fences."
+
+// CompletionRequest OpenAI兼容的旧版文本补全请求
+type CompletionRequest struct {
+	Model       string      `json:"model"`
+	Prompt      interface{} `json:"prompt"` // 字符串或只包含一个字符串的数组
+	Suffix      string      `json:"suffix,omitempty"`
+	MaxTokens   int         `json:"max_tokens,omitempty"`
+	Temperature float64     `json:"temperature,omitempty"`
+	Stream      bool        `json:"stream,omitempty"`
+	Echo        bool        `json:"echo,omitempty"`
+	N           int         `json:"n,omitempty"`
+}
+
+// CompletionChoice 文本补全结果
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+// CompletionResponse OpenAI兼容的文本补全响应，流式响应的每个片段使用相同的结构
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+// completionPrompt 解析prompt，不支持token数组和多个prompt
+func completionPrompt(prompt interface{}) (string, error) {
+	switch v := prompt.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		if len(v) == 1 {
+			if text, ok := v[0].(string); ok {
+				return text, nil
+			}
+		}
+		return "", fmt.Errorf("prompt 只支持字符串或只包含一个字符串的数组")
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("prompt 只支持字符串或只包含一个字符串的数组")
+	}
+}
+
+// validateCompletionText 检查prompt和suffix的长度，限制与工作区上下文相同
+func validateCompletionText(name, value string) error {
+	if len(value) > maxWorkspaceTextBytes {
+		return fmt.Errorf("%s 超过%dKB", name, maxWorkspaceTextBytes>>10)
+	}
+	return nil
+}
+
+// CompletionsHandler 处理旧版文本补全请求
+// prompt和suffix作为光标前后的代码发送给上游，模式和使用统计与聊天接口一样由model决定
+func CompletionsHandler(c *gin.Context) {
+	defer cleanupRequestStatus(c)
+
+	var req CompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
+		return
+	}
+	prompt, err := completionPrompt(req.Prompt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(prompt) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prompt 不能为空"})
+		return
+	}
+	if req.N > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不支持 n 大于1"})
+		return
+	}
+	if req.MaxTokens < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_tokens 不能为负数"})
+		return
+	}
+	for _, field := range []struct{ name, value string }{{"prompt", prompt}, {"suffix", req.Suffix}} {
+		if err := validateCompletionText(field.name, field.value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	augmentReq, err := convertToAugmentRequest(OpenAIRequest{
+		Model:    req.Model,
+		Messages: []ChatMessage{{Role: "user", Content: completionInstruction}},
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// 光标前后的代码直接作为前缀和后缀，语言按代码检测
+	augmentReq.Prefix = prompt
+	augmentReq.Suffix = req.Suffix
+	augmentReq.Lang = detectLanguage(OpenAIRequest{
+		Messages: []ChatMessage{{Role: "user", Content: prompt + "\n" + req.Suffix}},
+	})
+
+	reqLog := requestLogFrom(c)
+	if reqLog != nil {
+		reqLog.Model = req.Model
+		reqLog.Mode = augmentReq.Mode
+		reqLog.Stream = req.Stream
+	}
+
+	// 从上下文中获取token和tenant_url
+	token, tenant := c.GetString("token"), c.GetString("tenant_url")
+	if token == "" || tenant == "" {
+		token, tenant = GetAuthInfo()
+	}
+	if token == "" || tenant == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "无可用Token,请先在管理页面获取"})
+		return
+	}
+	tokenID := c.GetString("token_id")
+	if tokenID == "" {
+		tokenID = TokenID(token)
+	}
+	asyncIncrementTokenUsage(tokenID, req.Model)
+
+	requestID := requestIDFromContext(c)
+	sessionID := uuid.New().String()
+
+	responseID := fmt.Sprintf("cmpl-%d", time.Now().Unix())
+	promptTokens := estimateTokenCount(prompt) + estimateTokenCount(req.Suffix)
+	finishReason := "stop"
+	var fullText strings.Builder
+	started := false
+	start := func() {
+		started = true
+		reqLog.markFirstByte()
+		if !req.Stream {
+			return
+		}
+		startEventStream(c)
+		if req.Echo {
+			writeCompletionChunk(c, responseID, req.Model, prompt, nil)
+		}
+	}
+
+	err = streamUpstreamChat(c.Request.Context(), token, tenant, requestID, sessionID, augmentReq, func(text string) bool {
+		if !started {
+			start()
+		}
+		fullText.WriteString(text)
+		if req.Stream {
+			writeCompletionChunk(c, responseID, req.Model, text, nil)
+		}
+		// 上游不支持限制回复长度，按估算的token数量提前结束
+		if req.MaxTokens > 0 && estimateTokenCount(fullText.String()) >= req.MaxTokens {
+			finishReason = "length"
+			return false
+		}
+		return true
+	})
+	text := fullText.String()
+	reqLog.setUsage(promptTokens, estimateTokenCount(text))
+	reqLog.setBodies(prompt, text)
+
+	if err != nil {
+		log := logger.WithContext(c).WithFields(logrus.Fields{
+			"token_id": tokenID,
+			"error":    err.Error(),
+		})
+		if errors.Is(err, errUpstreamBlocked) {
+			reqLog.markBlocked()
+			log.Info("检测到block信息，将token加入冷却队列10分钟")
+			if err := SetTokenCoolStatus(tokenID, 10*time.Minute); err != nil {
+				log.WithField("error", err.Error()).Error("将token加入冷却队列失败")
+			}
+		} else {
+			log.Error("文本补全请求失败")
+		}
+		// 已开始返回的流式回复直接结束，与聊天接口一致
+		if started && req.Stream {
+			return
+		}
+		var statusErr *upstreamStatusError
+		switch {
+		case errors.As(err, &statusErr):
+			c.JSON(statusErr.StatusCode, gin.H{"error": "Augment response error: " + statusErr.Body})
+		case errors.Is(err, errUpstreamBlocked):
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	asyncRecordSessionEvent(token, tenant, requestID, sessionID)
+
+	if !req.Stream {
+		if req.Echo {
+			text = prompt + text
+		}
+		completionTokens := estimateTokenCount(fullText.String())
+		c.JSON(http.StatusOK, CompletionResponse{
+			ID:      responseID,
+			Object:  "text_completion",
+			Created: time.Now().Unix(),
+			Model:   req.Model,
+			Choices: []CompletionChoice{{Text: text, Index: 0, FinishReason: &finishReason}},
+			Usage: &Usage{
+				PromptTokens:     promptTokens,
+				CompletionTokens: completionTokens,
+				TotalTokens:      promptTokens + completionTokens,
+			},
+		})
+		return
+	}
+
+	if !started {
+		start()
+	}
+	writeCompletionChunk(c, responseID, req.Model, "", &finishReason)
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+}
+
+// writeCompletionChunk 发送一个旧版文本补全格式的流式片段
+func writeCompletionChunk(c *gin.Context, responseID, model, text string, finishReason *string) {
+	jsonResp, err := json.Marshal(CompletionResponse{
+		ID:      responseID,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []CompletionChoice{{Text: text, Index: 0, FinishReason: finishReason}},
+	})
+	if err != nil {
+		logger.WithContext(c).Errorf("序列化响应失败: %v", err)
+		return
+	}
+	fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+	c.Writer.Flush()
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompletionPrompt(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompt  interface{}
+		want    string
+		wantErr bool
+	}{
+		{"string", "def add(a, b):", "def add(a, b):", false},
+		{"nil", nil, "", false},
+		{"single item array", []interface{}{"x = 1"}, "x = 1", false},
+		{"multiple prompts", []interface{}{"a", "b"}, "", true},
+		{"empty array", []interface{}{}, "", true},
+		{"token array", []interface{}{float64(1), float64(2)}, "", true},
+		{"number", float64(1), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := completionPrompt(tt.prompt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("completionPrompt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCompletionText(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   string
+		value   string
+		wantErr string
+	}{
+		{"empty", "prompt", "", ""},
+		{"at limit", "prompt", strings.Repeat("x", maxWorkspaceTextBytes), ""},
+		{"prompt too long", "prompt", strings.Repeat("x", maxWorkspaceTextBytes+1), "prompt 超过512KB"},
+		{"suffix too long", "suffix", strings.Repeat("x", maxWorkspaceTextBytes+1), "suffix 超过512KB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCompletionText(tt.field, tt.value)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			// 错误信息使用请求中的字段名，而不是工作区上下文的字段名
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
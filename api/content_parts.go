@@ -0,0 +1,259 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// 图片请求节点的类型，与Augment插件一致
+const requestNodeImage = 2
+
+// 图片格式，与Augment插件一致
+const (
+	imageFormatPNG  = 1
+	imageFormatJPEG = 2
+	imageFormatGIF  = 3
+	imageFormatWEBP = 4
+)
+
+const (
+	// 单个图片或文件解码后的最大字节数
+	maxContentPartBytes = 5 << 20
+)
+
+var imageFormats = map[string]int{
+	"image/png":  imageFormatPNG,
+	"image/jpeg": imageFormatJPEG,
+	"image/gif":  imageFormatGIF,
+	"image/webp": imageFormatWEBP,
+}
+
+// 可以作为文本嵌入消息的非 text/* 文件类型
+var textFileTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/toml":       true,
+	"application/x-sh":       true,
+	"application/sql":        true,
+}
+
+// ImageNode 图片请求节点，图片数据为base64编码
+type ImageNode struct {
+	ImageData string `json:"image_data"`
+	Format    int    `json:"format"`
+}
+
+// messageContent 解析后的消息内容：文本部分合并为消息文本，图片作为请求节点发送
+type messageContent struct {
+	Text   string
+	Images []Node
+}
+
+// ContentPartError 消息中包含无法转换的内容
+type ContentPartError struct {
+	Message int // 消息序号
+	Part    int // 内容序号
+	Reason  string
+}
+
+func (e *ContentPartError) Error() string {
+	if e.Part < 0 {
+		return fmt.Sprintf("messages[%d].content: %s", e.Message, e.Reason)
+	}
+	return fmt.Sprintf("messages[%d].content[%d]: %s", e.Message, e.Part, e.Reason)
+}
+
+// parseMessageContent 解析OpenAI格式的消息内容，支持文本、图片（base64或data URL）和文件
+// 文本文件嵌入消息文本，图片文件作为图片节点，其他无法表示的内容返回错误，不会静默丢弃
+func parseMessageContent(index int, content interface{}) (messageContent, error) {
+	var result messageContent
+	switch v := content.(type) {
+	case nil:
+		return result, nil
+	case string:
+		result.Text = v
+		return result, nil
+	case []interface{}:
+	default:
+		return result, &ContentPartError{Message: index, Part: -1, Reason: "content 必须为字符串或数组"}
+	}
+
+	var files []string
+	for i, item := range content.([]interface{}) {
+		fail := func(format string, args ...interface{}) (messageContent, error) {
+			return messageContent{}, &ContentPartError{Message: index, Part: i, Reason: fmt.Sprintf(format, args...)}
+		}
+
+		part, ok := item.(map[string]interface{})
+		if !ok {
+			return fail("内容必须为对象")
+		}
+		partType, _ := part["type"].(string)
+		switch partType {
+		case "text", "input_text":
+			text, _ := part["text"].(string)
+			result.Text += text
+
+		case "image_url", "input_image":
+			var imageURL string
+			switch image := part["image_url"].(type) {
+			case string:
+				imageURL = image
+			case map[string]interface{}:
+				imageURL, _ = image["url"].(string)
+			}
+			if imageURL == "" {
+				return fail("缺少图片地址")
+			}
+			if strings.HasPrefix(imageURL, "http://") || strings.HasPrefix(imageURL, "https://") {
+				return fail("不支持远程图片地址，请使用base64或data URL")
+			}
+			data, mediaType, err := decodeContentData(imageURL)
+			if err != nil {
+				return fail("图片数据无效: %v", err)
+			}
+			node, err := imageNode(len(result.Images)+1, data, mediaType)
+			if err != nil {
+				return fail("%v", err)
+			}
+			result.Images = append(result.Images, node)
+
+		case "file", "input_file":
+			file, _ := part["file"].(map[string]interface{})
+			if file == nil {
+				file = part
+			}
+			filename, _ := file["filename"].(string)
+			fileData, _ := file["file_data"].(string)
+			if fileData == "" {
+				if fileID, _ := file["file_id"].(string); fileID != "" {
+					return fail("不支持file_id引用的文件，请使用file_data传入文件内容")
+				}
+				return fail("缺少文件内容")
+			}
+			data, mediaType, err := decodeContentData(fileData)
+			if err != nil {
+				return fail("文件数据无效: %v", err)
+			}
+			if mediaType == "" || mediaType == "application/octet-stream" {
+				mediaType = mime.TypeByExtension(path.Ext(filename))
+			}
+			if _, isImage := imageFormats[baseMediaType(mediaType)]; isImage {
+				node, err := imageNode(len(result.Images)+1, data, mediaType)
+				if err != nil {
+					return fail("%v", err)
+				}
+				result.Images = append(result.Images, node)
+				continue
+			}
+			if !isTextFile(mediaType, data) {
+				return fail("不支持的文件类型 %s，只支持文本文件和图片", fileTypeName(mediaType))
+			}
+			if filename == "" {
+				filename = fmt.Sprintf("file%d", len(files)+1)
+			}
+			files = append(files, fmt.Sprintf("File: %s\n```\n%s\n```", filename, strings.TrimRight(string(data), "\n")))
+
+		default:
+			return fail("不支持的内容类型 %q", partType)
+		}
+	}
+
+	// 文件内容附加在消息文本之后
+	if len(files) > 0 {
+		sections := append([]string{}, files...)
+		if result.Text != "" {
+			sections = append([]string{result.Text}, sections...)
+		}
+		result.Text = strings.Join(sections, "\n\n")
+	}
+	return result, nil
+}
+
+// decodeContentData 解码data URL或纯base64数据，返回数据和data URL中声明的类型
+func decodeContentData(value string) ([]byte, string, error) {
+	var mediaType string
+	if strings.HasPrefix(value, "data:") {
+		comma := strings.Index(value, ",")
+		if comma < 0 {
+			return nil, "", fmt.Errorf("data URL格式错误")
+		}
+		meta := value[len("data:"):comma]
+		if !strings.HasSuffix(meta, ";base64") {
+			return nil, "", fmt.Errorf("data URL必须使用base64编码")
+		}
+		mediaType = strings.ToLower(strings.TrimSuffix(meta, ";base64"))
+		value = value[comma+1:]
+	}
+
+	if base64.StdEncoding.DecodedLen(len(value)) > maxContentPartBytes+3 {
+		return nil, "", fmt.Errorf("超过%dMB大小限制", maxContentPartBytes>>20)
+	}
+	value = strings.TrimSpace(value)
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		// 兼容不带填充的base64
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "=")); err != nil {
+			return nil, "", fmt.Errorf("base64解码失败")
+		}
+	}
+	if len(data) > maxContentPartBytes {
+		return nil, "", fmt.Errorf("超过%dMB大小限制", maxContentPartBytes>>20)
+	}
+	return data, mediaType, nil
+}
+
+// imageNode 生成图片请求节点，未声明类型时根据内容判断
+func imageNode(id int, data []byte, mediaType string) (Node, error) {
+	detected := http.DetectContentType(data)
+	format, ok := imageFormats[detected]
+	if !ok {
+		if mediaType == "" {
+			mediaType = detected
+		}
+		return Node{}, fmt.Errorf("不支持的图片格式 %s，只支持PNG、JPEG、GIF和WEBP", fileTypeName(baseMediaType(mediaType)))
+	}
+	return Node{
+		ID:   id,
+		Type: requestNodeImage,
+		ImageNode: &ImageNode{
+			ImageData: base64.StdEncoding.EncodeToString(data),
+			Format:    format,
+		},
+	}, nil
+}
+
+// isTextFile 判断文件是否可以作为文本嵌入消息
+func isTextFile(mediaType string, data []byte) bool {
+	mediaType = baseMediaType(mediaType)
+	if mediaType == "" {
+		mediaType = baseMediaType(http.DetectContentType(data))
+	}
+	if !strings.HasPrefix(mediaType, "text/") && !textFileTypes[mediaType] &&
+		!strings.HasSuffix(mediaType, "+json") && !strings.HasSuffix(mediaType, "+xml") {
+		return false
+	}
+	return utf8.Valid(data)
+}
+
+func baseMediaType(mediaType string) string {
+	if parsed, _, err := mime.ParseMediaType(mediaType); err == nil {
+		return parsed
+	}
+	return strings.ToLower(mediaType)
+}
+
+func fileTypeName(mediaType string) string {
+	if mediaType == "" {
+		return "未知"
+	}
+	return mediaType
+}
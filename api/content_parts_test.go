@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDecodeContentData(t *testing.T) {
+	hello := base64.StdEncoding.EncodeToString([]byte("hello"))
+	tests := []struct {
+		name          string
+		value         string
+		wantData      string
+		wantMediaType string
+		wantErr       string
+	}{
+		{"plain base64", hello, "hello", "", ""},
+		{"unpadded base64", strings.TrimRight(hello, "="), "hello", "", ""},
+		{"data url", "data:Text/Plain;base64," + hello, "hello", "text/plain", ""},
+		{"data url without comma", "data:text/plain;base64", "", "", "格式错误"},
+		{"data url not base64", "data:text/plain,hello", "", "", "base64编码"},
+		{"invalid base64", "not base64!", "", "", "解码失败"},
+		{"too large", strings.Repeat("A", (maxContentPartBytes+8)/3*4), "", "", "大小限制"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, mediaType, err := decodeContentData(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantData || mediaType != tt.wantMediaType {
+				t.Errorf("got %q %q, want %q %q", data, mediaType, tt.wantData, tt.wantMediaType)
+			}
+		})
+	}
+}
+
+func TestParseMessageContent(t *testing.T) {
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"))
+	text := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name       string
+		content    interface{}
+		wantText   string
+		wantImages int
+		wantErr    string
+	}{
+		{"nil", nil, "", 0, ""},
+		{"string", "hi", "hi", 0, ""},
+		{"invalid type", 42, "", 0, "messages[0].content: content 必须为字符串或数组"},
+		{
+			name: "text parts",
+			content: []interface{}{
+				map[string]interface{}{"type": "text", "text": "a"},
+				map[string]interface{}{"type": "input_text", "text": "b"},
+			},
+			wantText: "ab",
+		},
+		{
+			name: "image data url",
+			content: []interface{}{
+				map[string]interface{}{"type": "text", "text": "look"},
+				map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "data:image/png;base64," + png}},
+				map[string]interface{}{"type": "input_image", "image_url": png},
+			},
+			wantText:   "look",
+			wantImages: 2,
+		},
+		{
+			name:    "remote image",
+			content: []interface{}{map[string]interface{}{"type": "image_url", "image_url": "https://example.com/a.png"}},
+			wantErr: "messages[0].content[0]: 不支持远程图片地址",
+		},
+		{
+			name:    "unsupported image format",
+			content: []interface{}{map[string]interface{}{"type": "image_url", "image_url": text("plain text")}},
+			wantErr: "不支持的图片格式",
+		},
+		{
+			name: "text file",
+			content: []interface{}{
+				map[string]interface{}{"type": "text", "text": "review"},
+				map[string]interface{}{"type": "file", "file": map[string]interface{}{"filename": "main.go", "file_data": text("package main\n")}},
+			},
+			wantText: "review\n\nFile: main.go\n```\npackage main\n```",
+		},
+		{
+			name:       "image file",
+			content:    []interface{}{map[string]interface{}{"type": "input_file", "filename": "a.png", "file_data": png}},
+			wantImages: 1,
+		},
+		{
+			name:    "binary file",
+			content: []interface{}{map[string]interface{}{"type": "file", "file": map[string]interface{}{"filename": "a.zip", "file_data": text("PK\x03\x04")}}},
+			wantErr: "不支持的文件类型 application/zip",
+		},
+		{
+			name:    "file id",
+			content: []interface{}{map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_id": "file-1"}}},
+			wantErr: "不支持file_id",
+		},
+		{
+			name:    "unknown part",
+			content: []interface{}{map[string]interface{}{"type": "input_audio"}},
+			wantErr: `不支持的内容类型 "input_audio"`,
+		},
+		{
+			name:    "part not object",
+			content: []interface{}{"text"},
+			wantErr: "内容必须为对象",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMessageContent(0, tt.content)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Text != tt.wantText || len(got.Images) != tt.wantImages {
+				t.Errorf("got text %q images %d, want %q %d", got.Text, len(got.Images), tt.wantText, tt.wantImages)
+			}
+			for i, node := range got.Images {
+				if node.ID != i+1 || node.Type != requestNodeImage || node.ImageNode.Format != imageFormatPNG {
+					t.Errorf("unexpected image node %+v", node)
+				}
+			}
+		})
+	}
+}
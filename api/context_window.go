@@ -0,0 +1,303 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// 上下文截断情况的响应头
+const (
+	ContextTruncatedHeader  = "X-Context-Truncated"  // 从历史中移除的轮数
+	ContextSummarizedHeader = "X-Context-Summarized" // 移除的轮次是否以摘要形式保留
+)
+
+const (
+	// 摘要缓存，相同的历史只总结一次
+	contextSummaryPrefix = "context_summary:"
+	contextSummaryTTL    = time.Hour
+	// 发送给上游总结的历史最大字符数，超出时保留较新的部分
+	contextSummaryInputLimit = 32000
+	// 总结请求的超时时间
+	contextSummaryTimeout = 60 * time.Second
+	// 总结请求计入CHAT模式的使用次数
+	contextSummaryModel = "context-summary-chat"
+)
+
+const contextSummaryPrompt = "Summarize the earlier part of the conversation below so it can replace the original messages as context. " +
+	"Keep facts, decisions, code identifiers and open questions; omit pleasantries. Reply with the summary only, in the language of the conversation, within 300 words.\n\n"
+
+// 摘要在历史中的提问，回复为摘要内容
+const contextSummaryRequest = "[Summary of the earlier conversation]"
+
+var errNoSpareToken = errors.New("没有可用于总结的空闲token")
+
+// contextTokens 估算文本的token数量，用于上下文预算
+// 代码等不含空格的文本按每4个字符1个token计算，取两种估算中较大的值
+func contextTokens(text string) int {
+	estimated := estimateTokenCount(text)
+	if byChars := utf8.RuneCountInString(text) / 4; byChars > estimated {
+		return byChars
+	}
+	return estimated
+}
+
+func historyTokens(history AugmentChatHistory) int {
+	return contextTokens(history.RequestMessage) + contextTokens(history.ResponseText)
+}
+
+// fitContextWindow 历史超出模型的上下文预算时移除最早的轮次，按配置丢弃或总结为摘要
+// 用户指南、工作区上下文和当前消息始终保留，截断情况通过响应头返回
+func fitContextWindow(c *gin.Context, augmentReq *AugmentRequest, model string) {
+	runtimeConfig := config.Current()
+	budget := runtimeConfig.ContextBudget(model)
+	if budget <= 0 || len(augmentReq.ChatHistory) == 0 {
+		return
+	}
+
+	total := contextTokens(augmentReq.UserGuideLines) + contextTokens(augmentReq.WorkspaceGuidelines) +
+		contextTokens(augmentReq.Prefix) + contextTokens(augmentReq.Suffix) + contextTokens(augmentReq.Message)
+	turnTokens := make([]int, len(augmentReq.ChatHistory))
+	for i, history := range augmentReq.ChatHistory {
+		turnTokens[i] = historyTokens(history)
+		total += turnTokens[i]
+	}
+	if total <= budget {
+		return
+	}
+
+	// 从最早的轮次开始移除，直到满足预算
+	dropped := 0
+	for dropped < len(augmentReq.ChatHistory) && total > budget {
+		total -= turnTokens[dropped]
+		dropped++
+	}
+	removed := augmentReq.ChatHistory[:dropped]
+	kept := augmentReq.ChatHistory[dropped:]
+
+	log := logger.WithContext(c).WithFields(logrus.Fields{
+		"model":          model,
+		"context_budget": budget,
+		"dropped_turns":  dropped,
+		"kept_turns":     len(kept),
+	})
+
+	summarized := false
+	if runtimeConfig.ContextTruncation == config.ContextTruncationSummarize {
+		summary, err := summarizeHistory(c, removed)
+		if err != nil {
+			log.WithField("error", err.Error()).Warn("总结历史失败，直接丢弃最早的轮次")
+		} else {
+			summaryTurn := AugmentChatHistory{
+				RequestMessage: contextSummaryRequest,
+				ResponseText:   summary,
+				RequestID:      generateRequestID(),
+				RequestNodes:   make([]Node, 0),
+				ResponseNodes:  []Node{{Content: summary}},
+			}
+			// 摘要本身放不下时退化为直接丢弃
+			if total+historyTokens(summaryTurn) <= budget {
+				kept = append([]AugmentChatHistory{summaryTurn}, kept...)
+				summarized = true
+			}
+		}
+	}
+
+	augmentReq.ChatHistory = append(make([]AugmentChatHistory, 0, len(kept)), kept...)
+	if reqLog := requestLogFrom(c); reqLog != nil {
+		reqLog.ContextTruncated = dropped
+	}
+	c.Header(ContextTruncatedHeader, strconv.Itoa(dropped))
+	if summarized {
+		c.Header(ContextSummarizedHeader, "true")
+	}
+	log.WithField("summarized", summarized).Info("历史超出上下文预算，已截断")
+}
+
+// historyTranscript 将要总结的历史转换为文本，超出长度时保留较新的部分
+func historyTranscript(history []AugmentChatHistory) string {
+	var transcript strings.Builder
+	for _, turn := range history {
+		transcript.WriteString("User: ")
+		transcript.WriteString(turn.RequestMessage)
+		transcript.WriteString("\n\nAssistant: ")
+		transcript.WriteString(turn.ResponseText)
+		transcript.WriteString("\n\n")
+	}
+	text := transcript.String()
+	if runes := []rune(text); len(runes) > contextSummaryInputLimit {
+		text = string(runes[len(runes)-contextSummaryInputLimit:])
+	}
+	return text
+}
+
+// contextSummaryKey 返回历史摘要的缓存键
+func contextSummaryKey(transcript string) string {
+	sum := sha256.Sum256([]byte(transcript))
+	return contextSummaryPrefix + hex.EncodeToString(sum[:16])
+}
+
+// summarizeHistory 使用一个空闲token调用上游CHAT模式总结历史，相同的历史复用缓存的摘要
+func summarizeHistory(c *gin.Context, history []AugmentChatHistory) (string, error) {
+	text := historyTranscript(history)
+	cacheKey := contextSummaryKey(text)
+	if summary, err := config.RedisGet(cacheKey); err == nil && summary != "" {
+		return summary, nil
+	} else if err != nil && !errors.Is(err, redis.Nil) {
+		logger.WithContext(c).WithField("error", err.Error()).Warn("读取历史摘要缓存失败")
+	}
+
+	// 当前请求的token已标记为使用中，不会被再次选中
+	tokenID, tenantURL, _ := GetAvailableToken(TokenGroupsFor(c), "")
+	if tokenID == "No token" || tokenID == "No available token" || tenantURL == "" {
+		return "", errNoSpareToken
+	}
+	token, err := GetTokenSecret(tokenID)
+	if err != nil {
+		return "", err
+	}
+
+	// 与普通请求一样占用token，避免同时被其他请求选中
+	lock, err := AcquireToken(tokenID)
+	if err != nil {
+		return "", fmt.Errorf("更新token请求状态失败: %v", err)
+	}
+	defer func() {
+		if err := ReleaseToken(tokenID, lock); err != nil {
+			logger.WithContext(c).WithFields(logrus.Fields{
+				"token_id": tokenID,
+				"error":    err.Error(),
+			}).Error("清理总结token请求状态失败")
+		}
+	}()
+	asyncIncrementTokenUsage(tokenID, contextSummaryModel)
+
+	summaryReq, err := convertToAugmentRequest(OpenAIRequest{
+		Model:    contextSummaryModel,
+		Messages: []ChatMessage{{Role: "user", Content: contextSummaryPrompt + text}},
+	})
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), contextSummaryTimeout)
+	defer cancel()
+
+	summary, err := callUpstreamChat(ctx, token, tenantURL, summaryReq)
+	if err != nil {
+		return "", err
+	}
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return "", fmt.Errorf("上游返回的摘要为空")
+	}
+
+	logger.WithContext(c).WithFields(logrus.Fields{
+		"token_id":      tokenID,
+		"summary_turns": len(history),
+	}).Info("已使用空闲token总结历史")
+	if err := config.RedisSet(cacheKey, summary, contextSummaryTTL); err != nil {
+		logger.WithContext(c).WithField("error", err.Error()).Warn("保存历史摘要缓存失败")
+	}
+	return summary, nil
+}
+
+// callUpstreamChat 发送一次上游对话请求并返回完整回复
+func callUpstreamChat(ctx context.Context, token, tenantURL string, augmentReq AugmentRequest) (string, error) {
+	var fullText strings.Builder
+	err := streamUpstreamChat(ctx, token, tenantURL, generateRequestID(), uuid.New().String(), augmentReq, func(text string) bool {
+		fullText.WriteString(text)
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	return fullText.String(), nil
+}
+
+// errUpstreamBlocked 上游回复中包含block信息
+var errUpstreamBlocked = errors.New("上游拒绝了请求")
+
+// upstreamStatusError 上游返回了非200状态码
+type upstreamStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("上游返回状态码 %d: %s", e.StatusCode, e.Body)
+}
+
+// streamUpstreamChat 发送一次上游对话请求，每收到一段回复调用一次onText，onText返回false时停止读取
+// 检测到block信息时返回errUpstreamBlocked，包含block信息的片段不会传给onText
+func streamUpstreamChat(ctx context.Context, token, tenantURL, requestID, sessionID string, augmentReq AugmentRequest,
+	onText func(text string) bool) error {
+	jsonData, err := json.Marshal(augmentReq)
+	if err != nil {
+		return fmt.Errorf("序列化请求失败: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", tenantURL+"chat-stream", bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
+	req.Header.Set("x-api-version", "2")
+	req.Header.Set("x-request-id", requestID)
+	req.Header.Set("x-request-session-id", sessionID)
+
+	resp, err := createHTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &upstreamStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var augmentResp AugmentResponse
+		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
+			continue
+		}
+		if strings.Contains(augmentResp.Text, errBlocked) {
+			return errUpstreamBlocked
+		}
+		if augmentResp.Text != "" && !onText(augmentResp.Text) {
+			return nil
+		}
+		if augmentResp.Done {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("读取响应失败: %v", err)
+	}
+	return nil
+}
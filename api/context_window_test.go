@@ -0,0 +1,91 @@
+package api
+
+import (
+	"augment2api/config"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFitContextWindow(t *testing.T) {
+	// 每轮的提问和回复各约100个token
+	turn := func(name string) AugmentChatHistory {
+		return AugmentChatHistory{
+			RequestMessage: name + strings.Repeat("q", 400),
+			ResponseText:   name + strings.Repeat("r", 400),
+		}
+	}
+	history := []AugmentChatHistory{turn("1"), turn("2"), turn("3")}
+
+	tests := []struct {
+		name           string
+		budget         int
+		rules          []string
+		truncation     string
+		cachedSummary  bool
+		wantTurns      []string
+		wantTruncated  string
+		wantSummarized string
+	}{
+		{"unlimited", 0, nil, config.ContextTruncationDrop, false, []string{"1", "2", "3"}, "", ""},
+		{"within budget", 1000, nil, config.ContextTruncationDrop, false, []string{"1", "2", "3"}, "", ""},
+		{"drop oldest", 450, nil, config.ContextTruncationDrop, false, []string{"2", "3"}, "1", ""},
+		{"drop all", 100, nil, config.ContextTruncationDrop, false, []string{}, "3", ""},
+		{"model rule", 1000, []string{"test-*=250"}, config.ContextTruncationDrop, false, []string{"3"}, "2", ""},
+		{"summarize from cache", 450, nil, config.ContextTruncationSummarize, true, []string{"summary", "2", "3"}, "1", "true"},
+		{"summarize without spare token", 450, nil, config.ContextTruncationSummarize, false, []string{"2", "3"}, "1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestRedis(t)
+			rules, errs := config.ParseContextBudgets(tt.rules)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			useReloadable(t, func(r *config.Reloadable) {
+				r.DefaultContextBudget = tt.budget
+				r.ContextBudgets = rules
+				r.ContextTruncation = tt.truncation
+			})
+			if tt.cachedSummary {
+				key := contextSummaryKey(historyTranscript(history[:1]))
+				if err := config.RedisSet(key, "summary", contextSummaryTTL); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c, recorder := newTestContext(`{}`, nil)
+			augmentReq := AugmentRequest{ChatHistory: append([]AugmentChatHistory(nil), history...)}
+			fitContextWindow(c, &augmentReq, "test-chat")
+
+			turns := make([]string, 0, len(augmentReq.ChatHistory))
+			for _, h := range augmentReq.ChatHistory {
+				if h.RequestMessage == contextSummaryRequest {
+					turns = append(turns, h.ResponseText)
+					continue
+				}
+				turns = append(turns, h.RequestMessage[:1])
+			}
+			if !reflect.DeepEqual(turns, tt.wantTurns) {
+				t.Errorf("turns = %v, want %v", turns, tt.wantTurns)
+			}
+			if got := recorder.Header().Get(ContextTruncatedHeader); got != tt.wantTruncated {
+				t.Errorf("%s = %q, want %q", ContextTruncatedHeader, got, tt.wantTruncated)
+			}
+			if got := recorder.Header().Get(ContextSummarizedHeader); got != tt.wantSummarized {
+				t.Errorf("%s = %q, want %q", ContextSummarizedHeader, got, tt.wantSummarized)
+			}
+		})
+	}
+}
+
+func TestHistoryTranscriptLimit(t *testing.T) {
+	history := []AugmentChatHistory{
+		{RequestMessage: strings.Repeat("old", contextSummaryInputLimit), ResponseText: "a"},
+		{RequestMessage: "latest question", ResponseText: "latest answer"},
+	}
+	text := historyTranscript(history)
+	if len([]rune(text)) != contextSummaryInputLimit || !strings.HasSuffix(text, "User: latest question\n\nAssistant: latest answer\n\n") {
+		t.Errorf("transcript should keep the newest %d characters", contextSummaryInputLimit)
+	}
+}
@@ -0,0 +1,501 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// 服务端会话存储在 conversation:<所属密钥>:<会话ID> 中，值为会话JSON
+// conversations:<所属密钥> 为会话索引，分数为最后更新时间
+// 会话按API密钥隔离，其他密钥无法读取或修改
+const (
+	conversationPrefix      = "conversation:"
+	conversationIndexPrefix = "conversations:"
+	conversationLockPrefix  = "conversation_lock:"
+)
+
+const (
+	// 每个API密钥在索引中保留的会话数量
+	conversationIndexLimit = 1000
+	// 会话锁的有效期，同一会话同时只处理一条消息
+	conversationLockTTL = 10 * time.Minute
+)
+
+// 会话相关数据在gin上下文中的键名
+const (
+	conversationContextKey = "conversation"
+	conversationMessageKey = "conversation_message"
+)
+
+// ErrConversationNotFound 会话不存在或不属于当前API密钥
+var ErrConversationNotFound = errors.New("会话不存在")
+
+// Conversation 服务端保存的会话
+type Conversation struct {
+	ID        string             `json:"id"`
+	Object    string             `json:"object"`
+	Model     string             `json:"model"`
+	System    string             `json:"system,omitempty"`
+	Title     string             `json:"title,omitempty"`
+	ParentID  string             `json:"parent_id,omitempty"` // 分叉来源的会话ID
+	Truncated int                `json:"truncated_turns"`     // 超出轮数上限被丢弃的轮数
+	Turns     []ConversationTurn `json:"turns"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// ConversationTurn 会话中的一轮问答
+type ConversationTurn struct {
+	RequestID string    `json:"request_id"` // 发送给上游的请求ID，作为后续请求历史中的request_id
+	User      string    `json:"user"`
+	Assistant string    `json:"assistant"`
+	Model     string    `json:"model,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ConversationSummary 会话列表中的摘要信息
+type ConversationSummary struct {
+	ID        string    `json:"id"`
+	Object    string    `json:"object"`
+	Model     string    `json:"model"`
+	Title     string    `json:"title,omitempty"`
+	ParentID  string    `json:"parent_id,omitempty"`
+	TurnCount int       `json:"turn_count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (conv *Conversation) summary() ConversationSummary {
+	return ConversationSummary{
+		ID:        conv.ID,
+		Object:    "conversation",
+		Model:     conv.Model,
+		Title:     conv.Title,
+		ParentID:  conv.ParentID,
+		TurnCount: len(conv.Turns),
+		CreatedAt: conv.CreatedAt,
+		UpdatedAt: conv.UpdatedAt,
+	}
+}
+
+// chatRequest 将会话历史和新消息组合为OpenAI请求，历史按一问一答排列
+// 新消息保留原始内容，其中的图片只随本轮发送，历史中只保存文本
+func (conv *Conversation) chatRequest(model string, content interface{}, stream bool) *OpenAIRequest {
+	messages := make([]ChatMessage, 0, len(conv.Turns)*2+1)
+	for _, turn := range conv.Turns {
+		messages = append(messages,
+			ChatMessage{Role: "user", Content: turn.User},
+			ChatMessage{Role: "assistant", Content: turn.Assistant})
+	}
+	messages = append(messages, ChatMessage{Role: "user", Content: content})
+	return &OpenAIRequest{Model: model, Messages: messages, Stream: stream}
+}
+
+// appendTurn 追加一轮问答，超出轮数上限时丢弃最早的轮次
+func (conv *Conversation) appendTurn(turn ConversationTurn, maxTurns int) {
+	conv.Turns = append(conv.Turns, turn)
+	if maxTurns > 0 && len(conv.Turns) > maxTurns {
+		dropped := len(conv.Turns) - maxTurns
+		conv.Turns = append([]ConversationTurn(nil), conv.Turns[dropped:]...)
+		conv.Truncated += dropped
+	}
+	conv.UpdatedAt = turn.CreatedAt
+}
+
+// conversationOwner 返回请求所属的API密钥标识，未开启鉴权时所有请求共用同一标识
+func conversationOwner(c *gin.Context) string {
+	apiKey := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	sum := sha256.Sum256([]byte("conversation\x00" + apiKey))
+	return hex.EncodeToString(sum[:16])
+}
+
+func conversationKey(owner, id string) string {
+	return conversationPrefix + owner + ":" + id
+}
+
+// GetConversation 读取会话
+func GetConversation(owner, id string) (*Conversation, error) {
+	value, err := config.RedisGet(conversationKey(owner, id))
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var conv Conversation
+	if err := json.Unmarshal([]byte(value), &conv); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// SaveConversation 保存会话并刷新有效期
+func SaveConversation(owner string, conv *Conversation) error {
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return err
+	}
+	ttl := config.Current().ConversationTTL
+	if err := config.RedisSet(conversationKey(owner, conv.ID), string(data), ttl); err != nil {
+		return err
+	}
+
+	// 索引中移除已过期的会话
+	indexKey := conversationIndexPrefix + owner
+	var minScore float64
+	if ttl > 0 {
+		minScore = float64(time.Now().Add(-ttl).Unix())
+	}
+	if err := config.RedisZAddCapped(indexKey, float64(conv.UpdatedAt.Unix()), conv.ID, conversationIndexLimit, minScore); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		return config.RedisExpire(indexKey, ttl)
+	}
+	return nil
+}
+
+// DeleteConversation 删除会话
+func DeleteConversation(owner, id string) error {
+	exists, err := config.RedisExists(conversationKey(owner, id))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrConversationNotFound
+	}
+	if err := config.RedisDel(conversationKey(owner, id)); err != nil {
+		return err
+	}
+	return config.RedisZRem(conversationIndexPrefix+owner, id)
+}
+
+// ListConversations 按最后更新时间倒序列出会话
+func ListConversations(owner string, offset, limit int) ([]ConversationSummary, error) {
+	var minScore float64
+	if ttl := config.Current().ConversationTTL; ttl > 0 {
+		minScore = float64(time.Now().Add(-ttl).Unix())
+	}
+	ids, err := config.RedisZRevRangeByScore(conversationIndexPrefix+owner,
+		float64(time.Now().Unix()+1), minScore, int64(offset), int64(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]ConversationSummary, 0, len(ids))
+	for _, id := range ids {
+		conv, err := GetConversation(owner, id)
+		if errors.Is(err, ErrConversationNotFound) {
+			// 会话已过期，清理索引
+			_ = config.RedisZRem(conversationIndexPrefix+owner, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, conv.summary())
+	}
+	return summaries, nil
+}
+
+// newConversationID 生成会话ID
+func newConversationID() string {
+	return "conv_" + randomHex(12)
+}
+
+// conversationError 将会话读写错误转换为响应
+func conversationError(c *gin.Context, err error) {
+	if errors.Is(err, ErrConversationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	logger.WithContext(c).WithFields(logrus.Fields{
+		"error": err.Error(),
+	}).Error("读写会话失败")
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "读写会话失败"})
+}
+
+// CreateConversationHandler 创建会话
+func CreateConversationHandler(c *gin.Context) {
+	var body struct {
+		Model  string `json:"model"`
+		System string `json:"system"`
+		Title  string `json:"title"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
+		return
+	}
+	if body.Model == "" {
+		body.Model = config.Current().Models[0]
+	}
+
+	now := time.Now()
+	conv := &Conversation{
+		ID:        newConversationID(),
+		Object:    "conversation",
+		Model:     body.Model,
+		System:    body.System,
+		Title:     body.Title,
+		Turns:     make([]ConversationTurn, 0),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := SaveConversation(conversationOwner(c), conv); err != nil {
+		conversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, conv)
+}
+
+// ListConversationsHandler 列出当前API密钥的会话
+func ListConversationsHandler(c *gin.Context) {
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	summaries, err := ListConversations(conversationOwner(c), offset, limit)
+	if err != nil {
+		conversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   summaries,
+	})
+}
+
+// GetConversationHandler 获取会话及完整历史
+func GetConversationHandler(c *gin.Context) {
+	conv, err := GetConversation(conversationOwner(c), c.Param("id"))
+	if err != nil {
+		conversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, conv)
+}
+
+// DeleteConversationHandler 删除会话
+func DeleteConversationHandler(c *gin.Context) {
+	id := c.Param("id")
+	if err := DeleteConversation(conversationOwner(c), id); err != nil {
+		conversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      id,
+		"object":  "conversation.deleted",
+		"deleted": true,
+	})
+}
+
+// ForkConversationHandler 复制会话的前若干轮为新会话，不指定轮数时复制全部历史
+func ForkConversationHandler(c *gin.Context) {
+	var body struct {
+		Turns *int   `json:"turns"`
+		Title string `json:"title"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
+			return
+		}
+	}
+
+	owner := conversationOwner(c)
+	source, err := GetConversation(owner, c.Param("id"))
+	if err != nil {
+		conversationError(c, err)
+		return
+	}
+
+	turns := len(source.Turns)
+	if body.Turns != nil {
+		if *body.Turns < 0 || *body.Turns > len(source.Turns) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "turns 超出会话轮数范围"})
+			return
+		}
+		turns = *body.Turns
+	}
+	title := body.Title
+	if title == "" {
+		title = source.Title
+	}
+
+	now := time.Now()
+	conv := &Conversation{
+		ID:        newConversationID(),
+		Object:    "conversation",
+		Model:     source.Model,
+		System:    source.System,
+		Title:     title,
+		ParentID:  source.ID,
+		Truncated: source.Truncated,
+		Turns:     append(make([]ConversationTurn, 0, turns), source.Turns[:turns]...),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := SaveConversation(owner, conv); err != nil {
+		conversationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, conv)
+}
+
+// ConversationMiddleware 在选择token前加载会话，并将历史和新消息组合为聊天请求
+// 同一会话同时只处理一条消息，避免并发写入导致历史丢失
+func ConversationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Content   interface{}       `json:"content"`
+			Model     string            `json:"model"`
+			Stream    bool              `json:"stream"`
+			Workspace *WorkspaceContext `json:"workspace"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求数据"})
+			c.Abort()
+			return
+		}
+		content, err := parseMessageContent(0, body.Content)
+		if err != nil {
+			var partErr *ContentPartError
+			if errors.As(err, &partErr) && partErr.Part >= 0 {
+				err = fmt.Errorf("content[%d]: %s", partErr.Part, partErr.Reason)
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+		message := content.Text
+		if strings.TrimSpace(message) == "" && len(content.Images) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "content 不能为空"})
+			c.Abort()
+			return
+		}
+
+		owner := conversationOwner(c)
+		id := c.Param("id")
+		lockKey := conversationLockPrefix + owner + ":" + id
+		lockValue := randomHex(8)
+		acquired, err := config.RedisSetNX(lockKey, lockValue, conversationLockTTL)
+		if err != nil {
+			conversationError(c, err)
+			c.Abort()
+			return
+		}
+		if !acquired {
+			c.JSON(http.StatusConflict, gin.H{"error": "会话正在处理其他消息"})
+			c.Abort()
+			return
+		}
+		defer func() {
+			if err := config.RedisDelIfValue(lockKey, lockValue); err != nil {
+				logger.WithContext(c).WithFields(logrus.Fields{
+					"conversation": id,
+					"error":        err.Error(),
+				}).Warn("释放会话锁失败")
+			}
+		}()
+
+		// 获取锁后再读取，确保基于最新的历史
+		conv, err := GetConversation(owner, id)
+		if err != nil {
+			conversationError(c, err)
+			c.Abort()
+			return
+		}
+
+		model := body.Model
+		if model == "" {
+			model = conv.Model
+		}
+		req := conv.chatRequest(model, body.Content, body.Stream)
+		req.Workspace = body.Workspace
+		c.Set(chatRequestPeekKey, req)
+		c.Set(conversationContextKey, conv)
+		c.Set(conversationMessageKey, message)
+		c.Next()
+	}
+}
+
+// ConversationMessageHandler 向会话发送一条用户消息，回复完成后保存到会话历史
+// 响应格式与 /v1/chat/completions 相同
+func ConversationMessageHandler(c *gin.Context) {
+	conv := c.MustGet(conversationContextKey).(*Conversation)
+	message := c.GetString(conversationMessageKey)
+	req := peekChatRequest(c)
+
+	augmentReq, err := convertToAugmentRequest(*req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		cleanupRequestStatus(c)
+		return
+	}
+	// 历史使用上游真实的请求ID
+	for i := range augmentReq.ChatHistory {
+		if i < len(conv.Turns) && conv.Turns[i].RequestID != "" {
+			augmentReq.ChatHistory[i].RequestID = conv.Turns[i].RequestID
+		}
+	}
+	if conv.System != "" {
+		augmentReq.UserGuideLines = strings.TrimSpace(augmentReq.UserGuideLines + "\n" + conv.System)
+	}
+
+	if reqLog := requestLogFrom(c); reqLog != nil {
+		reqLog.Model = req.Model
+		reqLog.Mode = augmentReq.Mode
+		reqLog.Stream = req.Stream
+	}
+	c.Header(ConversationHeader, conv.ID)
+	fitContextWindow(c, &augmentReq, req.Model)
+
+	if req.Stream {
+		handleStreamRequest(c, augmentReq, req.Model)
+	} else {
+		handleNonStreamRequest(c, augmentReq, req.Model)
+	}
+
+	value, exists := c.Get(chatResultKey)
+	if !exists {
+		return
+	}
+	result := value.(chatResult)
+
+	log := logger.WithContext(c).WithField("conversation", conv.ID)
+	owner := conversationOwner(c)
+	// 处理期间会话可能已被删除，此时不再重新创建
+	if exists, err := config.RedisExists(conversationKey(owner, conv.ID)); err != nil || !exists {
+		log.Warn("会话已删除，不保存本轮历史")
+		return
+	}
+
+	conv.appendTurn(ConversationTurn{
+		RequestID: result.RequestID,
+		User:      message,
+		Assistant: result.Text,
+		Model:     req.Model,
+		CreatedAt: time.Now(),
+	}, config.Current().ConversationMaxTurns)
+	if err := SaveConversation(owner, conv); err != nil {
+		log.WithField("error", err.Error()).Error("保存会话历史失败")
+	}
+}
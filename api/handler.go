@@ -9,7 +9,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -29,6 +28,10 @@ type OpenAIRequest struct {
 	Stream      bool          `json:"stream,omitempty"`
 	Temperature float64       `json:"temperature,omitempty"`
 	MaxTokens   int           `json:"max_tokens,omitempty"`
+	User        string        `json:"user,omitempty"`
+
+	// 扩展字段：编辑器集成传入的工作区上下文
+	Workspace *WorkspaceContext `json:"workspace,omitempty"`
 }
 
 // OpenAIResponse OpenAI兼容的响应结构
@@ -67,7 +70,7 @@ type ChatMessage struct {
 	Content interface{} `json:"content"`
 }
 
-// GetContent 添加一个辅助方法来获取消息内容
+// GetContent 添加一个辅助方法来获取消息内容，只返回文本部分，图片和文件由 parseMessageContent 处理
 func (m ChatMessage) GetContent() string {
 	switch v := m.Content.(type) {
 	case string:
@@ -110,6 +113,7 @@ type Node struct {
 	Content     string      `json:"content"`
 	ToolUse     ToolUse     `json:"tool_use"`
 	AgentMemory AgentMemory `json:"agent_memory"`
+	ImageNode   *ImageNode  `json:"image_node,omitempty"`
 }
 
 type ToolUse struct {
@@ -145,6 +149,9 @@ type AugmentRequest struct {
 	} `json:"feature_detection_flags"`
 	ToolDefinitions []ToolDefinition `json:"tool_definitions"`
 	Nodes           []Node           `json:"nodes"`
+
+	// 工作区指南，由客户端通过工作区上下文传入
+	WorkspaceGuidelines string `json:"workspace_guidelines"`
 }
 
 type AugmentChatHistory struct {
@@ -238,10 +245,12 @@ func generatePath() string {
 }
 
 // convertToAugmentRequest 将OpenAI请求转换为Augment请求
-func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
+// 消息中包含无法转换的内容时返回 *ContentPartError，工作区上下文无效时同样返回错误
+func convertToAugmentRequest(req OpenAIRequest) (AugmentRequest, error) {
 	// 确定模式和其他参数基于模型名称
 	mode := "CHAT" // 默认使用CHAT模式
-	userGuideLines := "must answer in Chinese."
+	runtimeConfig := config.Current()
+	userGuideLines := runtimeConfig.ChatGuidelines
 	includeToolDefinitions := false
 	includeDefaultPrompt := false
 
@@ -255,7 +264,7 @@ func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
 	} else if strings.HasSuffix(modelLower, "-agent") {
 		// 使用AGENT模式
 		mode = "AGENT"
-		userGuideLines = "Answer in Chinese, do not use any tools, and for questions involving internet searches, please answer based on your existing knowledge."
+		userGuideLines = runtimeConfig.AgentGuidelines
 		includeToolDefinitions = true
 		includeDefaultPrompt = true
 	}
@@ -265,7 +274,7 @@ func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
 		Mode:           mode,                // 根据模型名称决定模式
 		Prefix:         defaultPrefix,       // 固定前缀，影响模型回复风格
 		Suffix:         " ",                 // 固定后缀，暂时传空，不影响对话
-		Lang:           detectLanguage(req), // 简单检测当前对话语言类型，不传好像回答有问题
+		Lang:           detectLanguage(req), // 检测当前对话涉及的编程语言，无法判断时为空
 		Message:        "",                  // 当前对话消息
 		UserGuideLines: userGuideLines,      // 根据模型类型设置指南
 		// 初始化为空列表
@@ -290,6 +299,11 @@ func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
 		Nodes:           make([]Node, 0),
 	}
 
+	// 使用客户端传入的工作区上下文
+	if err := applyWorkspaceContext(&augmentReq, req.Workspace); err != nil {
+		return AugmentRequest{}, err
+	}
+
 	// 根据模型类型决定是否包含工具定义
 	if includeToolDefinitions {
 		augmentReq.ToolDefinitions = getFullToolDefinitions()
@@ -300,11 +314,14 @@ func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
 		// 每次处理一对消息（用户问题和助手回答）
 		for i := 0; i < len(req.Messages)-1; i += 2 {
 			if i+1 < len(req.Messages) {
-				userMsg := req.Messages[i]
+				userContent, err := parseMessageContent(i, req.Messages[i].Content)
+				if err != nil {
+					return AugmentRequest{}, err
+				}
 				assistantMsg := req.Messages[i+1]
 
 				chatHistory := AugmentChatHistory{
-					RequestMessage: userMsg.GetContent(),
+					RequestMessage: userContent.Text,
 					ResponseText:   assistantMsg.GetContent(),
 					RequestID:      generateRequestID(), // 生成唯一的请求ID
 					RequestNodes:   make([]Node, 0),
@@ -324,22 +341,38 @@ func convertToAugmentRequest(req OpenAIRequest) AugmentRequest {
 						},
 					},
 				}
+				// 历史消息中的图片同样发送给上游
+				chatHistory.RequestNodes = append(chatHistory.RequestNodes, userContent.Images...)
 				augmentReq.ChatHistory = append(augmentReq.ChatHistory, chatHistory)
 			}
 		}
 	}
 
-	// 设置当前消息
+	// 设置当前消息，图片作为请求节点
 	if len(req.Messages) > 0 {
-		lastMsg := req.Messages[len(req.Messages)-1]
+		lastContent, err := parseMessageContent(len(req.Messages)-1, req.Messages[len(req.Messages)-1].Content)
+		if err != nil {
+			return AugmentRequest{}, err
+		}
 		if includeDefaultPrompt {
-			augmentReq.Message = defaultPrompt + "\n" + lastMsg.GetContent()
+			augmentReq.Message = defaultPrompt + "\n" + lastContent.Text
 		} else {
-			augmentReq.Message = lastMsg.GetContent()
+			augmentReq.Message = lastContent.Text
 		}
+		augmentReq.Nodes = append(augmentReq.Nodes, lastContent.Images...)
 	}
 
-	return augmentReq
+	return augmentReq, nil
+}
+
+// 上游回复结果在gin上下文中的键名，会话接口据此保存历史，响应缓存据此写入缓存
+const chatResultKey = "chat_result"
+
+// chatResult 一次成功的上游对话结果
+type chatResult struct {
+	Text         string
+	RequestID    string // 发送给上游的x-request-id
+	PromptTokens int    // 估算的提示词token数量
 }
 
 // generateRequestID 生成唯一的请求ID
@@ -348,44 +381,13 @@ func generateRequestID() string {
 	return uuid.New().String()
 }
 
-// detectLanguage 检测编程语言
-func detectLanguage(req OpenAIRequest) string {
-	if len(req.Messages) == 0 {
-		return ""
+// requestIDFromContext 获取当前请求的关联ID，作为上游的x-request-id
+// 关联ID始终由服务端生成，客户端传入的X-Request-ID不会发送给上游
+func requestIDFromContext(c *gin.Context) string {
+	if requestID := c.GetString(logger.RequestIDKey); requestID != "" {
+		return requestID
 	}
-
-	content := req.Messages[len(req.Messages)-1].GetContent()
-	// 简单判断一下当前对话语言类型
-	if strings.Contains(strings.ToLower(content), "html") {
-		return "HTML"
-	} else if strings.Contains(strings.ToLower(content), "python") {
-		return "Python"
-	} else if strings.Contains(strings.ToLower(content), "javascript") {
-		return "JavaScript"
-	} else if strings.Contains(strings.ToLower(content), "go") {
-		return "Go"
-	} else if strings.Contains(strings.ToLower(content), "rust") {
-		return "Rust"
-	} else if strings.Contains(strings.ToLower(content), "java") {
-		return "Java"
-	} else if strings.Contains(strings.ToLower(content), "c++") {
-		return "C++"
-	} else if strings.Contains(strings.ToLower(content), "c#") {
-		return "C#"
-	} else if strings.Contains(strings.ToLower(content), "php") {
-		return "PHP"
-	} else if strings.Contains(strings.ToLower(content), "ruby") {
-		return "Ruby"
-	} else if strings.Contains(strings.ToLower(content), "swift") {
-		return "Swift"
-	} else if strings.Contains(strings.ToLower(content), "kotlin") {
-		return "Kotlin"
-	} else if strings.Contains(strings.ToLower(content), "typescript") {
-		return "TypeScript"
-	} else if strings.Contains(strings.ToLower(content), "c") {
-		return "C"
-	}
-	return "HTML"
+	return generateRequestID()
 }
 
 // getFullToolDefinitions 返回官方定义的完整工具定义列表
@@ -648,29 +650,29 @@ func CallbackHandler(c *gin.Context, getAccessTokenFunc func(string, string, str
 	// 5. 返回成功响应
 	c.JSON(http.StatusOK, gin.H{
 		"status": "success",
-		"token":  token,
+		"token":  MaskToken(token),
 	})
 }
 
 // ModelsHandler 处理模型请求
 func ModelsHandler(c *gin.Context) {
-	// 这里直接返回写死的模型
+	// 返回配置的模型列表
+	models := config.Current().Models
 	response := ModelsResponse{
 		Object: "list",
-		Data: []ModelObject{
-			{
-				ID:      "claude-3.7-agent",
-				Object:  "model",
-				Created: 1708387200,
-				OwnedBy: "anthropic",
-			},
-			{
-				ID:      "augment-chat",
-				Object:  "model",
-				Created: 1708387200,
-				OwnedBy: "augment",
-			},
-		},
+		Data:   make([]ModelObject, 0, len(models)),
+	}
+	for _, model := range models {
+		ownedBy := "augment"
+		if strings.Contains(strings.ToLower(model), "claude") {
+			ownedBy = "anthropic"
+		}
+		response.Data = append(response.Data, ModelObject{
+			ID:      model,
+			Object:  "model",
+			Created: 1708387200,
+			OwnedBy: ownedBy,
+		})
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -687,8 +689,22 @@ func ChatCompletionsHandler(c *gin.Context) {
 		return
 	}
 
-	// 转换为Augment请求格式
-	augmentReq := convertToAugmentRequest(req)
+	// 转换为Augment请求格式，无法转换的内容直接返回错误，不静默丢弃
+	augmentReq, err := convertToAugmentRequest(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		cleanupRequestStatus(c)
+		return
+	}
+
+	if reqLog := requestLogFrom(c); reqLog != nil {
+		reqLog.Model = req.Model
+		reqLog.Mode = augmentReq.Mode
+		reqLog.Stream = req.Stream
+	}
+
+	// 历史超出上下文预算时截断
+	fitContextWindow(c, &augmentReq, req.Model)
 
 	// 处理流式请求
 	if req.Stream {
@@ -701,20 +717,20 @@ func ChatCompletionsHandler(c *gin.Context) {
 }
 
 // 异步处理token使用计数
-func asyncIncrementTokenUsage(token string, model string) {
+func asyncIncrementTokenUsage(tokenID string, model string) {
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
 				logger.Log.WithFields(logrus.Fields{
-					"error": r,
-					"token": token,
-					"model": model,
+					"error":    r,
+					"token_id": tokenID,
+					"model":    model,
 				}).Error("system err")
 			}
 		}()
 
 		// 增加token使用计数
-		incrementTokenUsage(token, model)
+		incrementTokenUsage(tokenID, model)
 	}()
 }
 
@@ -722,7 +738,7 @@ func asyncIncrementTokenUsage(token string, model string) {
 func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string) {
 	defer func() {
 		if r := recover(); r != nil {
-			logger.Log.WithFields(logrus.Fields{
+			logger.WithContext(c).WithFields(logrus.Fields{
 				"error": r,
 				"model": model,
 			}).Error("处理流式请求时发生panic")
@@ -753,8 +769,27 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		return
 	}
 
+	// tokenID用于Redis中的计数和状态
+	tokenID := c.GetString("token_id")
+	if tokenID == "" {
+		tokenID = TokenID(token)
+	}
+
+	// 请求结束时记录估算的token数量
+	reqLog := requestLogFrom(c)
+	var fullText string
+	var requestID string
+	completed := false
+	defer func() {
+		reqLog.setUsage(estimatePromptTokens(augmentReq), estimateTokenCount(fullText))
+		reqLog.setBodies(augmentReq.Message, fullText)
+		if completed {
+			c.Set(chatResultKey, chatResult{Text: fullText, RequestID: requestID, PromptTokens: estimatePromptTokens(augmentReq)})
+		}
+	}()
+
 	// 异步处理token使用计数
-	asyncIncrementTokenUsage(token, model)
+	asyncIncrementTokenUsage(tokenID, model)
 
 	// 准备请求数据
 	jsonData, err := json.Marshal(augmentReq)
@@ -773,7 +808,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 
 	// 创建请求
 	requestURL := tenant + "chat-stream"
-	req, err := http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
+	req, err := http.NewRequestWithContext(upstreamContext(c), "POST", requestURL, bytes.NewReader(jsonData))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
 		return
@@ -788,7 +823,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 	req.Header.Set("x-api-version", "2")
 
 	// 生成请求ID和会话ID
-	requestID := uuid.New().String()
+	requestID = requestIDFromContext(c)
 	sessionID := uuid.New().String()
 	req.Header.Set("x-request-id", requestID)
 	req.Header.Set("x-request-session-id", sessionID)
@@ -806,14 +841,15 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 	// 第一次尝试使用原始模式请求
 	resp, err := client.Do(req)
 	if err != nil {
-		logger.Log.WithFields(logrus.Fields{
+		logger.WithContext(c).WithFields(logrus.Fields{
 			"error": err.Error(),
 			"mode":  augmentReq.Mode,
 		}).Error("请求失败")
 
 		// 切换到CHAT模式
 		augmentReq.Mode = "CHAT"
-		augmentReq.UserGuideLines = "使用中文回答"
+		augmentReq.UserGuideLines = config.Current().FallbackGuidelines
+		reqLog.markFallback()
 		augmentReq.ToolDefinitions = []ToolDefinition{}
 
 		// 重新准备请求数据
@@ -824,7 +860,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		}
 
 		// 创建新的请求
-		req, err = http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
+		req, err = http.NewRequestWithContext(upstreamContext(c), "POST", requestURL, bytes.NewReader(jsonData))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
 			return
@@ -867,7 +903,6 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 	reader := bufio.NewReader(resp.Body)
 	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
 
-	var fullText string
 	var hasError bool
 
 	for {
@@ -876,20 +911,21 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 			if err == io.EOF {
 				break
 			}
-			logger.Log.WithFields(logrus.Fields{
+			logger.WithContext(c).WithFields(logrus.Fields{
 				"error": err.Error(),
 				"mode":  augmentReq.Mode,
 			}).Error("读取响应失败")
 
 			// 切换到CHAT模式
 			if augmentReq.Mode != "CHAT" {
-				logger.Log.WithFields(logrus.Fields{
+				logger.WithContext(c).WithFields(logrus.Fields{
 					"error": err.Error(),
 					"mode":  augmentReq.Mode,
 				}).Info("切换到CHAT模式")
 
 				augmentReq.Mode = "CHAT"
-				augmentReq.UserGuideLines = "使用中文回答"
+				augmentReq.UserGuideLines = config.Current().FallbackGuidelines
+				reqLog.markFallback()
 				augmentReq.ToolDefinitions = []ToolDefinition{}
 
 				// 重新准备请求数据
@@ -900,7 +936,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 				}
 
 				// 创建新的请求
-				req, err = http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
+				req, err = http.NewRequestWithContext(upstreamContext(c), "POST", requestURL, bytes.NewReader(jsonData))
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
 					return
@@ -939,6 +975,8 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 				reader = bufio.NewReader(resp.Body)
 				continue
 			}
+			// 回复不完整，不作为成功结果
+			hasError = true
 			break
 		}
 
@@ -949,25 +987,26 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 
 		var augmentResp AugmentResponse
 		if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-			log.Printf("解析响应失败: %v", err)
+			logger.WithContext(c).Errorf("解析响应失败: %v", err)
 			continue
 		}
 
 		// 检查响应内容是否包含错误信息
 		if strings.Contains(augmentResp.Text, errBlocked) {
 			hasError = true
+			reqLog.markBlocked()
 
 			// 将当前token加入冷却队列，冷却时间10分钟
-			logger.Log.WithFields(logrus.Fields{
-				"token": token,
-				"mode":  augmentReq.Mode,
+			logger.WithContext(c).WithFields(logrus.Fields{
+				"token_id": tokenID,
+				"mode":     augmentReq.Mode,
 			}).Info("检测到block信息，将token加入冷却队列10分钟")
 
-			err := SetTokenCoolStatus(token, 10*time.Minute)
+			err := SetTokenCoolStatus(tokenID, 10*time.Minute)
 			if err != nil {
-				logger.Log.WithFields(logrus.Fields{
-					"token": token,
-					"error": err.Error(),
+				logger.WithContext(c).WithFields(logrus.Fields{
+					"token_id": tokenID,
+					"error":    err.Error(),
 				}).Error("将token加入冷却队列失败")
 			}
 
@@ -1003,12 +1042,14 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		// 序列化并发送响应
 		jsonResp, err := json.Marshal(streamResp)
 		if err != nil {
-			log.Printf("序列化响应失败: %v", err)
+			logger.WithContext(c).Errorf("序列化响应失败: %v", err)
 			continue
 		}
 
+		reqLog.markFirstByte()
 		fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
 		flusher.Flush()
+		publishChunk(c, augmentResp.Text)
 
 		// 如果完成，发送最后的[DONE]标记
 		if augmentResp.Done {
@@ -1020,13 +1061,14 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 
 	// 如果检测到错误信息，尝试切换到CHAT模式重新请求
 	if hasError && augmentReq.Mode != "CHAT" {
-		logger.Log.WithFields(logrus.Fields{
+		logger.WithContext(c).WithFields(logrus.Fields{
 			"mode": augmentReq.Mode,
 		}).Info("检测到block信息，尝试切换到 CHAT 模式回复！")
 
 		// 切换到CHAT模式
 		augmentReq.Mode = "CHAT"
-		augmentReq.UserGuideLines = "使用中文回答"
+		augmentReq.UserGuideLines = config.Current().FallbackGuidelines
+		reqLog.markFallback()
 		augmentReq.ToolDefinitions = []ToolDefinition{}
 
 		// 重新准备请求数据
@@ -1037,7 +1079,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		}
 
 		// 创建新的请求
-		req, err = http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
+		req, err = http.NewRequestWithContext(upstreamContext(c), "POST", requestURL, bytes.NewReader(jsonData))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
 			return
@@ -1080,13 +1122,15 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 		responseID = fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
 
 		fullText = ""
+		hasError = false
 		for {
 			line, err := reader.ReadString('\n')
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
-				log.Printf("读取响应失败: %v", err)
+				logger.WithContext(c).Errorf("读取响应失败: %v", err)
+				hasError = true
 				break
 			}
 
@@ -1097,7 +1141,7 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 
 			var augmentResp AugmentResponse
 			if err := json.Unmarshal([]byte(line), &augmentResp); err != nil {
-				log.Printf("解析响应失败: %v", err)
+				logger.WithContext(c).Errorf("解析响应失败: %v", err)
 				continue
 			}
 
@@ -1130,12 +1174,14 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 			// 序列化并发送响应
 			jsonResp, err := json.Marshal(streamResp)
 			if err != nil {
-				log.Printf("序列化响应失败: %v", err)
+				logger.WithContext(c).Errorf("序列化响应失败: %v", err)
 				continue
 			}
 
+			reqLog.markFirstByte()
 			fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
 			flusher.Flush()
+			publishChunk(c, augmentResp.Text)
 
 			// 如果完成，发送最后的[DONE]标记
 			if augmentResp.Done {
@@ -1145,6 +1191,8 @@ func handleStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string
 			}
 		}
 	}
+
+	completed = !hasError
 }
 
 // estimateTokenCount 粗略估计文本中的token数量
@@ -1168,11 +1216,68 @@ func estimateTokenCount(text string) int {
 	return wordCount + int(float64(chineseCount)*0.75)
 }
 
+// estimatePromptTokens 估算请求消息和历史记录的token数量
+func estimatePromptTokens(augmentReq AugmentRequest) int {
+	promptTokens := estimateTokenCount(augmentReq.Message)
+	for _, history := range augmentReq.ChatHistory {
+		promptTokens += estimateTokenCount(history.RequestMessage)
+		promptTokens += estimateTokenCount(history.ResponseText)
+	}
+	return promptTokens
+}
+
+// chatCompletionResponse 生成OpenAI兼容的非流式回复
+func chatCompletionResponse(model, text string, promptTokens int) OpenAIResponse {
+	finishReason := "stop"
+	completionTokens := estimateTokenCount(text)
+	return OpenAIResponse{
+		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []Choice{
+			{
+				Index:        0,
+				Message:      ChatMessage{Role: "assistant", Content: text},
+				FinishReason: &finishReason,
+			},
+		},
+		Usage: Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}
+}
+
+// writeStreamChunk 发送一个OpenAI兼容的流式回复片段，finishReason为nil表示回复尚未结束
+func writeStreamChunk(c *gin.Context, responseID, model, content string, finishReason *string) {
+	jsonResp, err := json.Marshal(OpenAIStreamResponse{
+		ID:      responseID,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []StreamChoice{
+			{
+				Index:        0,
+				Delta:        ChatMessage{Role: "assistant", Content: content},
+				FinishReason: finishReason,
+			},
+		},
+	})
+	if err != nil {
+		logger.WithContext(c).Errorf("序列化响应失败: %v", err)
+		return
+	}
+	fmt.Fprintf(c.Writer, "data: %s\n\n", jsonResp)
+	c.Writer.Flush()
+}
+
 // 处理非流式请求
 func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model string) {
 	defer func() {
 		if r := recover(); r != nil {
-			logger.Log.WithFields(logrus.Fields{
+			logger.WithContext(c).WithFields(logrus.Fields{
 				"error": r,
 				"model": model,
 			}).Error("处理非流式请求时发生panic")
@@ -1202,8 +1307,14 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 		return
 	}
 
+	// tokenID用于Redis中的计数和状态
+	tokenID := c.GetString("token_id")
+	if tokenID == "" {
+		tokenID = TokenID(token)
+	}
+
 	// 异步处理token使用计数
-	asyncIncrementTokenUsage(token, model)
+	asyncIncrementTokenUsage(tokenID, model)
 
 	// 准备请求数据
 	jsonData, err := json.Marshal(augmentReq)
@@ -1222,7 +1333,7 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 
 	// 创建请求
 	requestURL := tenant + "chat-stream"
-	req, err := http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
+	req, err := http.NewRequestWithContext(upstreamContext(c), "POST", requestURL, bytes.NewReader(jsonData))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建请求失败"})
 		return
@@ -1237,7 +1348,7 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 	req.Header.Set("x-api-version", "2")
 
 	// 生成请求ID和会话ID
-	requestID := uuid.New().String()
+	requestID := requestIDFromContext(c)
 	sessionID := uuid.New().String()
 	req.Header.Set("x-request-id", requestID)
 	req.Header.Set("x-request-session-id", sessionID)
@@ -1265,8 +1376,10 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 	asyncRecordSessionEvent(token, tenant, requestID, sessionID)
 
 	// 读取完整响应
+	requestLogFrom(c).markFirstByte()
 	reader := bufio.NewReader(resp.Body)
 	var fullText string
+	var blocked bool
 
 	for {
 		line, err := reader.ReadString('\n')
@@ -1292,17 +1405,20 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 
 		// 检查响应内容是否包含错误信息
 		if strings.Contains(augmentResp.Text, errBlocked) {
+			blocked = true
+			requestLogFrom(c).markBlocked()
+
 			// 将当前token加入冷却队列，冷却时间10分钟
-			logger.Log.WithFields(logrus.Fields{
-				"token": token,
-				"mode":  augmentReq.Mode,
+			logger.WithContext(c).WithFields(logrus.Fields{
+				"token_id": tokenID,
+				"mode":     augmentReq.Mode,
 			}).Info("检测到block信息，将token加入冷却队列10分钟")
 
-			err := SetTokenCoolStatus(token, 10*time.Minute)
+			err := SetTokenCoolStatus(tokenID, 10*time.Minute)
 			if err != nil {
-				logger.Log.WithFields(logrus.Fields{
-					"token": token,
-					"error": err.Error(),
+				logger.WithContext(c).WithFields(logrus.Fields{
+					"token_id": tokenID,
+					"error":    err.Error(),
 				}).Error("将token加入冷却队列失败")
 			}
 		}
@@ -1316,13 +1432,16 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 	finishReason := "stop"
 
 	// 估算token数量
-	promptTokens := estimateTokenCount(augmentReq.Message)
-	for _, history := range augmentReq.ChatHistory {
-		promptTokens += estimateTokenCount(history.RequestMessage)
-		promptTokens += estimateTokenCount(history.ResponseText)
-	}
+	promptTokens := estimatePromptTokens(augmentReq)
 	completionTokens := estimateTokenCount(fullText)
 
+	reqLog := requestLogFrom(c)
+	reqLog.setUsage(promptTokens, completionTokens)
+	reqLog.setBodies(augmentReq.Message, fullText)
+	if !blocked {
+		c.Set(chatResultKey, chatResult{Text: fullText, RequestID: requestID, PromptTokens: promptTokens})
+	}
+
 	openAIResp := OpenAIResponse{
 		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
 		Object:  "chat.completion",
@@ -1352,7 +1471,7 @@ func handleNonStreamRequest(c *gin.Context, augmentReq AugmentRequest, model str
 func cleanupRequestStatus(c *gin.Context) {
 	defer func() {
 		if r := recover(); r != nil {
-			logger.Log.WithFields(logrus.Fields{
+			logger.WithContext(c).WithFields(logrus.Fields{
 				"error": r,
 			}).Error("清理请求状态时发生panic")
 		}
@@ -1364,7 +1483,7 @@ func cleanupRequestStatus(c *gin.Context) {
 		return
 	}
 
-	tokenInterface, exists := c.Get("token")
+	tokenIDInterface, exists := c.Get("token_id")
 	if !exists {
 		return
 	}
@@ -1374,22 +1493,14 @@ func cleanupRequestStatus(c *gin.Context) {
 		return
 	}
 
-	token, ok := tokenInterface.(string)
+	tokenID, ok := tokenIDInterface.(string)
 	if !ok {
 		return
 	}
 
-	// 更新请求状态为已完成
-	err := SetTokenRequestStatus(token, TokenRequestStatus{
-		InProgress:    false,
-		LastRequestAt: time.Now(),
-	})
-
-	// 无论更新状态是否成功，都要释放锁
-	defer lock.Unlock()
-
-	if err != nil {
-		logger.Log.WithFields(logrus.Fields{
+	// 更新请求状态为已完成并释放锁
+	if err := ReleaseToken(tokenID, lock); err != nil {
+		logger.WithContext(c).WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Error("清理请求状态失败")
 		return
@@ -1401,16 +1512,17 @@ func createHTTPClient() *http.Client {
 	client := &http.Client{}
 
 	// 检查是否配置了代理
-	if config.AppConfig.ProxyURL != "" {
-		proxyURL, err := url.Parse(config.AppConfig.ProxyURL)
+	proxy := config.Current().ProxyURL
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
 		if err == nil {
 			transport := &http.Transport{
 				Proxy: http.ProxyURL(proxyURL),
 			}
 			client.Transport = transport
-			log.Printf("使用代理: %s", config.AppConfig.ProxyURL)
+			logger.Log.Debugf("使用代理: %s", logger.RedactURL(proxy))
 		} else {
-			log.Printf("代理URL格式错误: %v", err)
+			logger.Log.Errorf("代理URL格式错误: %v", err)
 		}
 	}
 
@@ -1420,12 +1532,15 @@ func createHTTPClient() *http.Client {
 // 异步记录用户会话事件
 func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
 	go func() {
+		// 异步日志同样附加请求关联ID
+		log := logger.Log.WithField(logger.RequestIDKey, requestID)
+
 		defer func() {
 			if r := recover(); r != nil {
-				logger.Log.WithFields(logrus.Fields{
-					"error":      r,
-					"token":      token,
-					"tenant_url": tenantURL,
+				log.WithFields(logrus.Fields{
+					"error":             r,
+					"token_fingerprint": logger.Fingerprint(token),
+					"tenant_url":        tenantURL,
 				}).Error("记录会话事件时发生panic")
 			}
 		}()
@@ -1433,7 +1548,7 @@ func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
 		// 提取主机部分
 		parsedURL, err := url.Parse(tenantURL)
 		if err != nil {
-			logger.Log.WithFields(logrus.Fields{
+			log.WithFields(logrus.Fields{
 				"error":      err.Error(),
 				"tenant_url": tenantURL,
 			}).Error("解析租户URL失败")
@@ -1456,7 +1571,7 @@ func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
 		// 序列化请求数据
 		jsonData, err := json.Marshal(eventData)
 		if err != nil {
-			logger.Log.WithFields(logrus.Fields{
+			log.WithFields(logrus.Fields{
 				"error": err.Error(),
 			}).Error("序列化事件数据失败")
 			return
@@ -1468,7 +1583,7 @@ func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
 		// 创建请求
 		req, err := http.NewRequest("POST", requestURL, bytes.NewReader(jsonData))
 		if err != nil {
-			logger.Log.WithFields(logrus.Fields{
+			log.WithFields(logrus.Fields{
 				"error": err.Error(),
 			}).Error("创建记录事件请求失败")
 			return
@@ -1489,7 +1604,7 @@ func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
 		client := createHTTPClient()
 		resp, err := client.Do(req)
 		if err != nil {
-			logger.Log.WithFields(logrus.Fields{
+			log.WithFields(logrus.Fields{
 				"error": err.Error(),
 			}).Error("发送记录事件请求失败")
 			return
@@ -1497,7 +1612,7 @@ func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
 		defer resp.Body.Close()
 
 		// 记录响应状态
-		logger.Log.WithFields(logrus.Fields{
+		log.WithFields(logrus.Fields{
 			"status_code": resp.StatusCode,
 			"tenant_url":  tenantURL,
 		}).Info("记录会话事件完成")
@@ -1505,37 +1620,37 @@ func asyncRecordSessionEvent(token, tenantURL, requestID, sessionID string) {
 }
 
 // 在处理聊天请求时增加token使用计数
-func incrementTokenUsage(token string, model string) {
+func incrementTokenUsage(tokenID string, model string) {
 	// 先将模型名称转换为小写
 	modelLower := strings.ToLower(model)
 
 	// 根据模型类型确定计数键 (不区分大小写)
 	var countKey string
 	if strings.HasSuffix(modelLower, "-chat") {
-		countKey = "token_usage_chat:" + token
+		countKey = "token_usage_chat:" + tokenID
 	} else if strings.HasSuffix(modelLower, "-agent") {
-		countKey = "token_usage_agent:" + token
+		countKey = "token_usage_agent:" + tokenID
 	} else {
-		countKey = "token_usage:" + token // 默认键
+		countKey = "token_usage:" + tokenID // 默认键
 		// 非特定结尾的模型，增加chat计数
-		err := config.RedisIncr("token_usage_chat:" + token)
+		err := config.RedisIncr("token_usage_chat:" + tokenID)
 		if err != nil {
-			logger.Log.Error("增加token chat使用计数失败: %v", err)
+			logger.Log.Errorf("增加token chat使用计数失败: %v", err)
 		}
 	}
 
 	// 使用Redis的INCR命令增加计数
 	err := config.RedisIncr(countKey)
 	if err != nil {
-		logger.Log.Error("增加token使用计数失败: %v", err)
+		logger.Log.Errorf("增加token使用计数失败: %v", err)
 	}
 
 	// 同时增加总使用计数
-	totalCountKey := "token_usage:" + token
+	totalCountKey := "token_usage:" + tokenID
 	if countKey != totalCountKey { // 避免重复计数
 		err = config.RedisIncr(totalCountKey)
 		if err != nil {
-			logger.Log.Error("增加token总使用计数失败: %v", err)
+			logger.Log.Errorf("增加token总使用计数失败: %v", err)
 		}
 	}
 }
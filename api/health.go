@@ -0,0 +1,148 @@
+package api
+
+import (
+	"augment2api/config"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 健康检查状态
+const (
+	ProbeOK   = "ok"
+	ProbeFail = "fail"
+)
+
+// 服务启动时间
+var startedAt = time.Now()
+
+// ProbeCheck 单项就绪检查结果
+type ProbeCheck struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Message   string `json:"message,omitempty"`
+}
+
+// runProbeCheck 执行单项检查并记录耗时
+func runProbeCheck(check func() (string, error)) ProbeCheck {
+	start := time.Now()
+	message, err := check()
+	result := ProbeCheck{
+		Status:    ProbeOK,
+		LatencyMs: time.Since(start).Milliseconds(),
+		Message:   message,
+	}
+	if err != nil {
+		result.Status = ProbeFail
+		result.Message = err.Error()
+	}
+	return result
+}
+
+// HealthzHandler 存活检查，进程能处理请求即返回成功
+func HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":         ProbeOK,
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+	})
+}
+
+// ReadyzHandler 就绪检查：Redis可用、配置已加载、至少有一个可分配的token
+// 传入 upstream=true 或配置 READY_CHECK_UPSTREAM 时同时检查上游租户地址是否可连接
+func ReadyzHandler(c *gin.Context) {
+	checks := make(map[string]ProbeCheck)
+
+	checks["config"] = runProbeCheck(func() (string, error) {
+		if config.AppConfig.Port == 0 {
+			return "", fmt.Errorf("配置未加载")
+		}
+		return "", nil
+	})
+
+	if config.AppConfig.CodingMode == "true" {
+		checks["tokens"] = runProbeCheck(func() (string, error) {
+			return "调试模式", nil
+		})
+	} else {
+		checks["redis"] = runProbeCheck(func() (string, error) {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+			defer cancel()
+			return "", config.RedisPing(ctx)
+		})
+		checks["tokens"] = runProbeCheck(func() (string, error) {
+			count, _, err := selectableTokens()
+			if err != nil {
+				return "", err
+			}
+			if count == 0 {
+				return "", fmt.Errorf("没有可用的token")
+			}
+			return fmt.Sprintf("%d 个可用token", count), nil
+		})
+	}
+
+	if c.Query("upstream") == "true" || config.AppConfig.ReadyCheckUpstream {
+		checks["upstream"] = runProbeCheck(checkUpstreamReachable)
+	}
+
+	status, code := ProbeOK, http.StatusOK
+	for _, check := range checks {
+		if check.Status != ProbeOK {
+			status, code = ProbeFail, http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	c.JSON(code, gin.H{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// selectableTokens 统计可以参与请求分配的token数量，并返回其中一个token的租户地址
+func selectableTokens() (int, string, error) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return 0, "", err
+	}
+	count := 0
+	tenantURL := ""
+	for _, key := range keys {
+		fields, err := config.RedisHMGet(key, "status", "tenant_url")
+		if err != nil || !isTokenSelectable(fields[0]) {
+			continue
+		}
+		count++
+		if tenantURL == "" {
+			tenantURL = fields[1]
+		}
+	}
+	return count, tenantURL, nil
+}
+
+// checkUpstreamReachable 检查任意一个可用token的租户地址能否建立连接，收到任何HTTP响应即视为可达
+func checkUpstreamReachable() (string, error) {
+	tenantURL := config.AppConfig.TenantURL
+	if config.AppConfig.CodingMode != "true" {
+		_, url, err := selectableTokens()
+		if err != nil {
+			return "", err
+		}
+		tenantURL = url
+	}
+	if tenantURL == "" {
+		return "", fmt.Errorf("没有可检查的租户地址")
+	}
+
+	client := createHTTPClient()
+	client.Timeout = 5 * time.Second
+	resp, err := client.Get(tenantURL)
+	if err != nil {
+		return "", fmt.Errorf("连接租户地址失败: %v", err)
+	}
+	resp.Body.Close()
+	return tenantURL, nil
+}
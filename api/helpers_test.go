@@ -0,0 +1,49 @@
+package api
+
+import (
+	"augment2api/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestRedis 使用内存Redis替换全局连接，测试结束后恢复
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	previous := config.RDB
+	config.RDB = client
+	t.Cleanup(func() {
+		config.RDB = previous
+		client.Close()
+	})
+	return server
+}
+
+// useReloadable 在默认配置的基础上修改可热更新配置，测试结束后恢复
+func useReloadable(t *testing.T, modify func(r *config.Reloadable)) {
+	t.Helper()
+	r := *config.Current()
+	modify(&r)
+	previous := config.SetCurrent(&r)
+	t.Cleanup(func() { config.SetCurrent(previous) })
+}
+
+// newTestContext 创建携带JSON请求体和请求头的gin上下文
+func newTestContext(body string, headers map[string]string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		c.Request.Header.Set(key, value)
+	}
+	return c, recorder
+}
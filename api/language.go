@@ -0,0 +1,263 @@
+package api
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// languageSpec 一种编程语言的识别规则
+type languageSpec struct {
+	Name       string
+	Fences     []string         // 代码块标记中的语言名称
+	Extensions []string         // 文件扩展名
+	Syntax     []*regexp.Regexp // 该语言特有的语法
+	Strong     []*regexp.Regexp // 足以区分相近语言的语法，例如TypeScript的类型标注
+}
+
+// 语言检测的权重
+const (
+	fenceScore     = 4 // 代码块标记了语言
+	extensionScore = 3 // 提到了该语言的文件
+	syntaxScore    = 1 // 匹配一条语法特征
+	strongScore    = 2 // 匹配一条强语法特征
+	// 当前消息的权重，之前的消息为1
+	currentMessageWeight = 2
+	// 最高分低于该值时认为无法判断
+	minLanguageScore = 2
+)
+
+func patterns(exprs ...string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		compiled[i] = regexp.MustCompile(expr)
+	}
+	return compiled
+}
+
+var languages = []languageSpec{
+	{
+		Name:       "Go",
+		Fences:     []string{"go", "golang"},
+		Extensions: []string{".go"},
+		Syntax:     patterns(`\bfunc (\(\w+ \*?\w+\) )?\w+\(`, `\w+ := `, `\bfmt\.\w+\(`, `\berr != nil\b`, `\bchan \w+`),
+		Strong:     patterns(`(?m)^package \w+\s*$`, `\bgo func\(`),
+	},
+	{
+		Name:       "Python",
+		Fences:     []string{"python", "py", "python3"},
+		Extensions: []string{".py"},
+		Syntax:     patterns(`(?m)^\s*import \w+(\.\w+)*\s*$`, `\bself\.\w+`, `(?m)^\s*elif\b`, `\bNone\b`),
+		Strong:     patterns(`(?m)^\s*def \w+\(.*\)( -> [\w\[\], ]+)?:\s*$`, `(?m)^\s*from [\w.]+ import `, `__name__ == ['"]__main__['"]`),
+	},
+	{
+		Name:       "JavaScript",
+		Fences:     []string{"javascript", "js", "jsx", "node", "mjs"},
+		Extensions: []string{".js", ".jsx", ".mjs", ".cjs"},
+		Syntax:     patterns(`\bconsole\.log\(`, `\bfunction\s*\w*\s*\(`, `=>\s*\{`, `(?m)^\s*(const|let) \w+ = `, `\bdocument\.\w+`),
+		Strong:     patterns(`\brequire\(['"][\w@./-]+['"]\)`, `\bmodule\.exports\b`),
+	},
+	{
+		Name:       "TypeScript",
+		Fences:     []string{"typescript", "ts", "tsx"},
+		Extensions: []string{".ts", ".tsx"},
+		Syntax:     patterns(`\bconsole\.log\(`, `=>\s*\{`, `(?m)^\s*(const|let) \w+(: [\w<>\[\]]+)? = `, `(?m)^\s*import .+ from ['"]`),
+		Strong:     patterns(`(?m)^\s*(export )?interface \w+ \{`, `\w+\??: (string|number|boolean|any|unknown)\b`, `(?m)^\s*(export )?type \w+ = `),
+	},
+	{
+		Name:       "Rust",
+		Fences:     []string{"rust", "rs"},
+		Extensions: []string{".rs"},
+		Syntax:     patterns(`\bfn \w+\(`, `\bimpl\b[^{]*\{`, `&mut\b`, `->\s*Result<`, `(?m)^use \w+::`),
+		Strong:     patterns(`\blet mut\b`, `\bprintln!\(`),
+	},
+	{
+		Name:       "Java",
+		Fences:     []string{"java"},
+		Extensions: []string{".java"},
+		Syntax:     patterns(`\bpublic (static )?(class|void|interface)\b`, `@Override\b`, `\bprivate final\b`),
+		Strong:     patterns(`\bSystem\.out\.print`, `(?m)^import java\.`, `public static void main\(String`),
+	},
+	{
+		Name:       "C",
+		Fences:     []string{"c"},
+		Extensions: []string{".c", ".h"},
+		Syntax:     patterns(`\bprintf\(`, `\bmalloc\(`, `\bint main\(`),
+		Strong:     patterns(`#include\s*<\w+\.h>`),
+	},
+	{
+		Name:       "C++",
+		Fences:     []string{"cpp", "c++", "cc", "cxx", "hpp"},
+		Extensions: []string{".cpp", ".cc", ".cxx", ".hpp", ".hh"},
+		Syntax:     patterns(`\bint main\(`, `\btemplate\s*<`, `\bnamespace \w+`),
+		Strong:     patterns(`\bstd::`, `#include\s*<\w+>`, `\bcout\s*<<`),
+	},
+	{
+		Name:       "C#",
+		Fences:     []string{"csharp", "cs", "c#"},
+		Extensions: []string{".cs"},
+		Syntax:     patterns(`\bnamespace \w+`, `\bpublic (async )?Task\b`, `\{ get; set; \}`),
+		Strong:     patterns(`(?m)^using System`, `\bConsole\.Write`),
+	},
+	{
+		Name:       "PHP",
+		Fences:     []string{"php"},
+		Extensions: []string{".php"},
+		Syntax:     patterns(`\$\w+\s*=`, `\becho\b`, `\bfunction \w+\(\$`),
+		Strong:     patterns(`<\?php`, `\$this->`),
+	},
+	{
+		Name:       "Ruby",
+		Fences:     []string{"ruby", "rb"},
+		Extensions: []string{".rb"},
+		Syntax:     patterns(`(?m)^\s*def \w+[?!]?(\(.*\))?\s*$`, `(?m)^\s*end\s*$`, `\bputs\b`),
+		Strong:     patterns(`\.each do \|`, `(?m)^require ['"]`, `\battr_accessor\b`),
+	},
+	{
+		Name:       "Swift",
+		Fences:     []string{"swift"},
+		Extensions: []string{".swift"},
+		Syntax:     patterns(`\bfunc \w+\(.*\) -> `, `\bvar \w+: \w+`, `\blet \w+: \w+`),
+		Strong:     patterns(`\bguard let\b`, `(?m)^import (UIKit|SwiftUI|Foundation)\s*$`),
+	},
+	{
+		Name:       "Kotlin",
+		Fences:     []string{"kotlin", "kt"},
+		Extensions: []string{".kt", ".kts"},
+		Syntax:     patterns(`\bfun \w+\(`, `\bval \w+ = `, `\bprintln\(`),
+		Strong:     patterns(`\bdata class\b`, `\bfun main\(`),
+	},
+	{
+		Name:       "HTML",
+		Fences:     []string{"html", "htm", "xhtml"},
+		Extensions: []string{".html", ".htm"},
+		Syntax:     patterns(`</div>`, `<body[ >]`, `<script[ >]`),
+		Strong:     patterns(`(?i)<!DOCTYPE html`, `<html[ >]`),
+	},
+	{
+		Name:       "CSS",
+		Fences:     []string{"css", "scss", "less"},
+		Extensions: []string{".css", ".scss", ".less"},
+		Syntax:     patterns(`\b(margin|padding|color|display|font-size)\s*:\s*[^;{}]+;`),
+		Strong:     patterns(`@media\b`),
+	},
+	{
+		Name:       "Shell",
+		Fences:     []string{"shell", "sh", "bash", "zsh", "console"},
+		Extensions: []string{".sh", ".bash", ".zsh"},
+		Syntax:     patterns(`(?m)^\s*\$? ?(sudo|apt-get|apt|brew|yum|chmod|export) `),
+		Strong:     patterns(`(?m)^#!/(usr/)?bin/(env )?(ba|z)?sh`),
+	},
+	{
+		Name:       "SQL",
+		Fences:     []string{"sql", "mysql", "postgresql", "sqlite"},
+		Extensions: []string{".sql"},
+		Syntax:     patterns(`(?i)\bSELECT\b[\s\S]+?\bFROM\b`, `(?i)\bWHERE\b`),
+		Strong:     patterns(`(?i)\bINSERT INTO\b`, `(?i)\bCREATE TABLE\b`, `(?i)\bUPDATE \w+ SET\b`),
+	},
+}
+
+var (
+	// 代码块开始标记及其语言名称
+	fencePattern = regexp.MustCompile("(?m)^\\s*(```|~~~)\\s*([\\w+#.-]*)")
+	// 文本中提到的文件名
+	fileNamePattern = regexp.MustCompile(`[\w./-]+\.([A-Za-z+]{1,6})\b`)
+)
+
+// 代码块语言名称和扩展名到语言的索引
+var (
+	languageByFence     = make(map[string]int)
+	languageByExtension = make(map[string]int)
+)
+
+func init() {
+	for i, lang := range languages {
+		for _, fence := range lang.Fences {
+			languageByFence[fence] = i
+		}
+		for _, ext := range lang.Extensions {
+			languageByExtension[ext] = i
+		}
+	}
+}
+
+// languageFromPath 根据文件扩展名判断语言，无法判断时返回空字符串
+func languageFromPath(filePath string) string {
+	if i, ok := languageByExtension[strings.ToLower(path.Ext(filePath))]; ok {
+		return languages[i].Name
+	}
+	return ""
+}
+
+// detectLanguage 检测对话涉及的编程语言
+// 依据代码块标记、提到的文件扩展名和语法特征对整个对话打分，当前消息权重更高
+// 没有明显特征或多种语言得分相同时返回空字符串；客户端可以通过 workspace.lang 显式指定
+func detectLanguage(req OpenAIRequest) string {
+	// 工作区中的当前文件最能代表语言
+	if req.Workspace != nil {
+		if lang := languageFromPath(req.Workspace.Path); lang != "" {
+			return lang
+		}
+	}
+
+	scores := make([]int, len(languages))
+	for i, msg := range req.Messages {
+		weight := 1
+		if i == len(req.Messages)-1 {
+			weight = currentMessageWeight
+		}
+		scoreLanguages(scores, msg.GetContent(), weight)
+	}
+	if req.Workspace != nil {
+		scoreLanguages(scores, req.Workspace.Prefix+"\n"+req.Workspace.Suffix, currentMessageWeight)
+	}
+
+	best, bestScore, secondScore := -1, 0, 0
+	for i, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, secondScore = i, score, bestScore
+		case score > secondScore:
+			secondScore = score
+		}
+	}
+	if best < 0 || bestScore < minLanguageScore || bestScore == secondScore {
+		return ""
+	}
+	return languages[best].Name
+}
+
+// scoreLanguages 按文本中的特征为每种语言加分
+func scoreLanguages(scores []int, text string, weight int) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+
+	for _, match := range fencePattern.FindAllStringSubmatch(text, -1) {
+		if i, ok := languageByFence[strings.ToLower(match[2])]; ok {
+			scores[i] += fenceScore * weight
+		}
+	}
+
+	// 同一文件扩展名在一条消息中只计一次
+	seen := make(map[int]bool)
+	for _, match := range fileNamePattern.FindAllStringSubmatch(text, -1) {
+		if i, ok := languageByExtension["."+strings.ToLower(match[1])]; ok && !seen[i] {
+			seen[i] = true
+			scores[i] += extensionScore * weight
+		}
+	}
+
+	for i, lang := range languages {
+		for _, pattern := range lang.Syntax {
+			if pattern.MatchString(text) {
+				scores[i] += syntaxScore * weight
+			}
+		}
+		for _, pattern := range lang.Strong {
+			if pattern.MatchString(text) {
+				scores[i] += strongScore * weight
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	user := func(content string) ChatMessage { return ChatMessage{Role: "user", Content: content} }
+	tests := []struct {
+		name      string
+		messages  []ChatMessage
+		workspace *WorkspaceContext
+		want      string
+	}{
+		{"empty", nil, nil, ""},
+		{"plain text", []ChatMessage{user("how are you today?")}, nil, ""},
+		{"fence", []ChatMessage{user("```python\nprint(1)\n```")}, nil, "Python"},
+		{"file name", []ChatMessage{user("why does main.rs fail to build?")}, nil, "Rust"},
+		{"go syntax", []ChatMessage{user("package main\n\nfunc main() {\n\tx := 1\n\tif err != nil {}\n}")}, nil, "Go"},
+		{"typescript over javascript", []ChatMessage{user("interface User {\n  name: string\n}\nconst u: User = load()\nconsole.log(u)")}, nil, "TypeScript"},
+		{"c++ over c", []ChatMessage{user("#include <vector>\nint main() { std::cout << 1; }")}, nil, "C++"},
+		{"sql", []ChatMessage{user("SELECT id FROM users WHERE age > 1; INSERT INTO logs VALUES (1)")}, nil, "SQL"},
+		{"single weak hint in history", []ChatMessage{user("use printf( here"), {Role: "assistant", Content: "ok"}, user("thanks")}, nil, ""},
+		{"tie", []ChatMessage{user("compare a.go and b.py")}, nil, ""},
+		{
+			name:     "current message outweighs history",
+			messages: []ChatMessage{user("```go\nx := 1\n```"), {Role: "assistant", Content: "ok"}, user("```python\nprint(1)\n```")},
+			want:     "Python",
+		},
+		{"workspace path wins", []ChatMessage{user("```python\nprint(1)\n```")}, &WorkspaceContext{Path: "src/App.kt"}, "Kotlin"},
+		{"workspace code", []ChatMessage{user("complete this")}, &WorkspaceContext{Prefix: "<?php\n$this->run();"}, "PHP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := detectLanguage(OpenAIRequest{Messages: tt.messages, Workspace: tt.workspace})
+			if got != tt.want {
+				t.Errorf("detectLanguage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLanguageFromPath(t *testing.T) {
+	tests := map[string]string{
+		"main.go":        "Go",
+		"src/App.TSX":    "TypeScript",
+		"include/util.h": "C",
+		"Makefile":       "",
+		"notes.txt":      "",
+	}
+	for path, want := range tests {
+		if got := languageFromPath(path); got != want {
+			t.Errorf("languageFromPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -102,7 +103,9 @@ func AuthTokenMiddleware() gin.HandlerFunc {
 
 		// 验证会话令牌
 		if !ValidateToken(token) {
-			logger.Log.Info("无效的会话令牌:", token)
+			logger.WithContext(c).WithFields(logrus.Fields{
+				"token_fingerprint": logger.Fingerprint(token),
+			}).Info("无效的会话令牌")
 			c.Redirect(http.StatusFound, "/login?error=token_expired")
 			c.Abort()
 			return
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Redis数据结构版本和迁移记录
+const (
+	schemaVersionKey    = "schema_version"
+	schemaMigrationKey  = "schema_migrations"
+	schemaMigrationLock = "schema_migration_lock"
+)
+
+const (
+	// 迁移锁的有效期，持有锁的实例异常退出后其他实例可以重新获取
+	migrationLockTTL = 10 * time.Minute
+	// 等待其他实例完成迁移的最长时间
+	migrationWaitTimeout = 2 * time.Minute
+	// 保留的迁移记录数量
+	migrationHistoryLimit = 100
+)
+
+// Migration 一次Redis数据结构迁移，Up 需要可以重复执行
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(run *MigrationRun) error
+}
+
+// migrations 按版本号顺序执行的迁移，新增迁移追加在末尾，已发布的迁移不要修改版本号
+var migrations = []Migration{
+	{Version: 1, Name: "token-remark", Up: migrateTokenRemark},
+	{Version: 2, Name: "token-key-layout", Up: migrateTokenKeyLayout},
+	{Version: 3, Name: "token-keyed-id", Up: migrateTokenKeyedID},
+}
+
+// MigrationRun 单次迁移的执行上下文
+type MigrationRun struct {
+	DryRun  bool
+	Changes int
+
+	migration Migration
+}
+
+// Change 记录一项数据变更，返回是否需要实际写入（dry-run时返回false）
+func (r *MigrationRun) Change(fields logrus.Fields, message string) bool {
+	r.Changes++
+	entry := logger.Log.WithFields(fields).WithFields(logrus.Fields{
+		"migration": r.migration.Name,
+		"version":   r.migration.Version,
+		"dry_run":   r.DryRun,
+	})
+	entry.Info(message)
+	return !r.DryRun
+}
+
+// MigrationStatus 迁移的执行状态
+type MigrationStatus struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	Changes   int       `json:"changes"`
+	AppliedAt time.Time `json:"applied_at,omitempty"`
+}
+
+// migrationRecord 已执行迁移的记录
+type migrationRecord struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Changes   int       `json:"changes"`
+	Instance  string    `json:"instance"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// LatestSchemaVersion 返回当前程序支持的最新数据版本
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion 返回Redis中记录的数据版本，未记录时为0
+func SchemaVersion() (int, error) {
+	value, err := config.RedisGet(schemaVersionKey)
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// MigrationStatuses 返回所有迁移的执行状态
+func MigrationStatuses() ([]MigrationStatus, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[int]migrationRecord)
+	items, err := config.RedisLRange(schemaMigrationKey, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	// 列表中新的记录在前，同一版本只保留最新一次
+	for i := len(items) - 1; i >= 0; i-- {
+		var record migrationRecord
+		if json.Unmarshal([]byte(items[i]), &record) == nil {
+			records[record.Version] = record
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{
+			Version: m.Version,
+			Name:    m.Name,
+			Applied: m.Version <= version,
+		}
+		if record, ok := records[m.Version]; ok {
+			status.Changes = record.Changes
+			status.AppliedAt = record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// RunMigrations 执行所有未执行的迁移，多个实例同时启动时只有一个实例执行，其他实例等待完成
+// dryRun 为true时不加锁、不写入，只记录将要发生的变更
+func RunMigrations(dryRun bool) error {
+	version, err := SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("读取数据版本失败: %v", err)
+	}
+	if version > LatestSchemaVersion() {
+		logger.Log.WithFields(logrus.Fields{
+			"schema_version": version,
+			"latest_version": LatestSchemaVersion(),
+		}).Warn("Redis数据版本高于当前程序支持的版本，请确认是否误用了旧版本程序")
+		return nil
+	}
+	if version == LatestSchemaVersion() {
+		return nil
+	}
+
+	if dryRun {
+		return runPendingMigrations(version, true)
+	}
+
+	lockValue := migrationInstance() + "/" + randomHex(8)
+	deadline := time.Now().Add(migrationWaitTimeout)
+	for {
+		acquired, err := config.RedisSetNX(schemaMigrationLock, lockValue, migrationLockTTL)
+		if err != nil {
+			return fmt.Errorf("获取迁移锁失败: %v", err)
+		}
+		if acquired {
+			break
+		}
+
+		// 其他实例正在迁移，等待完成后重新检查版本
+		if time.Now().After(deadline) {
+			return fmt.Errorf("等待其他实例完成数据迁移超时")
+		}
+		logger.Log.Info("其他实例正在执行数据迁移，等待完成")
+		time.Sleep(2 * time.Second)
+
+		if version, err = SchemaVersion(); err != nil {
+			return fmt.Errorf("读取数据版本失败: %v", err)
+		}
+		if version >= LatestSchemaVersion() {
+			return nil
+		}
+	}
+	defer func() {
+		if err := config.RedisDelIfValue(schemaMigrationLock, lockValue); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Warn("释放迁移锁失败")
+		}
+	}()
+
+	// 获取锁后重新读取版本，避免重复执行其他实例刚完成的迁移
+	if version, err = SchemaVersion(); err != nil {
+		return fmt.Errorf("读取数据版本失败: %v", err)
+	}
+	return runPendingMigrations(version, false)
+}
+
+// runPendingMigrations 按顺序执行版本号大于 version 的迁移，任一迁移失败时停止
+func runPendingMigrations(version int, dryRun bool) error {
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		log := logger.Log.WithFields(logrus.Fields{
+			"migration": m.Name,
+			"version":   m.Version,
+			"dry_run":   dryRun,
+		})
+		log.Info("开始执行数据迁移")
+
+		start := time.Now()
+		run := &MigrationRun{DryRun: dryRun, migration: m}
+		if err := m.Up(run); err != nil {
+			return fmt.Errorf("执行迁移 %d(%s) 失败: %v", m.Version, m.Name, err)
+		}
+
+		if !dryRun {
+			if err := config.RedisSet(schemaVersionKey, strconv.Itoa(m.Version), 0); err != nil {
+				return fmt.Errorf("保存数据版本失败: %v", err)
+			}
+			record, _ := json.Marshal(migrationRecord{
+				Version:   m.Version,
+				Name:      m.Name,
+				Changes:   run.Changes,
+				Instance:  migrationInstance(),
+				AppliedAt: time.Now(),
+			})
+			if err := config.RedisLPushTrim(schemaMigrationKey, string(record), migrationHistoryLimit); err != nil {
+				log.WithField("error", err.Error()).Warn("保存迁移记录失败")
+			}
+		}
+
+		log.WithFields(logrus.Fields{
+			"changes":     run.Changes,
+			"duration_ms": time.Since(start).Milliseconds(),
+		}).Info("数据迁移完成")
+	}
+	return nil
+}
+
+// migrationInstance 返回当前实例标识，记录在迁移锁和迁移记录中
+func migrationInstance() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// randomHex 生成随机十六进制字符串
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// migrateTokenRemark 确保所有token都有remark字段
+func migrateTokenRemark(run *MigrationRun) error {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return fmt.Errorf("获取token列表失败: %v", err)
+	}
+
+	for _, key := range keys {
+		// 检查是否已有remark字段
+		exists, err := config.RedisHExists(key, "remark")
+		if err != nil {
+			return fmt.Errorf("检查token备注字段失败: %v", err)
+		}
+
+		// 如果没有remark字段，添加一个空的remark
+		if !exists && run.Change(logrus.Fields{"token_fingerprint": logger.Fingerprint(key[6:])}, "添加remark字段") {
+			if err := config.RedisHSet(key, "remark", ""); err != nil {
+				return fmt.Errorf("添加remark字段失败: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"augment2api/config"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// useTestMigrations 使用记录执行顺序的迁移替换全局迁移列表
+func useTestMigrations(t *testing.T, failAt int) *[]int {
+	t.Helper()
+	var applied []int
+	previous := migrations
+	migrations = nil
+	for _, version := range []int{1, 2, 3} {
+		version := version
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    "test",
+			Up: func(run *MigrationRun) error {
+				if version == failAt {
+					return errors.New("failed")
+				}
+				if run.Change(logrus.Fields{}, "change") {
+					applied = append(applied, version)
+				}
+				return nil
+			},
+		})
+	}
+	t.Cleanup(func() { migrations = previous })
+	return &applied
+}
+
+func TestRunMigrations(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     string
+		dryRun      bool
+		failAt      int
+		wantErr     bool
+		wantApplied []int
+		wantVersion int
+	}{
+		{"all pending", "", false, 0, false, []int{1, 2, 3}, 3},
+		{"partially applied", "1", false, 0, false, []int{2, 3}, 3},
+		{"up to date", "3", false, 0, false, nil, 3},
+		{"newer than program", "4", false, 0, false, nil, 4},
+		{"dry run", "1", true, 0, false, nil, 1},
+		{"stops at failure", "", false, 2, true, []int{1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestRedis(t)
+			if tt.version != "" {
+				server.Set(schemaVersionKey, tt.version)
+			}
+			applied := useTestMigrations(t, tt.failAt)
+
+			err := RunMigrations(tt.dryRun)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunMigrations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(*applied, tt.wantApplied) {
+				t.Errorf("applied = %v, want %v", *applied, tt.wantApplied)
+			}
+			version, err := SchemaVersion()
+			if err != nil || version != tt.wantVersion {
+				t.Errorf("SchemaVersion() = %d, %v, want %d", version, err, tt.wantVersion)
+			}
+			if server.Exists(schemaMigrationLock) {
+				t.Error("migration lock should be released")
+			}
+		})
+	}
+}
+
+func TestMigrationStatuses(t *testing.T) {
+	newTestRedis(t)
+	useTestMigrations(t, 0)
+	if err := config.RedisSet(schemaVersionKey, "2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := MigrationStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []bool
+	for _, status := range statuses {
+		applied = append(applied, status.Applied)
+	}
+	if want := []bool{true, true, false}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied = %v, want %v", applied, want)
+	}
+}
+
+func TestMigrateTokenRemarkDryRun(t *testing.T) {
+	tests := []struct {
+		dryRun     bool
+		wantRemark bool
+	}{
+		{true, false},
+		{false, true},
+	}
+	for _, tt := range tests {
+		server := newTestRedis(t)
+		server.HSet("token:abc", "tenant_url", "https://d1.api.augmentcode.com/")
+
+		run := &MigrationRun{DryRun: tt.dryRun, migration: Migration{Version: 1, Name: "token-remark"}}
+		if err := migrateTokenRemark(run); err != nil {
+			t.Fatal(err)
+		}
+		if run.Changes != 1 {
+			t.Errorf("dryRun=%v changes = %d, want 1", tt.dryRun, run.Changes)
+		}
+		exists, _ := config.RedisHExists("token:abc", "remark")
+		if exists != tt.wantRemark {
+			t.Errorf("dryRun=%v remark exists = %v, want %v", tt.dryRun, exists, tt.wantRemark)
+		}
+	}
+}
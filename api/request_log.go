@@ -0,0 +1,313 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 请求日志存储在有序集合中，分数为请求时间（毫秒），成员为JSON
+const requestLogKey = "request_log"
+
+// 请求日志在gin上下文中的键名
+const requestLogContextKey = "request_log"
+
+// 单次查询返回的最大条数
+const requestLogQueryLimit = 1000
+
+// RequestLog 单次聊天请求的记录
+type RequestLog struct {
+	RequestID        string    `json:"request_id"`
+	Time             time.Time `json:"time"`
+	APIKey           string    `json:"api_key,omitempty"` // API密钥指纹
+	Model            string    `json:"model"`
+	Mode             string    `json:"mode"`
+	Stream           bool      `json:"stream"`
+	TokenID          string    `json:"token_id,omitempty"`
+	TokenFingerprint string    `json:"token_fingerprint,omitempty"`
+	TokenGroup       string    `json:"token_group,omitempty"`
+	TenantURL        string    `json:"tenant_url,omitempty"`
+	Status           int       `json:"status"`
+	LatencyMs        int64     `json:"latency_ms"`
+	TTFBMs           int64     `json:"ttfb_ms"`
+	FallbackUsed     bool      `json:"fallback_used"`
+	BlockDetected    bool      `json:"block_detected"`
+	ContextTruncated int       `json:"context_truncated,omitempty"` // 超出上下文预算被移除的历史轮数
+	Cache            string    `json:"cache,omitempty"`             // 回复缓存情况：hit、miss 或 bypass
+	Coalesced        bool      `json:"coalesced,omitempty"`         // 合并到了进行中的相同请求，未占用token
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Prompt           string    `json:"prompt,omitempty"`
+	Response         string    `json:"response,omitempty"`
+
+	start time.Time
+}
+
+// requestLogFrom 获取当前请求的日志记录，未启用时返回nil
+func requestLogFrom(c *gin.Context) *RequestLog {
+	if value, exists := c.Get(requestLogContextKey); exists {
+		entry, _ := value.(*RequestLog)
+		return entry
+	}
+	return nil
+}
+
+// markFirstByte 记录首字节时间，只记录第一次
+func (l *RequestLog) markFirstByte() {
+	if l != nil && l.TTFBMs == 0 {
+		l.TTFBMs = time.Since(l.start).Milliseconds()
+	}
+}
+
+// markFallback 记录已切换到CHAT模式重试
+func (l *RequestLog) markFallback() {
+	if l != nil {
+		l.FallbackUsed = true
+		l.Mode = "CHAT"
+	}
+}
+
+// markBlocked 记录检测到block信息
+func (l *RequestLog) markBlocked() {
+	if l != nil {
+		l.BlockDetected = true
+	}
+}
+
+// setUsage 记录估算的token数量
+func (l *RequestLog) setUsage(promptTokens, completionTokens int) {
+	if l != nil {
+		l.PromptTokens = promptTokens
+		l.CompletionTokens = completionTokens
+	}
+}
+
+// setBodies 在开启记录时保存截断后的提示词和回复
+func (l *RequestLog) setBodies(prompt, response string) {
+	if l == nil || !config.AppConfig.RequestLogBodies {
+		return
+	}
+	l.Prompt = truncateRunes(prompt, config.AppConfig.RequestLogBodyLimit)
+	l.Response = truncateRunes(response, config.AppConfig.RequestLogBodyLimit)
+}
+
+// truncateRunes 按字符数截断字符串
+func truncateRunes(s string, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit]) + "..."
+}
+
+// RequestLogMiddleware 记录每个聊天请求的关键信息，并累加使用统计
+func RequestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if (!config.AppConfig.RequestLogEnabled && !config.AppConfig.AnalyticsEnabled) || config.AppConfig.CodingMode == "true" {
+			c.Next()
+			return
+		}
+
+		entry := &RequestLog{
+			RequestID: c.GetString(logger.RequestIDKey),
+			Time:      time.Now(),
+			start:     time.Now(),
+		}
+		if apiKey := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")); apiKey != "" {
+			entry.APIKey = logger.Fingerprint(apiKey)
+		}
+		c.Set(requestLogContextKey, entry)
+
+		c.Next()
+
+		entry.Status = c.Writer.Status()
+		entry.LatencyMs = time.Since(entry.start).Milliseconds()
+		entry.TokenID = c.GetString("token_id")
+		entry.TokenFingerprint = logger.Fingerprint(c.GetString("token"))
+		entry.TenantURL = c.GetString("tenant_url")
+		entry.TokenGroup = c.GetString("token_group")
+
+		go func() {
+			if config.AppConfig.RequestLogEnabled {
+				saveRequestLog(entry)
+			}
+			if config.AppConfig.AnalyticsEnabled {
+				recordUsageAnalytics(entry)
+			}
+		}()
+	}
+}
+
+// saveRequestLog 写入请求日志并清理超出数量或保留时间的旧记录
+func saveRequestLog(entry *RequestLog) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	minTime := time.Now().Add(-config.AppConfig.RequestLogRetention)
+	err = config.RedisZAddCapped(requestLogKey, float64(entry.Time.UnixMilli()), string(data),
+		int64(config.AppConfig.RequestLogMaxEntries), float64(minTime.UnixMilli()))
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			logger.RequestIDKey: entry.RequestID,
+			"error":             err.Error(),
+		}).Error("保存请求日志失败")
+	}
+}
+
+// requestLogFilter 请求日志查询条件
+type requestLogFilter struct {
+	From    time.Time
+	To      time.Time
+	APIKey  string
+	TokenID string
+	Status  string
+	Model   string
+}
+
+// match 判断日志是否满足查询条件
+func (f requestLogFilter) match(entry RequestLog) bool {
+	if f.APIKey != "" && entry.APIKey != f.APIKey {
+		return false
+	}
+	if f.TokenID != "" && entry.TokenID != f.TokenID {
+		return false
+	}
+	if f.Model != "" && !strings.EqualFold(entry.Model, f.Model) {
+		return false
+	}
+	return matchStatus(f.Status, entry.Status)
+}
+
+// matchStatus 支持具体状态码、"2xx"/"4xx"/"5xx"、"success" 和 "error"
+func matchStatus(filter string, status int) bool {
+	switch filter {
+	case "":
+		return true
+	case "success":
+		return status < 400
+	case "error":
+		return status >= 400
+	}
+	if len(filter) == 3 && strings.HasSuffix(filter, "xx") {
+		return strconv.Itoa(status/100) == filter[:1]
+	}
+	code, err := strconv.Atoi(filter)
+	return err == nil && code == status
+}
+
+// parseTimeParam 解析RFC3339或Unix秒格式的时间参数
+func parseTimeParam(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// QueryRequestLogs 按时间倒序查询满足条件的请求日志
+func QueryRequestLogs(filter requestLogFilter, offset, limit int) ([]RequestLog, error) {
+	logs := make([]RequestLog, 0, limit)
+	maxScore := float64(filter.To.UnixMilli())
+	minScore := float64(filter.From.UnixMilli())
+
+	// 分批读取并过滤，直到凑够所需条数
+	const batchSize = 500
+	skipped := 0
+	for scanned := int64(0); len(logs) < limit; scanned += batchSize {
+		items, err := config.RedisZRevRangeByScore(requestLogKey, maxScore, minScore, scanned, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			var entry RequestLog
+			if json.Unmarshal([]byte(item), &entry) != nil || !filter.match(entry) {
+				continue
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			logs = append(logs, entry)
+			if len(logs) >= limit {
+				break
+			}
+		}
+		if len(items) < batchSize {
+			break
+		}
+	}
+	return logs, nil
+}
+
+// GetRequestLogsHandler 查询请求日志
+// 支持参数: from、to（RFC3339或Unix秒）、key、token、status、model、offset、limit
+func GetRequestLogsHandler(c *gin.Context) {
+	filter := requestLogFilter{
+		From:   time.Now().Add(-config.AppConfig.RequestLogRetention),
+		To:     time.Now(),
+		Status: c.Query("status"),
+		Model:  c.Query("model"),
+	}
+
+	for param, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := c.Query(param); value != "" {
+			parsed, err := parseTimeParam(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": "error",
+					"error":  "无效的时间参数 " + param,
+				})
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	// API密钥和token均支持传入原文或指纹/ID
+	if key := c.Query("key"); key != "" {
+		if strings.HasPrefix(key, "fp:") {
+			filter.APIKey = key
+		} else {
+			filter.APIKey = logger.Fingerprint(key)
+		}
+	}
+	if token := c.Query("token"); token != "" {
+		filter.TokenID = ResolveTokenID(token)
+	}
+
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > requestLogQueryLimit {
+		limit = requestLogQueryLimit
+	}
+
+	logs, err := QueryRequestLogs(filter, offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "查询请求日志失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"logs":   logs,
+		"offset": offset,
+		"limit":  limit,
+	})
+}
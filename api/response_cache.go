@@ -0,0 +1,244 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// 回复缓存存储在 response_cache:<请求哈希> 中，response_cache_index 记录写入时间用于淘汰
+const (
+	responseCachePrefix   = "response_cache:"
+	responseCacheIndexKey = "response_cache_index"
+)
+
+// ResponseCacheHeader 返回本次请求的缓存情况：HIT、MISS 或 BYPASS
+const ResponseCacheHeader = "X-Cache"
+
+// 缓存情况，同时记录在请求日志中
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheBypass = "bypass"
+)
+
+// 重放流式回复时每个分块的字符数
+const cacheReplayChunkRunes = 32
+
+// cachedResponse 缓存的回复
+type cachedResponse struct {
+	Model        string    `json:"model"`
+	Text         string    `json:"text"`
+	PromptTokens int       `json:"prompt_tokens"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// responseCacheKey 根据API密钥、模型、消息和影响回复的参数计算缓存key
+// 模型名称不区分大小写，消息角色和文本内容忽略首尾空白；stream 和 user 不影响回复，不参与计算
+func responseCacheKey(c *gin.Context, req *OpenAIRequest) string {
+	messages := make([]ChatMessage, len(req.Messages))
+	for i, msg := range req.Messages {
+		content := msg.Content
+		if text, ok := content.(string); ok {
+			content = strings.TrimSpace(text)
+		}
+		messages[i] = ChatMessage{Role: strings.ToLower(strings.TrimSpace(msg.Role)), Content: content}
+	}
+
+	// 不同API密钥的缓存互不共享
+	apiKey := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	data, _ := json.Marshal(struct {
+		APIKey      string            `json:"api_key"`
+		Model       string            `json:"model"`
+		Messages    []ChatMessage     `json:"messages"`
+		Temperature float64           `json:"temperature"`
+		MaxTokens   int               `json:"max_tokens"`
+		Workspace   *WorkspaceContext `json:"workspace"`
+	}{apiKey, strings.ToLower(strings.TrimSpace(req.Model)), messages, req.Temperature, req.MaxTokens, req.Workspace})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheControl 解析请求的Cache-Control，no-cache 跳过读取缓存，no-store 不写入缓存
+func cacheControl(c *gin.Context) (noCache, noStore bool) {
+	for _, directive := range strings.Split(strings.ToLower(c.GetHeader("Cache-Control")), ",") {
+		switch strings.TrimSpace(directive) {
+		case "no-cache":
+			noCache = true
+		case "no-store":
+			noCache, noStore = true, true
+		}
+	}
+	return noCache, noStore
+}
+
+// getCachedResponse 读取缓存的回复，不存在时返回nil
+func getCachedResponse(key string) (*cachedResponse, error) {
+	value, err := config.RedisGet(responseCachePrefix + key)
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal([]byte(value), &cached); err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+// saveCachedResponse 写入缓存，超出数量上限时淘汰最早写入的缓存
+func saveCachedResponse(key string, cached cachedResponse) error {
+	runtimeConfig := config.Current()
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if len(data) > runtimeConfig.ResponseCacheMaxBytes {
+		return nil
+	}
+	if err := config.RedisSet(responseCachePrefix+key, string(data), runtimeConfig.ResponseCacheTTL); err != nil {
+		return err
+	}
+
+	evicted, err := config.RedisZAddEvict(responseCacheIndexKey, float64(cached.CreatedAt.UnixMilli()), key,
+		int64(runtimeConfig.ResponseCacheMaxEntries))
+	if err != nil {
+		return err
+	}
+	for _, old := range evicted {
+		if err := config.RedisDel(responseCachePrefix + old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChatCompletionsRoutes 由ChatCompletionsHandler处理的聊天路由，包括兼容旧客户端的别名
+var ChatCompletionsRoutes = []string{"/v1/chat/completions", "/v1", "/v1/chat"}
+
+// isChatCompletionsRoute 判断请求是否匹配到聊天路由，回复缓存和请求合并只作用于这些路由
+func isChatCompletionsRoute(c *gin.Context) bool {
+	fullPath := c.FullPath()
+	for _, route := range ChatCompletionsRoutes {
+		if strings.HasSuffix(fullPath, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResponseCacheMiddleware 相同的聊天请求直接返回缓存的回复，不占用token
+// 通过 RESPONSE_CACHE_TTL 开启，请求头 Cache-Control: no-cache 跳过缓存，no-store 同时不写入缓存
+func ResponseCacheMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.Current().ResponseCacheTTL <= 0 || !isChatCompletionsRoute(c) {
+			c.Next()
+			return
+		}
+		req := peekChatRequest(c)
+		if len(req.Messages) == 0 {
+			c.Next()
+			return
+		}
+
+		reqLog := requestLogFrom(c)
+		log := logger.WithContext(c)
+		key := responseCacheKey(c, req)
+		noCache, noStore := cacheControl(c)
+
+		result := cacheMiss
+		if noCache {
+			result = cacheBypass
+		} else {
+			cached, err := getCachedResponse(key)
+			if err != nil {
+				log.WithField("error", err.Error()).Warn("读取回复缓存失败")
+			} else if cached != nil {
+				if reqLog != nil {
+					reqLog.Model = req.Model
+					reqLog.Stream = req.Stream
+					reqLog.Cache = cacheHit
+				}
+				c.Header(ResponseCacheHeader, strings.ToUpper(cacheHit))
+				log.WithFields(logrus.Fields{
+					"model":     req.Model,
+					"cached_at": cached.CreatedAt.Format(time.RFC3339),
+				}).Info("命中回复缓存")
+				replayCachedResponse(c, req, cached)
+				c.Abort()
+				return
+			}
+		}
+
+		if reqLog != nil {
+			reqLog.Cache = result
+		}
+		c.Header(ResponseCacheHeader, strings.ToUpper(result))
+		c.Next()
+
+		value, exists := c.Get(chatResultKey)
+		if noStore || !exists || c.Writer.Status() != http.StatusOK {
+			return
+		}
+		chat := value.(chatResult)
+		if chat.Text == "" {
+			return
+		}
+		err := saveCachedResponse(key, cachedResponse{
+			Model:        req.Model,
+			Text:         chat.Text,
+			PromptTokens: chat.PromptTokens,
+			CreatedAt:    time.Now(),
+		})
+		if err != nil {
+			log.WithField("error", err.Error()).Warn("写入回复缓存失败")
+		}
+	}
+}
+
+// replayCachedResponse 按请求的格式返回缓存的回复，流式请求将回复重新分块发送
+func replayCachedResponse(c *gin.Context, req *OpenAIRequest, cached *cachedResponse) {
+	requestLogFrom(c).markFirstByte()
+	if !req.Stream {
+		c.JSON(http.StatusOK, chatCompletionResponse(req.Model, cached.Text, cached.PromptTokens))
+		return
+	}
+
+	startEventStream(c)
+	responseID := fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
+	finishReason := "stop"
+	runes := []rune(cached.Text)
+	for start := 0; start < len(runes); start += cacheReplayChunkRunes {
+		end := start + cacheReplayChunkRunes
+		if end > len(runes) {
+			end = len(runes)
+		}
+		if end == len(runes) {
+			writeStreamChunk(c, responseID, req.Model, string(runes[start:end]), &finishReason)
+		} else {
+			writeStreamChunk(c, responseID, req.Model, string(runes[start:end]), nil)
+		}
+	}
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+}
+
+// startEventStream 设置SSE响应头
+func startEventStream(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResponseCacheKey(t *testing.T) {
+	base := func() OpenAIRequest {
+		return OpenAIRequest{
+			Model:    "claude-3.7-chat",
+			Messages: []ChatMessage{{Role: "user", Content: "hello"}},
+		}
+	}
+	tests := []struct {
+		name     string
+		modify   func(req *OpenAIRequest)
+		apiKey   string
+		wantSame bool
+	}{
+		{"identical", func(req *OpenAIRequest) {}, "", true},
+		{"model case", func(req *OpenAIRequest) { req.Model = " Claude-3.7-CHAT " }, "", true},
+		{"message whitespace", func(req *OpenAIRequest) { req.Messages[0] = ChatMessage{Role: " User", Content: "  hello\n"} }, "", true},
+		{"stream ignored", func(req *OpenAIRequest) { req.Stream = true }, "", true},
+		{"user ignored", func(req *OpenAIRequest) { req.User = "u1" }, "", true},
+		{"message text", func(req *OpenAIRequest) { req.Messages[0].Content = "hello!" }, "", false},
+		{"extra message", func(req *OpenAIRequest) { req.Messages = append(req.Messages, ChatMessage{Role: "user", Content: "x"}) }, "", false},
+		{"model", func(req *OpenAIRequest) { req.Model = "claude-3.7-agent" }, "", false},
+		{"temperature", func(req *OpenAIRequest) { req.Temperature = 0.5 }, "", false},
+		{"max tokens", func(req *OpenAIRequest) { req.MaxTokens = 10 }, "", false},
+		{"workspace", func(req *OpenAIRequest) { req.Workspace = &WorkspaceContext{Path: "a.go"} }, "", false},
+		{"api key", func(req *OpenAIRequest) {}, "other-key", false},
+	}
+
+	key := func(req OpenAIRequest, apiKey string) string {
+		c, _ := newTestContext(`{}`, map[string]string{"Authorization": "Bearer " + apiKey})
+		return responseCacheKey(c, &req)
+	}
+	want := key(base(), "key")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := base()
+			tt.modify(&req)
+			apiKey := "key"
+			if tt.apiKey != "" {
+				apiKey = tt.apiKey
+			}
+			if got := key(req, apiKey); (got == want) != tt.wantSame {
+				t.Errorf("key equal = %v, want %v", got == want, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		header                   string
+		wantNoCache, wantNoStore bool
+	}{
+		{"", false, false},
+		{"max-age=0", false, false},
+		{"No-Cache", true, false},
+		{"private, no-store", true, true},
+	}
+	for _, tt := range tests {
+		c, _ := newTestContext(`{}`, map[string]string{"Cache-Control": tt.header})
+		noCache, noStore := cacheControl(c)
+		if noCache != tt.wantNoCache || noStore != tt.wantNoStore {
+			t.Errorf("cacheControl(%q) = %v, %v, want %v, %v", tt.header, noCache, noStore, tt.wantNoCache, tt.wantNoStore)
+		}
+	}
+}
+
+func TestIsChatCompletionsRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	group := router.Group("/prefix").Group("/")
+	matched := make(map[string]bool)
+	group.Use(func(c *gin.Context) {
+		matched[c.Request.URL.Path] = isChatCompletionsRoute(c)
+	})
+	for _, route := range ChatCompletionsRoutes {
+		group.POST(route, func(c *gin.Context) {})
+	}
+	group.POST("/v1/completions", func(c *gin.Context) {})
+
+	tests := map[string]bool{
+		"/prefix/v1/chat/completions": true,
+		"/prefix/v1":                  true,
+		"/prefix/v1/chat":             true,
+		"/prefix/v1/completions":      false,
+	}
+	for path, want := range tests {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+		if matched[path] != want {
+			t.Errorf("isChatCompletionsRoute(%q) = %v, want %v", path, matched[path], want)
+		}
+	}
+}
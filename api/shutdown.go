@@ -0,0 +1,106 @@
+package api
+
+import (
+	"augment2api/pkg/logger"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// 当前实例持有的token租约（tokenID -> 进行中的请求数），停止服务时统一释放
+var (
+	tokenLeases   = make(map[string]int)
+	tokenLeasesMu sync.Mutex
+)
+
+// AcquireTokenLease 记录请求开始占用token
+func AcquireTokenLease(tokenID string) {
+	tokenLeasesMu.Lock()
+	tokenLeases[tokenID]++
+	tokenLeasesMu.Unlock()
+}
+
+// releaseTokenLease 记录请求结束释放token
+func releaseTokenLease(tokenID string) {
+	tokenLeasesMu.Lock()
+	defer tokenLeasesMu.Unlock()
+
+	if tokenLeases[tokenID] <= 1 {
+		delete(tokenLeases, tokenID)
+		return
+	}
+	tokenLeases[tokenID]--
+}
+
+// ReleaseAllTokenLeases 将本实例仍在占用的token标记为空闲，避免停止后token一直处于使用中
+func ReleaseAllTokenLeases() {
+	tokenLeasesMu.Lock()
+	tokenIDs := make([]string, 0, len(tokenLeases))
+	for tokenID := range tokenLeases {
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	tokenLeases = make(map[string]int)
+	tokenLeasesMu.Unlock()
+
+	for _, tokenID := range tokenIDs {
+		err := SetTokenRequestStatus(tokenID, TokenRequestStatus{
+			InProgress:    false,
+			LastRequestAt: time.Now(),
+		})
+		if err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token_id": tokenID,
+				"error":    err.Error(),
+			}).Error("释放token失败")
+		}
+	}
+
+	if len(tokenIDs) > 0 {
+		logger.Log.WithFields(logrus.Fields{
+			"count": len(tokenIDs),
+		}).Info("已释放仍在使用中的token")
+	}
+}
+
+// 已启动的定时任务调度器
+var (
+	schedulers   []*cron.Cron
+	schedulersMu sync.Mutex
+)
+
+// registerScheduler 记录调度器，停止服务时统一停止
+func registerScheduler(c *cron.Cron) {
+	schedulersMu.Lock()
+	schedulers = append(schedulers, c)
+	schedulersMu.Unlock()
+}
+
+// StopSchedulers 停止所有定时任务调度器，并等待正在执行的任务结束或ctx超时
+func StopSchedulers(ctx context.Context) {
+	schedulersMu.Lock()
+	stopping := schedulers
+	schedulers = nil
+	schedulersMu.Unlock()
+
+	for _, c := range stopping {
+		select {
+		case <-c.Stop().Done():
+		case <-ctx.Done():
+			logger.Log.Warn("等待定时任务结束超时")
+			return
+		}
+	}
+}
+
+// CancelCheckJobs 取消所有运行中的批量检测任务
+func CancelCheckJobs() {
+	checkJobsMu.Lock()
+	defer checkJobsMu.Unlock()
+
+	for _, job := range checkJobs {
+		job.cancel()
+	}
+}
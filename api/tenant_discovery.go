@@ -0,0 +1,210 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrTokenDisabled token已失效并被标记为不可用
+var ErrTokenDisabled = errors.New("token被标记为不可用")
+
+// 租户地址连续失败多少次后判定为全局不可用
+const tenantDownThreshold = 3
+
+const (
+	tenantMappingPrefix = "tenant_mapping:" // token -> 租户地址缓存
+	tenantFailPrefix    = "tenant_fail:"    // 租户地址连续失败次数
+	tenantDownPrefix    = "tenant_down:"    // 全局不可用的租户地址
+	tenantHitsKey       = "tenant_hits"     // 各租户地址命中次数，用于排序候选地址
+)
+
+// isTenantDown 检查租户地址是否被判定为全局不可用
+func isTenantDown(tenantURL string) bool {
+	exists, err := config.RedisExists(tenantDownPrefix + tenantURL)
+	return err == nil && exists
+}
+
+// recordTenantFailure 记录租户地址失败，连续失败达到阈值后在一段时间内跳过该地址
+func recordTenantFailure(tenantURL string) {
+	ttl := config.AppConfig.TenantDownTTL
+	count, err := config.RedisIncrExpire(tenantFailPrefix+tenantURL, ttl)
+	if err != nil || count < tenantDownThreshold {
+		return
+	}
+
+	if err := config.RedisSet(tenantDownPrefix+tenantURL, "1", ttl); err != nil {
+		return
+	}
+	config.RedisDel(tenantFailPrefix + tenantURL)
+
+	logger.Log.WithFields(logrus.Fields{
+		"tenant_url": tenantURL,
+		"ttl":        ttl.String(),
+	}).Warn("租户地址连续请求失败，暂时跳过该地址")
+}
+
+// recordTenantSuccess 清除租户地址的失败计数
+func recordTenantSuccess(tenantURL string) {
+	config.RedisDel(tenantFailPrefix + tenantURL)
+}
+
+// tenantCandidatesFor 生成token的候选租户地址，按优先级排序
+// 依次为：缓存的映射、当前租户地址、按命中次数排序的配置地址
+func tenantCandidatesFor(tokenID, currentTenantURL string) []string {
+	seen := make(map[string]bool)
+	candidates := make([]string, 0, len(config.AppConfig.TenantCandidates)+2)
+
+	add := func(tenantURL string) {
+		if tenantURL == "" || seen[tenantURL] || isTenantDown(tenantURL) {
+			return
+		}
+		seen[tenantURL] = true
+		candidates = append(candidates, tenantURL)
+	}
+
+	if cached, err := config.RedisGet(tenantMappingPrefix + tokenID); err == nil {
+		add(cached)
+	}
+	add(currentTenantURL)
+
+	configured := append([]string(nil), config.AppConfig.TenantCandidates...)
+	hits := make(map[string]float64, len(configured))
+	for _, tenantURL := range configured {
+		hits[tenantURL] = config.RedisZScore(tenantHitsKey, tenantURL)
+	}
+	sort.SliceStable(configured, func(i, j int) bool {
+		return hits[configured[i]] > hits[configured[j]]
+	})
+	for _, tenantURL := range configured {
+		add(tenantURL)
+	}
+
+	return candidates
+}
+
+// CheckTokenTenantURL 检测token的租户地址
+func CheckTokenTenantURL(tokenID string) (string, error) {
+	return CheckTokenTenantURLContext(context.Background(), tokenID)
+}
+
+// CheckTokenTenantURLContext 并行探测候选租户地址，找到有效地址或确认token失效后立即取消其余探测
+func CheckTokenTenantURLContext(ctx context.Context, tokenID string) (string, error) {
+	tokenKey := "token:" + tokenID
+	currentTenantURL, _ := config.RedisHGet(tokenKey, "tenant_url")
+
+	token, err := GetTokenSecret(tokenID)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := tenantCandidatesFor(tokenID, currentTenantURL)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("没有可用的候选租户地址")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := config.AppConfig.TenantProbeConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu      sync.Mutex
+		found   string
+		invalid bool
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, concurrency)
+	)
+
+dispatch:
+	for _, tenantURL := range candidates {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(tenantURL string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, _, err := probeToken(ctx, token, tenantURL)
+			if ctx.Err() != nil {
+				// 已被取消，忽略结果
+				return
+			}
+
+			switch result {
+			case HealthCheckOK:
+				recordTenantSuccess(tenantURL)
+				mu.Lock()
+				if found == "" && !invalid {
+					found = tenantURL
+				}
+				mu.Unlock()
+				cancel()
+			case HealthCheckInvalid:
+				mu.Lock()
+				invalid = true
+				mu.Unlock()
+				cancel()
+			case HealthCheckDown:
+				recordTenantFailure(tenantURL)
+				logger.Log.WithFields(logrus.Fields{
+					"tenant_url": tenantURL,
+					"error":      err,
+				}).Debug("租户地址请求失败")
+			}
+		}(tenantURL)
+	}
+	wg.Wait()
+
+	if invalid {
+		// 只有当响应中包含"Invalid token"时才标记为不可用
+		if err := SetTokenStatus(tokenID, TokenStatusDisabled, "上游返回401 Invalid token", OperatorTenantCheck); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token_id": tokenID,
+				"error":    err.Error(),
+			}).Error("标记token为不可用失败")
+		}
+		return "", ErrTokenDisabled
+	}
+
+	if found == "" {
+		return "", fmt.Errorf("未找到有效的租户地址")
+	}
+
+	// 更新Redis中的租户地址和状态
+	if err := config.RedisHSet(tokenKey, "tenant_url", found); err != nil {
+		return "", err
+	}
+	// 被系统检查禁用的token检测通过后重新启用，管理员禁用或隔离的token保持原状态
+	status, _ := config.RedisHGet(tokenKey, "status")
+	if status == "" || (status == TokenStatusDisabled && disabledBySystemCheck(tokenID)) {
+		if err := SetTokenStatus(tokenID, TokenStatusActive, "租户地址检测通过", OperatorTenantCheck); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token_id": tokenID,
+				"error":    err.Error(),
+			}).Error("标记token为可用失败")
+		}
+	}
+	config.RedisSet(tenantMappingPrefix+tokenID, found, config.AppConfig.TenantCacheTTL)
+	config.RedisZIncrBy(tenantHitsKey, 1, found)
+
+	logger.Log.WithFields(logrus.Fields{
+		"token_id":       tokenID,
+		"new_tenant_url": found,
+	}).Info("token: 更新租户地址成功")
+
+	return found, nil
+}
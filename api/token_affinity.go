@@ -0,0 +1,87 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// ConversationHeader 客户端显式指定会话ID的请求头
+const ConversationHeader = "X-Conversation-ID"
+
+// 会话与token的绑定关系存储在 token_affinity:<会话key> 中，值为tokenID
+const tokenAffinityPrefix = "token_affinity:"
+
+// ConversationKey 计算请求所属会话的key，未开启会话绑定或无法识别会话时返回空字符串
+// 服务端会话使用会话ID，其他请求优先使用请求头中的会话ID，其次使用请求中的user字段，最后使用首条system消息和首条user消息
+func ConversationKey(c *gin.Context) string {
+	if config.Current().TokenAffinityTTL <= 0 {
+		return ""
+	}
+
+	var source string
+	if conv, exists := c.Get(conversationContextKey); exists {
+		source = "conversation|" + conv.(*Conversation).ID
+	} else if id := strings.TrimSpace(c.GetHeader(ConversationHeader)); id != "" {
+		source = "header|" + id
+	} else if req := peekChatRequest(c); req.User != "" {
+		source = "user|" + req.User
+	} else {
+		// 多轮对话中前面的消息保持不变，可以用来标识同一会话
+		var system, user string
+		for _, msg := range req.Messages {
+			switch {
+			case msg.Role == "system" && system == "":
+				system = msg.GetContent()
+			case msg.Role == "user" && user == "":
+				user = msg.GetContent()
+			}
+		}
+		if user == "" {
+			return ""
+		}
+		source = "messages|" + system + "\x00" + user
+	}
+
+	// 不同API密钥的相同会话互不影响
+	apiKey := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	sum := sha256.Sum256([]byte(apiKey + "\x00" + source))
+	return hex.EncodeToString(sum[:16])
+}
+
+// AffinityToken 返回会话上次使用的tokenID，没有绑定时返回空字符串
+func AffinityToken(conversationKey string) string {
+	if conversationKey == "" {
+		return ""
+	}
+	tokenID, err := config.RedisGet(tokenAffinityPrefix + conversationKey)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logger.Log.WithFields(logrus.Fields{
+			"conversation": conversationKey,
+			"error":        err.Error(),
+		}).Warn("读取会话token绑定失败")
+	}
+	return tokenID
+}
+
+// SetTokenAffinity 将会话绑定到token，每次使用后刷新有效期
+func SetTokenAffinity(conversationKey, tokenID string) {
+	ttl := config.Current().TokenAffinityTTL
+	if conversationKey == "" || ttl <= 0 {
+		return
+	}
+	if err := config.RedisSet(tokenAffinityPrefix+conversationKey, tokenID, ttl); err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"conversation": conversationKey,
+			"token_id":     tokenID,
+			"error":        err.Error(),
+		}).Warn("保存会话token绑定失败")
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"augment2api/config"
+	"testing"
+	"time"
+)
+
+func TestConversationKey(t *testing.T) {
+	const (
+		firstTurn  = `{"messages":[{"role":"system","content":"s"},{"role":"user","content":"hi"}]}`
+		secondTurn = `{"messages":[{"role":"system","content":"s"},{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"more"}]}`
+	)
+	type request struct {
+		body    string
+		headers map[string]string
+		conv    string
+	}
+	tests := []struct {
+		name     string
+		a, b     request
+		wantSame bool
+	}{
+		{"same conversation across turns", request{body: firstTurn}, request{body: secondTurn}, true},
+		{"different first message", request{body: firstTurn}, request{body: `{"messages":[{"role":"system","content":"s"},{"role":"user","content":"other"}]}`}, false},
+		{"different system message", request{body: firstTurn}, request{body: `{"messages":[{"role":"system","content":"x"},{"role":"user","content":"hi"}]}`}, false},
+		{"user field", request{body: `{"user":"u1","messages":[{"role":"user","content":"a"}]}`}, request{body: `{"user":"u1","messages":[{"role":"user","content":"b"}]}`}, true},
+		{"header overrides messages", request{body: firstTurn, headers: map[string]string{ConversationHeader: "c1"}}, request{body: `{"messages":[{"role":"user","content":"x"}]}`, headers: map[string]string{ConversationHeader: "c1"}}, true},
+		{"header differs", request{body: firstTurn, headers: map[string]string{ConversationHeader: "c1"}}, request{body: firstTurn, headers: map[string]string{ConversationHeader: "c2"}}, false},
+		{"api keys isolated", request{body: firstTurn, headers: map[string]string{"Authorization": "Bearer k1"}}, request{body: firstTurn, headers: map[string]string{"Authorization": "Bearer k2"}}, false},
+		{"server conversation", request{body: `{}`, conv: "id1"}, request{body: firstTurn, conv: "id1"}, true},
+	}
+
+	key := func(r request) string {
+		c, _ := newTestContext(r.body, r.headers)
+		if r.conv != "" {
+			c.Set(conversationContextKey, &Conversation{ID: r.conv})
+		}
+		return ConversationKey(c)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReloadable(t, func(r *config.Reloadable) { r.TokenAffinityTTL = time.Minute })
+			a, b := key(tt.a), key(tt.b)
+			if a == "" || b == "" {
+				t.Fatalf("empty key: %q %q", a, b)
+			}
+			if (a == b) != tt.wantSame {
+				t.Errorf("keys %q and %q, wantSame %v", a, b, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestConversationKeyEmpty(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		body string
+	}{
+		{"affinity disabled", 0, `{"messages":[{"role":"user","content":"hi"}]}`},
+		{"no user message", time.Minute, `{"messages":[{"role":"system","content":"s"}]}`},
+		{"invalid body", time.Minute, `not json`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReloadable(t, func(r *config.Reloadable) { r.TokenAffinityTTL = tt.ttl })
+			c, _ := newTestContext(tt.body, nil)
+			if got := ConversationKey(c); got != "" {
+				t.Errorf("ConversationKey() = %q, want empty", got)
+			}
+		})
+	}
+}
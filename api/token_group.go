@@ -0,0 +1,115 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenGroupsFor 按分组规则返回请求应使用的token分组，按顺序尝试
+// 没有匹配的规则时返回nil，表示使用全部token
+func TokenGroupsFor(c *gin.Context) []string {
+	rules := config.Current().TokenGroupRules
+	if len(rules) == 0 {
+		return nil
+	}
+
+	apiKey := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	model := ""
+	modelRead := false
+
+	for _, rule := range rules {
+		var matched bool
+		switch rule.Match {
+		case config.TokenGroupMatchKey:
+			if apiKey != "" {
+				matched = rule.MatchValue(apiKey) || rule.MatchValue(logger.Fingerprint(apiKey))
+			}
+		case config.TokenGroupMatchModel:
+			// 只有存在按模型匹配的规则时才读取请求体
+			if !modelRead {
+				model = peekChatRequest(c).Model
+				modelRead = true
+			}
+			matched = rule.MatchValue(model)
+		case config.TokenGroupMatchHeader:
+			matched = rule.MatchValue(c.GetHeader(rule.Header))
+		}
+		if matched {
+			return rule.Groups
+		}
+	}
+	return nil
+}
+
+// 预读的请求体在gin上下文中的键名
+const chatRequestPeekKey = "chat_request_peek"
+
+// peekChatRequest 在选择token前预读聊天请求，读取后恢复请求体供后续处理
+// 同一请求只解析一次，解析失败时返回空请求
+func peekChatRequest(c *gin.Context) *OpenAIRequest {
+	if value, exists := c.Get(chatRequestPeekKey); exists {
+		return value.(*OpenAIRequest)
+	}
+
+	req := &OpenAIRequest{}
+	c.Set(chatRequestPeekKey, req)
+	if c.Request.Body == nil {
+		return req
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err == nil {
+		_ = json.Unmarshal(body, req)
+	}
+	return req
+}
+
+// hasTag 判断token是否属于分组，* 匹配全部token
+func hasTag(tags []string, group string) bool {
+	if group == config.TokenGroupAll {
+		return true
+	}
+	for _, tag := range tags {
+		if tag == group {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterTokensByTag 筛选包含指定标签的token
+func FilterTokensByTag(tokens []TokenInfo, tag string) []TokenInfo {
+	if tag == "" {
+		return tokens
+	}
+	filtered := make([]TokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		if hasTag(t.Tags, tag) {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// collectTags 返回token列表中出现的所有标签
+func collectTags(tokens []TokenInfo) []string {
+	seen := make(map[string]bool)
+	tags := make([]string, 0)
+	for _, t := range tokens {
+		for _, tag := range t.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
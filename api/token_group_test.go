@@ -0,0 +1,51 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestTokenGroupsFor(t *testing.T) {
+	rules, errs := config.ParseTokenGroupRules([]string{
+		"key:team-a-key=team-a>*",
+		"key:" + logger.Fingerprint("team-b-key") + "=team-b",
+		"header:X-Team:ops=ops",
+		"model:*-agent=agent-capable>paid",
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	tests := []struct {
+		name    string
+		rules   []config.TokenGroupRule
+		body    string
+		headers map[string]string
+		want    []string
+	}{
+		{"no rules", nil, `{"model":"claude-3.7-agent"}`, nil, nil},
+		{"key", rules, `{}`, map[string]string{"Authorization": "Bearer team-a-key"}, []string{"team-a", "*"}},
+		{"key fingerprint", rules, `{}`, map[string]string{"Authorization": "Bearer team-b-key"}, []string{"team-b"}},
+		{"header", rules, `{}`, map[string]string{"X-Team": "ops"}, []string{"ops"}},
+		{"model case insensitive", rules, `{"model":"Claude-3.7-AGENT"}`, nil, []string{"agent-capable", "paid"}},
+		{"first match wins", rules, `{"model":"claude-3.7-agent"}`, map[string]string{"X-Team": "ops"}, []string{"ops"}},
+		{"no match", rules, `{"model":"claude-3.7-chat"}`, map[string]string{"X-Team": "dev"}, nil},
+		{"invalid body", rules, `not json`, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useReloadable(t, func(r *config.Reloadable) { r.TokenGroupRules = tt.rules })
+			c, _ := newTestContext(tt.body, tt.headers)
+			if got := TokenGroupsFor(c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TokenGroupsFor() = %v, want %v", got, tt.want)
+			}
+			// 预读后请求体仍可被处理函数读取
+			if body, _ := io.ReadAll(c.Request.Body); string(body) != tt.body {
+				t.Errorf("request body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
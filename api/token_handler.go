@@ -2,39 +2,40 @@ package api
 
 import (
 	"augment2api/config"
-	"augment2api/pkg/logger"
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
 )
 
 // TokenInfo 存储token信息
 type TokenInfo struct {
-	Token           string    `json:"token"`
-	TenantURL       string    `json:"tenant_url"`
-	UsageCount      int       `json:"usage_count"`        // 总对话次数
-	ChatUsageCount  int       `json:"chat_usage_count"`   // CHAT模式对话次数
-	AgentUsageCount int       `json:"agent_usage_count"`  // AGENT模式对话次数
-	Remark          string    `json:"remark"`             // 备注字段
-	InCool          bool      `json:"in_cool"`            // 是否在冷却中
-	CoolEnd         time.Time `json:"cool_end,omitempty"` // 冷却结束时间
-}
-
-// TokenItem token项结构
-type TokenItem struct {
-	Token     string `json:"token"`
-	TenantUrl string `json:"tenantUrl"`
+	ID              string      `json:"id"`    // token不透明ID，用于管理接口
+	Token           string      `json:"token"` // 脱敏后的token
+	TenantURL       string      `json:"tenant_url"`
+	UsageCount      int         `json:"usage_count"`        // 总对话次数
+	ChatUsageCount  int         `json:"chat_usage_count"`   // CHAT模式对话次数
+	AgentUsageCount int         `json:"agent_usage_count"`  // AGENT模式对话次数
+	Remark          string      `json:"remark"`             // 备注字段
+	Tags            []string    `json:"tags"`               // 标签
+	ChatUsageLimit  int         `json:"chat_usage_limit"`   // CHAT模式使用次数上限，为0时使用全局配置
+	AgentUsageLimit int         `json:"agent_usage_limit"`  // AGENT模式使用次数上限，为0时使用全局配置
+	InCool          bool        `json:"in_cool"`            // 是否在冷却中
+	CoolEnd         time.Time   `json:"cool_end,omitempty"` // 冷却结束时间
+	LastCheck       TokenHealth `json:"last_check"`         // 最近一次健康检查结果
+	Status          string      `json:"status"`             // 状态: active / disabled / quarantined
+	StatusReason    string      `json:"status_reason"`      // 状态变更原因
+	StatusUpdatedBy string      `json:"status_updated_by"`  // 状态变更操作者
+	StatusUpdatedAt string      `json:"status_updated_at"`  // 状态变更时间
 }
 
 // TokenRequestStatus 记录 token 请求状态
@@ -55,6 +56,11 @@ func GetRedisTokenHandler(c *gin.Context) {
 	page := c.DefaultQuery("page", "1")
 	pageSize := c.DefaultQuery("page_size", "0") // 0表示不分页，返回所有
 
+	// 状态筛选（可选）: active / disabled / quarantined / all
+	statusFilter := c.Query("status")
+	// 标签筛选（可选）
+	tagFilter := c.Query("tag")
+
 	pageNum, _ := strconv.Atoi(page)
 	pageSizeNum, _ := strconv.Atoi(pageSize)
 
@@ -62,8 +68,7 @@ func GetRedisTokenHandler(c *gin.Context) {
 		pageNum = 1
 	}
 
-	// 获取所有token的key (使用通配符模式)
-	keys, err := config.RedisKeys("token:*")
+	tokenList, err := ListTokens(statusFilter)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"status": "error",
@@ -71,12 +76,16 @@ func GetRedisTokenHandler(c *gin.Context) {
 		})
 		return
 	}
+	// 筛选前的全部标签，供页面选择
+	tags := collectTags(tokenList)
+	tokenList = FilterTokensByTag(tokenList, tagFilter)
 
 	// 如果没有token
-	if len(keys) == 0 {
+	if len(tokenList) == 0 {
 		c.JSON(http.StatusOK, gin.H{
 			"status":      "success",
 			"tokens":      []TokenInfo{},
+			"tags":        tags,
 			"total":       0,
 			"page":        pageNum,
 			"page_size":   pageSizeNum,
@@ -85,6 +94,52 @@ func GetRedisTokenHandler(c *gin.Context) {
 		return
 	}
 
+	// 计算总页数和分页数据
+	totalItems := len(tokenList)
+	totalPages := 1
+
+	// 如果需要分页
+	if pageSizeNum > 0 {
+		totalPages = (totalItems + pageSizeNum - 1) / pageSizeNum
+
+		// 确保页码有效
+		if pageNum > totalPages && totalPages > 0 {
+			pageNum = totalPages
+		}
+
+		// 计算分页的起始和结束索引
+		startIndex := (pageNum - 1) * pageSizeNum
+		endIndex := startIndex + pageSizeNum
+
+		if startIndex < totalItems {
+			if endIndex > totalItems {
+				endIndex = totalItems
+			}
+			tokenList = tokenList[startIndex:endIndex]
+		} else {
+			tokenList = []TokenInfo{}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"tokens":      tokenList,
+		"tags":        tags,
+		"total":       totalItems,
+		"page":        pageNum,
+		"page_size":   pageSizeNum,
+		"total_pages": totalPages,
+	})
+}
+
+// ListTokens 获取token列表，statusFilter 为空时不返回已禁用的token，为 all 时返回全部
+func ListTokens(statusFilter string) ([]TokenInfo, error) {
+	// 获取所有token的key (使用通配符模式)
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return nil, err
+	}
+
 	// 使用并发方式批量获取token信息
 	var wg sync.WaitGroup
 	tokenList := make([]TokenInfo, 0, len(keys))
@@ -93,13 +148,13 @@ func GetRedisTokenHandler(c *gin.Context) {
 	sem := make(chan struct{}, concurrencyLimit)
 
 	for _, key := range keys {
-		// 从key中提取token (格式: "token:{token}")
-		token := key[6:] // 去掉前缀 "token:"
+		// 从key中提取tokenID (格式: "token:{id}")
+		id := key[6:] // 去掉前缀 "token:"
 
 		wg.Add(1)
 		sem <- struct{}{} // 获取信号量
 
-		go func(tokenKey string, tokenValue string) {
+		go func(tokenKey string, id string) {
 			defer wg.Done()
 			defer func() { <-sem }() // 释放信号量
 
@@ -115,35 +170,55 @@ func GetRedisTokenHandler(c *gin.Context) {
 				return
 			}
 
-			// 检查token状态
-			status, ok := fields["status"]
-			if ok && status == "disabled" {
-				return // 跳过被标记为不可用的token
+			// 按状态筛选，未指定时不返回已禁用的token
+			status := fields["status"]
+			if status == "" {
+				status = TokenStatusActive
+			}
+			switch statusFilter {
+			case "":
+				if status == TokenStatusDisabled {
+					return
+				}
+			case "all":
+			default:
+				if status != statusFilter {
+					return
+				}
 			}
 
 			// 获取备注信息
 			remark := fields["remark"]
 
 			// 获取token的冷却状态 (异步获取)
-			coolStatus, _ := GetTokenCoolStatus(tokenValue)
+			coolStatus, _ := GetTokenCoolStatus(id)
 
 			// 获取使用次数 (可以考虑将这些计数缓存在Redis中)
-			chatCount := getTokenChatUsageCount(tokenValue)
-			agentCount := getTokenAgentUsageCount(tokenValue)
+			chatCount := getTokenChatUsageCount(id)
+			agentCount := getTokenAgentUsageCount(id)
 			totalCount := chatCount + agentCount
 
 			// 构建token信息并发送到channel
 			tokenListChan <- TokenInfo{
-				Token:           tokenValue,
+				ID:              id,
+				Token:           fields["token_masked"],
 				TenantURL:       tenantURL,
 				UsageCount:      totalCount,
 				ChatUsageCount:  chatCount,
 				AgentUsageCount: agentCount,
 				Remark:          remark,
+				Tags:            parseTags(fields["tags"]),
+				ChatUsageLimit:  tokenUsageLimit(fields["chat_usage_limit"], 0),
+				AgentUsageLimit: tokenUsageLimit(fields["agent_usage_limit"], 0),
 				InCool:          coolStatus.InCool,
 				CoolEnd:         coolStatus.CoolEnd,
+				LastCheck:       parseTokenHealth(fields),
+				Status:          status,
+				StatusReason:    fields["status_reason"],
+				StatusUpdatedBy: fields["status_updated_by"],
+				StatusUpdatedAt: fields["status_updated_at"],
 			}
-		}(key, token)
+		}(key, id)
 	}
 
 	// 启动一个goroutine来收集结果
@@ -157,47 +232,18 @@ func GetRedisTokenHandler(c *gin.Context) {
 		tokenList = append(tokenList, info)
 	}
 
-	// 计算总页数和分页数据
-	totalItems := len(tokenList)
-	totalPages := 1
-
-	// 如果需要分页
-	if pageSizeNum > 0 {
-		totalPages = (totalItems + pageSizeNum - 1) / pageSizeNum
-
-		// 确保页码有效
-		if pageNum > totalPages && totalPages > 0 {
-			pageNum = totalPages
-		}
-
-		// 计算分页的起始和结束索引
-		startIndex := (pageNum - 1) * pageSizeNum
-		endIndex := startIndex + pageSizeNum
-
-		if startIndex < totalItems {
-			if endIndex > totalItems {
-				endIndex = totalItems
-			}
-			tokenList = tokenList[startIndex:endIndex]
-		} else {
-			tokenList = []TokenInfo{}
-		}
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"status":      "success",
-		"tokens":      tokenList,
-		"total":       totalItems,
-		"page":        pageNum,
-		"page_size":   pageSizeNum,
-		"total_pages": totalPages,
+	// 并发获取的结果顺序不固定，按ID排序保证分页稳定
+	sort.Slice(tokenList, func(i, j int) bool {
+		return tokenList[i].ID < tokenList[j].ID
 	})
+
+	return tokenList, nil
 }
 
 // SaveTokenToRedis 保存token到Redis
 func SaveTokenToRedis(token, tenantURL string) error {
-	// 创建一个唯一的key，包含token和tenant_url
-	tokenKey := "token:" + token
+	// 使用tokenID作为key，原始token加密存储
+	tokenKey := "token:" + LookupTokenID(token)
 
 	// token已存在，则跳过
 	exists, err := config.RedisExists(tokenKey)
@@ -208,26 +254,25 @@ func SaveTokenToRedis(token, tenantURL string) error {
 		return nil
 	}
 
-	// 将tenant_url存储在token对应的哈希表中
-	err = config.RedisHSet(tokenKey, "tenant_url", tenantURL)
+	fields, err := tokenSecretFields(token)
 	if err != nil {
 		return err
 	}
 
+	// 将tenant_url存储在token对应的哈希表中
+	fields["tenant_url"] = tenantURL
 	// 默认将新添加的token标记为活跃状态
-	err = config.RedisHSet(tokenKey, "status", "active")
-	if err != nil {
-		return err
-	}
-
+	fields["status"] = TokenStatusActive
 	// 初始化备注为空字符串
-	return config.RedisHSet(tokenKey, "remark", "")
+	fields["remark"] = ""
+
+	return config.RedisHSetMap(tokenKey, fields)
 }
 
 // DeleteTokenHandler 删除指定的token
 func DeleteTokenHandler(c *gin.Context) {
-	token := c.Param("token")
-	if token == "" {
+	param := c.Param("token")
+	if param == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status": "error",
 			"error":  "未指定token",
@@ -235,78 +280,57 @@ func DeleteTokenHandler(c *gin.Context) {
 		return
 	}
 
-	tokenKey := "token:" + token
-
-	// 检查token是否存在
-	exists, err := config.RedisExists(tokenKey)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+	if err := DeleteToken(ResolveTokenID(param)); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, ErrTokenNotFound) {
+			code = http.StatusNotFound
+		}
+		c.JSON(code, gin.H{
 			"status": "error",
-			"error":  "检查token失败: " + err.Error(),
+			"error":  err.Error(),
 		})
 		return
 	}
 
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"status": "error",
-			"error":  "token不存在",
-		})
-		return
-	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
 
-	// 删除token
-	if err := config.RedisDel(tokenKey); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "删除token失败: " + err.Error(),
-		})
-		return
-	}
+// ErrTokenNotFound token不存在
+var ErrTokenNotFound = errors.New("token不存在")
 
-	// 删除token关联的使用次数（如果存在）
-	// 删除总使用次数
-	tokenUsageKey := "token_usage:" + token
-	exists, err = config.RedisExists(tokenUsageKey)
+// DeleteToken 删除token及其关联的使用次数、状态等数据
+func DeleteToken(id string) error {
+	tokenKey := "token:" + id
+
+	// 检查token是否存在
+	exists, err := config.RedisExists(tokenKey)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"status": "error",
-			"error":  "检查token使用次数失败: " + err.Error(),
-		})
-		return
+		return fmt.Errorf("检查token失败: %v", err)
 	}
-	if exists {
-		if err := config.RedisDel(tokenUsageKey); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status": "error",
-				"error":  "删除token使用次数失败: " + err.Error(),
-			})
-		}
+	if !exists {
+		return ErrTokenNotFound
 	}
 
-	// 删除CHAT模式使用次数
-	tokenChatUsageKey := "token_usage_chat:" + token
-	exists, err = config.RedisExists(tokenChatUsageKey)
-	if err == nil && exists {
-		config.RedisDel(tokenChatUsageKey)
+	// 删除token
+	if err := config.RedisDel(tokenKey); err != nil {
+		return fmt.Errorf("删除token失败: %v", err)
 	}
 
-	// 删除AGENT模式使用次数
-	tokenAgentUsageKey := "token_usage_agent:" + token
-	exists, err = config.RedisExists(tokenAgentUsageKey)
-	if err == nil && exists {
-		config.RedisDel(tokenAgentUsageKey)
+	// 删除token关联的使用次数、状态等键（如果存在）
+	for _, prefix := range tokenKeyPrefixes {
+		if err := config.RedisDel(prefix + id); err != nil {
+			return fmt.Errorf("删除token关联数据失败: %v", err)
+		}
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"status": "success",
-	})
+	return nil
 }
 
-// AddTokenHandler 批量添加token到Redis
+// AddTokenHandler 批量添加token到Redis，已存在的token跳过，无效的数据逐项返回错误原因
 func AddTokenHandler(c *gin.Context) {
-	var tokens []TokenItem
-	if err := c.ShouldBindJSON(&tokens); err != nil {
+	var records []TokenRecord
+	if err := c.ShouldBindJSON(&records); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status": "error",
 			"error":  "无效的请求数据",
@@ -315,7 +339,7 @@ func AddTokenHandler(c *gin.Context) {
 	}
 
 	// 检查是否有token数据
-	if len(tokens) == 0 {
+	if len(records) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status": "error",
 			"error":  "token列表为空",
@@ -323,261 +347,42 @@ func AddTokenHandler(c *gin.Context) {
 		return
 	}
 
-	// 批量保存token
-	successCount := 0
-	failedTokens := make([]string, 0)
-
-	for _, item := range tokens {
-		// 验证token格式
-		if item.Token == "" || item.TenantUrl == "" {
-			failedTokens = append(failedTokens, item.Token)
-			continue
-		}
-
-		// 保存到Redis
-		err := SaveTokenToRedis(item.Token, item.TenantUrl)
-		if err != nil {
-			failedTokens = append(failedTokens, item.Token)
-			continue
-		}
-		successCount++
-	}
-
-	// 返回处理结果
-	result := gin.H{
-		"status":        "success",
-		"total":         len(tokens),
-		"success_count": successCount,
-	}
-
-	if len(failedTokens) > 0 {
-		result["failed_tokens"] = failedTokens
-		result["failed_count"] = len(failedTokens)
-	}
-
-	c.JSON(http.StatusOK, result)
-}
-
-// CheckTokenTenantURL 检测token的租户地址
-func CheckTokenTenantURL(token string) (string, error) {
-	// 构建测试消息
-	testMsg := map[string]interface{}{
-		"message":              "hello，what is your name",
-		"mode":                 "CHAT",
-		"prefix":               "You are AI assistant,help me to solve problems!",
-		"suffix":               " ",
-		"lang":                 "HTML",
-		"user_guidelines":      "You are a helpful assistant, you can help me to solve problems and always answer in Chinese.",
-		"workspace_guidelines": "",
-		"feature_detection_flags": map[string]interface{}{
-			"support_raw_output": true,
-		},
-		"tool_definitions": []map[string]interface{}{},
-		"blobs": map[string]interface{}{
-			"checkpoint_id": nil,
-			"added_blobs":   []string{},
-			"deleted_blobs": []string{},
-		},
-	}
-
-	jsonData, err := json.Marshal(testMsg)
-	if err != nil {
-		return "", fmt.Errorf("序列化测试消息失败: %v", err)
-	}
-
-	tokenKey := "token:" + token
-
-	currentTenantURL, err := config.RedisHGet(tokenKey, "tenant_url")
-
-	var tenantURLResult string
-	var foundValid bool
-	var tenantURLsToTest []string
-
-	// 如果Redis中有有效的租户地址，优先测试该地址
-	if err == nil && currentTenantURL != "" {
-		tenantURLsToTest = append(tenantURLsToTest, currentTenantURL)
-	}
-
-	// 添加其他租户地址
-	for i := 20; i >= 1; i-- {
-		newTenantURL := fmt.Sprintf("https://d%d.api.augmentcode.com/", i)
-		// 避免重复测试已有的租户地址
-		if newTenantURL != currentTenantURL {
-			tenantURLsToTest = append(tenantURLsToTest, newTenantURL)
-		}
-	}
-
-	// 测试租户地址
-	for _, tenantURL := range tenantURLsToTest {
-		// 创建请求
-		req, err := http.NewRequest("POST", tenantURL+"chat-stream", bytes.NewReader(jsonData))
-		if err != nil {
-			continue
-		}
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+token)
-		req.Header.Set("User-Agent", "augment.intellij/0.160.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
-		req.Header.Set("x-api-version", "2")
-		req.Header.Set("x-request-id", uuid.New().String())
-		req.Header.Set("x-request-session-id", uuid.New().String())
-
-		client := createHTTPClient()
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Printf("请求失败: %v\n", err)
-			continue
-		}
-
-		isInvalid := false
-		func() {
-			defer resp.Body.Close()
-
-			// 检查是否返回401状态码（未授权）
-			if resp.StatusCode == http.StatusUnauthorized {
-				// 读取响应体内容
-				buf := make([]byte, 1024)
-				n, readErr := resp.Body.Read(buf)
-				responseBody := ""
-				if readErr == nil && n > 0 {
-					responseBody = string(buf[:n])
-				}
-
-				// 只有当响应中包含"Invalid token"时才标记为不可用
-				if readErr == nil && n > 0 && bytes.Contains(buf[:n], []byte("Invalid token")) {
-					// 将token标记为不可用
-					err = config.RedisHSet(tokenKey, "status", "disabled")
-					if err != nil {
-						fmt.Printf("标记token为不可用失败: %v\n", err)
-					}
-					logger.Log.WithFields(logrus.Fields{
-						"token":         token,
-						"response_body": responseBody,
-					}).Info("token: 已被标记为不可用,返回401未授权")
-					isInvalid = true
-				}
-				return
-			}
-
-			// 检查响应状态
-			if resp.StatusCode == http.StatusOK {
-				// 尝试读取一小部分响应以确认是否有效
-				buf := make([]byte, 1024)
-				n, err := resp.Body.Read(buf)
-				if err == nil && n > 0 {
-					// 更新Redis中的租户地址和状态
-					err = config.RedisHSet(tokenKey, "tenant_url", tenantURL)
-					if err != nil {
-						return
-					}
-					// 将token标记为可用
-					err = config.RedisHSet(tokenKey, "status", "active")
-					if err != nil {
-						fmt.Printf("标记token为可用失败: %v\n", err)
-					}
-					logger.Log.WithFields(logrus.Fields{
-						"token":          token,
-						"new_tenant_url": tenantURL,
-					}).Info("token: 更新租户地址成功")
-					tenantURLResult = tenantURL
-					foundValid = true
-				}
-			}
-		}()
-
-		// 如果token无效，立即返回错误，不再测试其他地址
-		if isInvalid {
-			return "", fmt.Errorf("token被标记为不可用")
-		}
-
-		// 如果找到有效的租户地址，跳出循环
-		if foundValid {
-			return tenantURLResult, nil
-		}
-	}
-
-	return "", fmt.Errorf("未找到有效的租户地址")
-}
-
-// CheckAllTokensHandler 批量检测所有token的租户地址
-func CheckAllTokensHandler(c *gin.Context) {
-	// 获取所有token的key
-	keys, err := config.RedisKeys("token:*")
+	report, err := ImportTokens(records, ImportOptions{Mode: ImportModeSkip})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"status": "error",
-			"error":  "获取token列表失败: " + err.Error(),
+			"error":  "保存token失败: " + err.Error(),
 		})
 		return
 	}
 
-	if len(keys) == 0 {
-		c.JSON(http.StatusOK, gin.H{
-			"status":   "success",
-			"total":    0,
-			"updated":  0,
-			"disabled": 0,
-		})
-		return
+	// 返回处理结果
+	result := gin.H{
+		"status":        "success",
+		"total":         report.Total,
+		"success_count": report.Created + report.Skipped,
+		"created":       report.Created,
+		"skipped":       report.Skipped,
 	}
 
-	var wg sync.WaitGroup
-	// 使用互斥锁保护计数器
-	var mu sync.Mutex
-	var updatedCount int
-	var disabledCount int
-
-	for _, key := range keys {
-		// 获取token状态，跳过已标记为不可用的token
-		status, err := config.RedisHGet(key, "status")
-		if err == nil && status == "disabled" {
-			mu.Lock()
-			mu.Unlock()
-			continue // 跳过此token
-		}
-
-		wg.Add(1)
-		go func(key string) {
-			defer wg.Done()
-
-			// 从key中提取token
-			token := key[6:] // 去掉前缀 "token:"
-
-			// 获取当前的租户地址
-			oldTenantURL, _ := config.RedisHGet(key, "tenant_url")
-
-			// 检测租户地址
-			newTenantURL, err := CheckTokenTenantURL(token)
-			logger.Log.WithFields(logrus.Fields{
-				"token":          token,
-				"old_tenant_url": oldTenantURL,
-				"new_tenant_url": newTenantURL,
-			}).Info("检测token租户地址")
-
-			mu.Lock()
-			if err != nil && err.Error() == "token被标记为不可用" {
-				disabledCount++
-			} else if err == nil && newTenantURL != oldTenantURL {
-				updatedCount++
+	if report.Invalid > 0 {
+		errs := make([]ImportRowResult, 0, report.Invalid)
+		for _, row := range report.Rows {
+			if row.Action == ImportActionInvalid {
+				errs = append(errs, row)
 			}
-			mu.Unlock()
-		}(key)
+		}
+		result["errors"] = errs
+		result["failed_count"] = report.Invalid
 	}
 
-	wg.Wait()
-
-	c.JSON(http.StatusOK, gin.H{
-		"status":   "success",
-		"total":    len(keys),
-		"updated":  updatedCount,
-		"disabled": disabledCount,
-	})
+	c.JSON(http.StatusOK, result)
 }
 
 // SetTokenRequestStatus 设置token请求状态
-func SetTokenRequestStatus(token string, status TokenRequestStatus) error {
+func SetTokenRequestStatus(tokenID string, status TokenRequestStatus) error {
 	// 使用Redis存储token请求状态
-	key := "token_status:" + token
+	key := "token_status:" + tokenID
 
 	// 将状态转换为JSON
 	statusJSON, err := json.Marshal(status)
@@ -590,8 +395,8 @@ func SetTokenRequestStatus(token string, status TokenRequestStatus) error {
 }
 
 // GetTokenRequestStatus 获取token请求状态
-func GetTokenRequestStatus(token string) (TokenRequestStatus, error) {
-	key := "token_status:" + token
+func GetTokenRequestStatus(tokenID string) (TokenRequestStatus, error) {
+	key := "token_status:" + tokenID
 
 	// 从Redis获取状态
 	statusJSON, err := config.RedisGet(key)
@@ -616,9 +421,9 @@ func GetTokenRequestStatus(token string) (TokenRequestStatus, error) {
 }
 
 // SetTokenCoolStatus 将token加入冷却队列
-func SetTokenCoolStatus(token string, duration time.Duration) error {
+func SetTokenCoolStatus(tokenID string, duration time.Duration) error {
 	// 使用Redis存储token冷却状态
-	key := "token_cool_status:" + token
+	key := "token_cool_status:" + tokenID
 
 	coolStatus := TokenCoolStatus{
 		InCool:  true,
@@ -636,8 +441,8 @@ func SetTokenCoolStatus(token string, duration time.Duration) error {
 }
 
 // GetTokenCoolStatus 获取token冷却状态
-func GetTokenCoolStatus(token string) (TokenCoolStatus, error) {
-	key := "token_cool_status:" + token
+func GetTokenCoolStatus(tokenID string) (TokenCoolStatus, error) {
+	key := "token_cool_status:" + tokenID
 
 	// 从Redis获取状态
 	coolStatusJSON, err := config.RedisGet(key)
@@ -666,32 +471,42 @@ func GetTokenCoolStatus(token string) (TokenCoolStatus, error) {
 	return coolStatus, nil
 }
 
-// GetAvailableToken 获取一个可用的token（未在使用中且冷却时间已过）
-func GetAvailableToken() (string, string) {
+// tokenCandidate 可参与分配的token
+type tokenCandidate struct {
+	id        string
+	tenantURL string
+	tags      []string
+	inCool    bool
+}
+
+// GetAvailableToken 获取一个可用的token（未在使用中且冷却时间已过），返回tokenID、租户地址和所属分组
+// groups 按顺序尝试，前面的分组没有可用token时使用后面的分组，为空时使用全部token
+// preferred 为会话上次使用的token，仍然可用且不在冷却中时优先使用
+func GetAvailableToken(groups []string, preferred string) (string, string, string) {
 	// 获取所有token的key
 	keys, err := config.RedisKeys("token:*")
 	if err != nil || len(keys) == 0 {
-		return "No token", ""
+		return "No token", "", ""
 	}
 
 	// 筛选可用的token
-	var availableTokens []string
-	var availableTenantURLs []string
-	var cooldownTokens []string
-	var cooldownTenantURLs []string
+	var candidates []tokenCandidate
+
+	// 使用次数限制和请求间隔支持热更新
+	limits := config.Current()
 
 	for _, key := range keys {
-		// 获取token状态
-		status, err := config.RedisHGet(key, "status")
-		if err == nil && status == "disabled" {
-			continue // 跳过被标记为不可用的token
+		// 获取token状态、租户地址、标签和单独配置的使用次数上限
+		values, err := config.RedisHMGet(key, "status", "tenant_url", "tags", "chat_usage_limit", "agent_usage_limit")
+		if err != nil || !isTokenSelectable(values[0]) || values[1] == "" {
+			continue // 跳过被禁用或隔离的token
 		}
 
-		// 从key中提取token
-		token := key[6:] // 去掉前缀 "token:"
+		// 从key中提取tokenID
+		tokenID := key[6:] // 去掉前缀 "token:"
 
 		// 获取token的请求状态
-		requestStatus, err := GetTokenRequestStatus(token)
+		requestStatus, err := GetTokenRequestStatus(tokenID)
 		if err != nil {
 			continue
 		}
@@ -701,70 +516,103 @@ func GetAvailableToken() (string, string) {
 			continue
 		}
 
-		// 如果距离上次请求不足3秒，跳过
-		if time.Since(requestStatus.LastRequestAt) < 3*time.Second {
+		// 如果距离上次请求不足最小间隔，跳过
+		if time.Since(requestStatus.LastRequestAt) < limits.TokenRequestInterval {
 			continue
 		}
 
 		// 检查CHAT模式和AGENT模式的使用次数限制
-		chatUsageCount := getTokenChatUsageCount(token)
-		agentUsageCount := getTokenAgentUsageCount(token)
+		chatUsageCount := getTokenChatUsageCount(tokenID)
+		agentUsageCount := getTokenAgentUsageCount(tokenID)
 
-		// 如果CHAT模式已达到3000次限制，跳过
-		if chatUsageCount >= 3000 {
+		// 如果CHAT模式已达到次数限制，跳过
+		if chatUsageCount >= tokenUsageLimit(values[3], limits.ChatUsageLimit) {
 			continue
 		}
 
-		// 如果AGENT模式已达到50次限制，跳过
-		if agentUsageCount >= 50 {
+		// 如果AGENT模式已达到次数限制，跳过
+		if agentUsageCount >= tokenUsageLimit(values[4], limits.AgentUsageLimit) {
 			continue
 		}
 
-		// 获取对应的tenant_url
-		tenantURL, err := config.RedisHGet(key, "tenant_url")
+		// 检查token是否在冷却中
+		coolStatus, err := GetTokenCoolStatus(tokenID)
 		if err != nil {
 			continue
 		}
 
-		// 检查token是否在冷却中
-		coolStatus, err := GetTokenCoolStatus(token)
-		if err != nil {
-			continue
+		candidates = append(candidates, tokenCandidate{
+			id:        tokenID,
+			tenantURL: values[1],
+			tags:      parseTags(values[2]),
+			inCool:    coolStatus.InCool,
+		})
+	}
+
+	if len(groups) == 0 {
+		groups = []string{config.TokenGroupAll}
+	}
+	if preferred != "" {
+		for _, candidate := range candidates {
+			if candidate.id != preferred || candidate.inCool {
+				continue
+			}
+			for _, group := range groups {
+				if hasTag(candidate.tags, group) {
+					return candidate.id, candidate.tenantURL, group
+				}
+			}
 		}
+	}
+	for _, group := range groups {
+		if candidate, ok := pickTokenCandidate(candidates, group); ok {
+			return candidate.id, candidate.tenantURL, group
+		}
+	}
+
+	// 如果没有任何可用的token
+	return "No available token", "", ""
+}
 
-		// 如果token在冷却中，放入冷却队列
-		if coolStatus.InCool {
-			cooldownTokens = append(cooldownTokens, token)
-			cooldownTenantURLs = append(cooldownTenantURLs, tenantURL)
+// pickTokenCandidate 从分组中随机选择一个token，优先选择不在冷却中的token
+func pickTokenCandidate(candidates []tokenCandidate, group string) (tokenCandidate, bool) {
+	var available, cooldown []tokenCandidate
+	for _, candidate := range candidates {
+		if !hasTag(candidate.tags, group) {
+			continue
+		}
+		if candidate.inCool {
+			cooldown = append(cooldown, candidate)
 		} else {
-			// 否则放入可用队列
-			availableTokens = append(availableTokens, token)
-			availableTenantURLs = append(availableTenantURLs, tenantURL)
+			available = append(available, candidate)
 		}
 	}
 
 	// 优先从可用队列中选择token
-	if len(availableTokens) > 0 {
-		// 随机选择一个token
-		randomIndex := rand.Intn(len(availableTokens))
-		return availableTokens[randomIndex], availableTenantURLs[randomIndex]
+	if len(available) > 0 {
+		return available[rand.Intn(len(available))], true
 	}
 
 	// 如果没有非冷却token可用，则从冷却队列中选择
-	if len(cooldownTokens) > 0 {
-		// 随机选择一个token
-		randomIndex := rand.Intn(len(cooldownTokens))
-		return cooldownTokens[randomIndex], cooldownTenantURLs[randomIndex]
+	if len(cooldown) > 0 {
+		return cooldown[rand.Intn(len(cooldown))], true
 	}
+	return tokenCandidate{}, false
+}
 
-	// 如果没有任何可用的token
-	return "No available token", ""
+// tokenUsageLimit 解析token单独配置的使用次数上限，未配置时返回默认值
+func tokenUsageLimit(value string, defaultLimit int) int {
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return defaultLimit
+	}
+	return limit
 }
 
 // getTokenUsageCount 获取token的使用次数
-func getTokenUsageCount(token string) int {
+func getTokenUsageCount(tokenID string) int {
 	// 使用Redis中的计数器获取使用次数
-	countKey := "token_usage:" + token
+	countKey := "token_usage:" + tokenID
 	count, err := config.RedisGet(countKey)
 	if err != nil {
 		return 0 // 如果出错或不存在，返回0
@@ -780,9 +628,9 @@ func getTokenUsageCount(token string) int {
 }
 
 // getTokenChatUsageCount 获取token的CHAT模式使用次数
-func getTokenChatUsageCount(token string) int {
+func getTokenChatUsageCount(tokenID string) int {
 	// 使用Redis中的计数器获取使用次数
-	countKey := "token_usage_chat:" + token
+	countKey := "token_usage_chat:" + tokenID
 	count, err := config.RedisGet(countKey)
 	if err != nil {
 		return 0 // 如果出错或不存在，返回0
@@ -798,9 +646,9 @@ func getTokenChatUsageCount(token string) int {
 }
 
 // getTokenAgentUsageCount 获取token的AGENT模式使用次数
-func getTokenAgentUsageCount(token string) int {
+func getTokenAgentUsageCount(tokenID string) int {
 	// 使用Redis中的计数器获取使用次数
-	countKey := "token_usage_agent:" + token
+	countKey := "token_usage_agent:" + tokenID
 	count, err := config.RedisGet(countKey)
 	if err != nil {
 		return 0 // 如果出错或不存在，返回0
@@ -815,7 +663,7 @@ func getTokenAgentUsageCount(token string) int {
 	return countInt
 }
 
-// UpdateTokenRemark 更新token的备注信息
+// UpdateTokenRemark 更新token的备注和标签，未提供的字段保持不变
 func UpdateTokenRemark(c *gin.Context) {
 	token := c.Param("token")
 	if token == "" {
@@ -827,7 +675,8 @@ func UpdateTokenRemark(c *gin.Context) {
 	}
 
 	var req struct {
-		Remark string `json:"remark"`
+		Remark *string   `json:"remark"`
+		Tags   *[]string `json:"tags"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -837,7 +686,32 @@ func UpdateTokenRemark(c *gin.Context) {
 		return
 	}
 
-	tokenKey := "token:" + token
+	fields := make(map[string]string)
+	if req.Remark != nil {
+		fields["remark"] = *req.Remark
+	}
+	if req.Tags != nil {
+		tags := parseTags(strings.Join(*req.Tags, ","))
+		for _, tag := range tags {
+			if !validTag.MatchString(tag) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status": "error",
+					"error":  fmt.Sprintf("标签 %q 无效，只允许字母、数字和 ._:-，最长32位", tag),
+				})
+				return
+			}
+		}
+		fields["tags"] = strings.Join(tags, ",")
+	}
+	if len(fields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定备注或标签",
+		})
+		return
+	}
+
+	tokenKey := "token:" + ResolveTokenID(token)
 
 	// 检查token是否存在
 	exists, err := config.RedisExists(tokenKey)
@@ -857,8 +731,8 @@ func UpdateTokenRemark(c *gin.Context) {
 		return
 	}
 
-	// 更新备注
-	err = config.RedisHSet(tokenKey, "remark", req.Remark)
+	// 更新备注和标签
+	err = config.RedisHSetMap(tokenKey, fields)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"status": "error",
@@ -871,34 +745,3 @@ func UpdateTokenRemark(c *gin.Context) {
 		"status": "success",
 	})
 }
-
-// MigrateTokensRemark 确保所有token都有remark字段
-func MigrateTokensRemark() error {
-	// 获取所有token的key
-	keys, err := config.RedisKeys("token:*")
-	if err != nil {
-		return fmt.Errorf("获取token列表失败: %v", err)
-	}
-
-	for _, key := range keys {
-		// 检查是否已有remark字段
-		exists, err := config.RedisHExists(key, "remark")
-		if err != nil {
-			logger.Log.Error("check remark field of token %s failed: %v", key, err)
-			continue
-		}
-
-		// 如果没有remark字段，添加一个空的remark
-		if !exists {
-			err = config.RedisHSet(key, "remark", "")
-			if err != nil {
-				logger.Log.Error("add remark field to token %s failed: %v", key, err)
-				continue
-			}
-			logger.Log.Info("add remark field to token %s success", key)
-		}
-	}
-	logger.Log.Info("migrate remark field to all tokens success!")
-
-	return nil
-}
@@ -0,0 +1,289 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// 健康检查结果
+const (
+	HealthCheckOK      = "ok"      // token可用
+	HealthCheckInvalid = "invalid" // token已失效，被标记为不可用
+	HealthCheckTenant  = "tenant"  // 租户地址失效，已重新检测
+	HealthCheckDown    = "down"    // 租户地址无法连接或返回5xx，未改变token状态
+	HealthCheckError   = "error"   // 其他上游错误，未改变token状态
+)
+
+// TokenHealth 记录token最近一次健康检查结果
+type TokenHealth struct {
+	LastCheckAt time.Time `json:"last_check_at,omitempty"`
+	LatencyMs   int64     `json:"last_check_latency_ms"`
+	Result      string    `json:"last_check_result"`
+	Message     string    `json:"last_check_message,omitempty"`
+}
+
+// tenantLimiter 限制对同一租户地址的探测频率
+type tenantLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+func newTenantLimiter(interval time.Duration) *tenantLimiter {
+	return &tenantLimiter{
+		interval: interval,
+		next:     make(map[string]time.Time),
+	}
+}
+
+// Wait 阻塞直到允许对该租户地址发起下一次探测
+func (l *tenantLimiter) Wait(tenantURL string) {
+	if l.interval <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[tenantURL]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[tenantURL] = at.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(at))
+}
+
+// probeToken 使用轻量的get-models接口探测token是否可用
+func probeToken(ctx context.Context, token, tenantURL string) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tenantURL+"get-models", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return HealthCheckError, 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", "augment.intellij/0.184.0 (Mac OS X; aarch64; 15.2) WebStorm/2024.3.5")
+	req.Header.Set("x-api-version", "2")
+	req.Header.Set("x-request-id", uuid.New().String())
+	req.Header.Set("x-request-session-id", uuid.New().String())
+
+	client := createHTTPClient()
+	client.Timeout = 15 * time.Second
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		return HealthCheckDown, latency, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return HealthCheckOK, latency, nil
+	case resp.StatusCode == http.StatusUnauthorized && bytes.Contains(body, []byte("Invalid token")):
+		return HealthCheckInvalid, latency, fmt.Errorf("token无效: %s", string(body))
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden ||
+		resp.StatusCode == http.StatusNotFound:
+		// 租户地址与token不匹配
+		return HealthCheckTenant, latency, fmt.Errorf("租户地址不匹配: %d", resp.StatusCode)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		// 上游临时故障，不改变token状态
+		return HealthCheckDown, latency, fmt.Errorf("租户地址不可用: %d", resp.StatusCode)
+	default:
+		return HealthCheckError, latency, fmt.Errorf("上游返回状态码: %d", resp.StatusCode)
+	}
+}
+
+// saveTokenHealth 将健康检查结果写入token哈希表
+func saveTokenHealth(tokenID string, health TokenHealth) {
+	tokenKey := "token:" + tokenID
+	fields := map[string]string{
+		"last_check_at":         health.LastCheckAt.Format(time.RFC3339),
+		"last_check_latency_ms": strconv.FormatInt(health.LatencyMs, 10),
+		"last_check_result":     health.Result,
+		"last_check_message":    health.Message,
+	}
+	// 检查期间token可能已被删除，不再写入结果
+	exists, err := config.RedisExists(tokenKey)
+	if err == nil && !exists {
+		return
+	}
+	if err == nil {
+		err = config.RedisHSetMap(tokenKey, fields)
+	}
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"token_id": tokenID,
+			"error":    err.Error(),
+		}).Error("保存token健康检查结果失败")
+	}
+}
+
+// parseTokenHealth 从token哈希表字段中解析健康检查结果
+func parseTokenHealth(fields map[string]string) TokenHealth {
+	var health TokenHealth
+	health.LastCheckAt, _ = time.Parse(time.RFC3339, fields["last_check_at"])
+	health.LatencyMs, _ = strconv.ParseInt(fields["last_check_latency_ms"], 10, 64)
+	health.Result = fields["last_check_result"]
+	health.Message = fields["last_check_message"]
+	return health
+}
+
+// CheckTokenHealth 检查单个token，必要时重新检测租户地址或禁用token
+func CheckTokenHealth(tokenID string, limiter *tenantLimiter) TokenHealth {
+	tenantURL, _ := config.RedisHGet("token:"+tokenID, "tenant_url")
+
+	token, err := GetTokenSecret(tokenID)
+	if err != nil {
+		health := TokenHealth{LastCheckAt: time.Now(), Result: HealthCheckError, Message: err.Error()}
+		saveTokenHealth(tokenID, health)
+		return health
+	}
+
+	if limiter != nil {
+		limiter.Wait(tenantURL)
+	}
+
+	result, latency, err := probeToken(context.Background(), token, tenantURL)
+	health := TokenHealth{
+		LastCheckAt: time.Now(),
+		LatencyMs:   latency.Milliseconds(),
+		Result:      result,
+	}
+	if err != nil {
+		health.Message = err.Error()
+	}
+
+	switch result {
+	case HealthCheckInvalid:
+		if err := SetTokenStatus(tokenID, TokenStatusDisabled, "上游返回401 Invalid token", OperatorHealthCheck); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token_id": tokenID,
+				"error":    err.Error(),
+			}).Error("标记token为不可用失败")
+		}
+	case HealthCheckTenant:
+		// 当前租户地址不可用，重新检测
+		newTenantURL, err := CheckTokenTenantURL(tokenID)
+		if err != nil {
+			health.Message = err.Error()
+			if errors.Is(err, ErrTokenDisabled) {
+				health.Result = HealthCheckInvalid
+			}
+		} else {
+			health.Message = "租户地址更新为 " + newTenantURL
+		}
+	}
+
+	saveTokenHealth(tokenID, health)
+
+	logger.Log.WithFields(logrus.Fields{
+		"token_id":   tokenID,
+		"result":     health.Result,
+		"latency_ms": health.LatencyMs,
+		"message":    health.Message,
+	}).Info("token健康检查完成")
+
+	return health
+}
+
+// RunTokenHealthCheck 执行一轮所有token的健康检查
+func RunTokenHealthCheck() {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("获取token列表失败")
+		return
+	}
+
+	// 打乱检查顺序，避免每轮都以相同顺序请求上游
+	rand.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+
+	concurrency := config.AppConfig.HealthCheckConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	limiter := newTenantLimiter(config.AppConfig.HealthCheckTenantInterval)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for _, key := range keys {
+		status, _ := config.RedisHGet(key, "status")
+		if !isTokenSelectable(status) {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tokenID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Log.WithFields(logrus.Fields{
+						"error":    r,
+						"token_id": tokenID,
+					}).Error("token健康检查时发生panic")
+				}
+			}()
+
+			CheckTokenHealth(tokenID, limiter)
+		}(key[6:]) // 去掉前缀 "token:"
+	}
+
+	wg.Wait()
+}
+
+// StartTokenHealthCheckScheduler 启动后台token健康检查调度器
+func StartTokenHealthCheckScheduler() {
+	interval := config.AppConfig.HealthCheckInterval
+	if interval <= 0 {
+		logger.Log.Info("未启用后台token健康检查")
+		return
+	}
+
+	// 上一轮未结束时跳过本轮
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+
+	_, err := c.AddFunc("@every "+interval.String(), func() {
+		// 随机延迟，避免多个实例同时检查
+		time.Sleep(time.Duration(rand.Int63n(int64(interval/10) + 1)))
+
+		logger.Log.Info("开始执行token健康检查任务")
+		RunTokenHealthCheck()
+		logger.Log.Info("token健康检查任务执行完成")
+	})
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("添加token健康检查定时任务失败")
+		return
+	}
+
+	c.Start()
+	registerScheduler(c)
+	logger.Log.WithFields(logrus.Fields{
+		"interval": interval.String(),
+	}).Info("token健康检查调度器启动成功!")
+}
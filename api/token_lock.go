@@ -0,0 +1,55 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// 全局锁映射，用于控制每个 token 的并发请求
+var (
+	tokenLocks      = make(map[string]*sync.Mutex)
+	tokenLocksGuard = sync.Mutex{}
+)
+
+// getTokenLock 获取指定 token 的锁
+func getTokenLock(tokenID string) *sync.Mutex {
+	tokenLocksGuard.Lock()
+	defer tokenLocksGuard.Unlock()
+
+	if lock, exists := tokenLocks[tokenID]; exists {
+		return lock
+	}
+
+	lock := &sync.Mutex{}
+	tokenLocks[tokenID] = lock
+	return lock
+}
+
+// AcquireToken 占用token：获取该token的锁，标记为使用中并记录租约
+// 会阻塞直到其他请求释放该token，使用完毕后必须调用ReleaseToken
+func AcquireToken(tokenID string) (*sync.Mutex, error) {
+	lock := getTokenLock(tokenID)
+	lock.Lock()
+
+	err := SetTokenRequestStatus(tokenID, TokenRequestStatus{
+		InProgress:    true,
+		LastRequestAt: time.Now(),
+	})
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	AcquireTokenLease(tokenID)
+	return lock, nil
+}
+
+// ReleaseToken 释放AcquireToken占用的token，无论更新请求状态是否成功都会释放锁
+func ReleaseToken(tokenID string, lock *sync.Mutex) error {
+	defer lock.Unlock()
+	releaseTokenLease(tokenID)
+
+	return SetTokenRequestStatus(tokenID, TokenRequestStatus{
+		InProgress:    false,
+		LastRequestAt: time.Now(),
+	})
+}
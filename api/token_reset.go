@@ -17,44 +17,44 @@ func ResetTokenUsage() error {
 	}
 
 	for _, key := range keys {
-		// 从key中提取token
-		token := key[6:] // 去掉前缀 "token:"
+		// 从key中提取tokenID
+		tokenID := key[6:] // 去掉前缀 "token:"
 
 		// 重置总使用次数
-		totalUsageKey := "token_usage:" + token
+		totalUsageKey := "token_usage:" + tokenID
 		err = config.RedisSet(totalUsageKey, "0", 0) // 0表示永不过期
 		if err != nil {
 			logger.Log.WithFields(logrus.Fields{
-				"token": token,
-				"error": err,
+				"token_id": tokenID,
+				"error":    err,
 			}).Error("重置Token总使用次数失败")
 			continue
 		}
 
 		// 重置CHAT模式使用次数
-		chatUsageKey := "token_usage_chat:" + token
+		chatUsageKey := "token_usage_chat:" + tokenID
 		err = config.RedisSet(chatUsageKey, "0", 0) // 0表示永不过期
 		if err != nil {
 			logger.Log.WithFields(logrus.Fields{
-				"token": token,
-				"error": err,
+				"token_id": tokenID,
+				"error":    err,
 			}).Error("重置Token CHAT模式使用次数失败")
 			continue
 		}
 
 		// 重置AGENT模式使用次数
-		agentUsageKey := "token_usage_agent:" + token
+		agentUsageKey := "token_usage_agent:" + tokenID
 		err = config.RedisSet(agentUsageKey, "0", 0) // 0表示永不过期
 		if err != nil {
 			logger.Log.WithFields(logrus.Fields{
-				"token": token,
-				"error": err,
+				"token_id": tokenID,
+				"error":    err,
 			}).Error("重置Token AGENT模式使用次数失败")
 			continue
 		}
 
 		logger.Log.WithFields(logrus.Fields{
-			"token": token,
+			"token_id": tokenID,
 		}).Info("重置token使用次数成功")
 	}
 
@@ -89,8 +89,6 @@ func StartTokenUsageResetScheduler() {
 
 	// 启动cron调度器
 	c.Start()
+	registerScheduler(c)
 	logger.Log.Info("Token使用次数重置调度器启动成功!")
-
-	// 保持程序运行
-	select {}
 }
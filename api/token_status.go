@@ -0,0 +1,250 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// token状态
+const (
+	TokenStatusActive      = "active"      // 可用
+	TokenStatusDisabled    = "disabled"    // 已失效或被手动禁用
+	TokenStatusQuarantined = "quarantined" // 隔离观察，不参与请求分配
+)
+
+// 系统自动修改状态时记录的操作者
+const (
+	OperatorTenantCheck = "system:tenant-check"
+	OperatorHealthCheck = "system:health-check"
+)
+
+// 每个token保留的状态变更记录数量
+const tokenStatusHistoryLimit = 20
+
+// TokenStatusChange token状态变更记录
+type TokenStatusChange struct {
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason"`
+	Operator  string    `json:"operator"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// isValidTokenStatus 检查状态值是否合法
+func isValidTokenStatus(status string) bool {
+	switch status {
+	case TokenStatusActive, TokenStatusDisabled, TokenStatusQuarantined:
+		return true
+	}
+	return false
+}
+
+// isTokenSelectable 判断该状态的token是否可以参与请求分配和后台检查
+// 旧数据可能没有status字段，视为可用
+func isTokenSelectable(status string) bool {
+	return status == "" || status == TokenStatusActive
+}
+
+// SetTokenStatus 修改token状态并记录原因、操作者和时间
+func SetTokenStatus(tokenID, status, reason, operator string) error {
+	tokenKey := "token:" + tokenID
+	change := TokenStatusChange{
+		Status:    status,
+		Reason:    reason,
+		Operator:  operator,
+		ChangedAt: time.Now(),
+	}
+
+	fields := map[string]string{
+		"status":            status,
+		"status_reason":     reason,
+		"status_updated_by": operator,
+		"status_updated_at": change.ChangedAt.Format(time.RFC3339),
+	}
+	// token可能已被删除，避免写入后留下只有状态字段的孤立哈希表
+	exists, err := config.RedisExists(tokenKey)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrTokenNotFound
+	}
+	if err := config.RedisHSetMap(tokenKey, fields); err != nil {
+		return err
+	}
+
+	// 记录状态变更历史
+	changeJSON, err := json.Marshal(change)
+	if err == nil {
+		err = config.RedisLPushTrim("token_status_history:"+tokenID, string(changeJSON), tokenStatusHistoryLimit)
+	}
+	if err != nil {
+		logger.Log.WithFields(logrus.Fields{
+			"token_id": tokenID,
+			"error":    err.Error(),
+		}).Error("记录token状态变更历史失败")
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"token_id": tokenID,
+		"status":   status,
+		"reason":   reason,
+		"operator": operator,
+	}).Info("token状态已变更")
+
+	return nil
+}
+
+// getTokenStatusHistory 获取token的状态变更历史，最新的在前
+func getTokenStatusHistory(tokenID string) []TokenStatusChange {
+	items, err := config.RedisLRange("token_status_history:"+tokenID, 0, -1)
+	history := make([]TokenStatusChange, 0, len(items))
+	if err != nil {
+		return history
+	}
+	for _, item := range items {
+		var change TokenStatusChange
+		if json.Unmarshal([]byte(item), &change) == nil {
+			history = append(history, change)
+		}
+	}
+	return history
+}
+
+// disabledBySystemCheck 根据状态变更历史判断token最近一次是否由租户检测或健康检查禁用
+// 没有历史记录时无法确定禁用者，视为手动禁用
+func disabledBySystemCheck(tokenID string) bool {
+	history := getTokenStatusHistory(tokenID)
+	if len(history) == 0 || history[0].Status != TokenStatusDisabled {
+		return false
+	}
+	switch history[0].Operator {
+	case OperatorTenantCheck, OperatorHealthCheck:
+		return true
+	}
+	return false
+}
+
+// adminOperator 返回当前管理员操作者标识
+func adminOperator(c *gin.Context) string {
+	return "admin@" + c.ClientIP()
+}
+
+// UpdateTokenStatusHandler 手动启用、禁用或隔离token
+func UpdateTokenStatusHandler(c *gin.Context) {
+	param := c.Param("token")
+	if param == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "未指定token",
+		})
+		return
+	}
+	tokenID := ResolveTokenID(param)
+
+	var req struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !isValidTokenStatus(req.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "无效的请求数据，status 必须为 active、disabled 或 quarantined",
+		})
+		return
+	}
+
+	tokenKey := "token:" + tokenID
+
+	// 检查token是否存在
+	exists, err := config.RedisExists(tokenKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "检查token失败: " + err.Error(),
+		})
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token不存在",
+		})
+		return
+	}
+
+	if err := SetTokenStatus(tokenID, req.Status, req.Reason, adminOperator(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "更新token状态失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// GetTokenStatusHistoryHandler 获取token的状态变更历史
+func GetTokenStatusHistoryHandler(c *gin.Context) {
+	tokenID := ResolveTokenID(c.Param("token"))
+
+	fields, err := config.RedisHGetAll("token:" + tokenID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "获取token失败: " + err.Error(),
+		})
+		return
+	}
+
+	if len(fields) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token不存在",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "success",
+		"token_status": fields["status"],
+		"history":      getTokenStatusHistory(tokenID),
+	})
+}
+
+// CheckTokenHandler 重新检测单个token的租户地址和可用性
+func CheckTokenHandler(c *gin.Context) {
+	tokenID := ResolveTokenID(c.Param("token"))
+
+	exists, err := config.RedisExists("token:" + tokenID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "检查token失败: " + err.Error(),
+		})
+		return
+	}
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  "token不存在",
+		})
+		return
+	}
+
+	result := CheckToken(c.Request.Context(), tokenID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"result": result,
+	})
+}
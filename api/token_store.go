@@ -0,0 +1,257 @@
+package api
+
+import (
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"augment2api/pkg/secret"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// token在Redis中的键均使用不透明的tokenID，原始token加密后存储在 token:<id> 的 secret 字段中
+// tokenID 由原始token以加密密钥派生的HMAC计算，无法通过ID离线验证猜测的token
+// 轮换密钥后执行 reencrypt-tokens 会同时将ID更新为新密钥下的ID，更新前仍可通过旧密钥下的ID找到token
+
+// 与token关联的键前缀，迁移和删除token时需要一并处理
+var tokenKeyPrefixes = []string{
+	"token_usage:",
+	"token_usage_chat:",
+	"token_usage_agent:",
+	"token_status:",
+	"token_cool_status:",
+	"token_status_history:",
+	tenantMappingPrefix,
+}
+
+// TokenID 计算token在当前密钥下的不透明ID
+func TokenID(token string) string {
+	return secret.ID(token)
+}
+
+// LookupTokenID 返回已保存的token的ID，兼容旧密钥下的ID；token不存在时返回当前密钥下的ID
+func LookupTokenID(token string) string {
+	id := TokenID(token)
+	if exists, err := config.RedisExists("token:" + id); err == nil && exists {
+		return id
+	}
+	for _, legacy := range secret.LegacyIDs(token) {
+		if exists, err := config.RedisExists("token:" + legacy); err == nil && exists {
+			return legacy
+		}
+	}
+	return id
+}
+
+// MaskToken 返回脱敏后的token，仅保留首尾少量字符
+func MaskToken(token string) string {
+	if len(token) <= 12 {
+		return "****"
+	}
+	return token[:6] + "..." + token[len(token)-4:]
+}
+
+// ResolveTokenID 将接口参数解析为tokenID，兼容直接传入原始token
+func ResolveTokenID(param string) string {
+	if exists, err := config.RedisExists("token:" + param); err == nil && exists {
+		return param
+	}
+	return LookupTokenID(param)
+}
+
+// GetTokenSecret 读取并解密tokenID对应的原始token
+func GetTokenSecret(id string) (string, error) {
+	value, err := config.RedisHGet("token:"+id, "secret")
+	if err != nil {
+		return "", fmt.Errorf("读取token失败: %v", err)
+	}
+	token, err := secret.Decrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// tokenSecretFields 生成保存原始token所需的哈希字段
+func tokenSecretFields(token string) (map[string]string, error) {
+	encrypted, err := secret.Encrypt(token)
+	if err != nil {
+		return nil, fmt.Errorf("加密token失败: %v", err)
+	}
+	return map[string]string{
+		"secret":       encrypted,
+		"token_masked": MaskToken(token),
+	}, nil
+}
+
+// migrateTokenKeyLayout 将以原始token命名的旧键迁移为以tokenID命名的新键，并加密存储token
+func migrateTokenKeyLayout(run *MigrationRun) error {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return fmt.Errorf("获取token列表失败: %v", err)
+	}
+
+	for _, key := range keys {
+		// 已迁移的token包含secret字段
+		exists, err := config.RedisHExists(key, "secret")
+		if err != nil || exists {
+			continue
+		}
+
+		token := key[6:] // 去掉前缀 "token:"
+		id := TokenID(token)
+		if !run.Change(logrus.Fields{"token_fingerprint": logger.Fingerprint(token), "token_id": id}, "迁移为tokenID键并加密存储") {
+			continue
+		}
+
+		fields, err := config.RedisHGetAll(key)
+		if err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token_fingerprint": logger.Fingerprint(token),
+				"error":             err.Error(),
+			}).Error("读取待迁移token失败")
+			continue
+		}
+		secretFields, err := tokenSecretFields(token)
+		if err != nil {
+			return err
+		}
+		for field, value := range secretFields {
+			fields[field] = value
+		}
+
+		if err := config.RedisHSetMap("token:"+id, fields); err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token_fingerprint": logger.Fingerprint(token),
+				"error":             err.Error(),
+			}).Error("写入迁移后的token失败")
+			continue
+		}
+
+		// 迁移关联的计数、状态等键
+		for _, prefix := range tokenKeyPrefixes {
+			if exists, err := config.RedisExists(prefix + token); err == nil && exists {
+				if err := config.RedisRename(prefix+token, prefix+id); err != nil {
+					logger.Log.WithFields(logrus.Fields{
+						"key":   prefix + id,
+						"error": err.Error(),
+					}).Error("迁移token关联键失败")
+				}
+			}
+		}
+
+		if err := config.RedisDel(key); err != nil {
+			return fmt.Errorf("删除旧token键失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReencryptTokens 使用当前密钥重新加密所有token，并将ID更新为当前密钥下的ID，用于密钥轮换
+func ReencryptTokens() (int, error) {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return 0, fmt.Errorf("获取token列表失败: %v", err)
+	}
+
+	count := 0
+	for _, key := range keys {
+		id := key[len("token:"):]
+		value, err := config.RedisHGet(key, "secret")
+		if err != nil {
+			continue
+		}
+		token, err := secret.Decrypt(value)
+		if err != nil {
+			return count, fmt.Errorf("解密token %s 失败: %v", id, err)
+		}
+		newID := TokenID(token)
+		if !secret.NeedsReencrypt(value) && newID == id {
+			continue
+		}
+
+		fields, err := tokenSecretFields(token)
+		if err != nil {
+			return count, err
+		}
+		if err := config.RedisHSetMap(key, fields); err != nil {
+			return count, fmt.Errorf("保存token %s 失败: %v", id, err)
+		}
+		if newID != id {
+			if err := renameTokenID(id, newID); err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// migrateTokenKeyedID 将旧版本未使用密钥计算的tokenID更新为HMAC计算的ID，并加密明文存储的token
+func migrateTokenKeyedID(run *MigrationRun) error {
+	keys, err := config.RedisKeys("token:*")
+	if err != nil {
+		return fmt.Errorf("获取token列表失败: %v", err)
+	}
+
+	for _, key := range keys {
+		id := key[len("token:"):]
+		value, err := config.RedisHGet(key, "secret")
+		if err != nil {
+			continue
+		}
+		token, err := secret.Decrypt(value)
+		if err != nil {
+			logger.Log.WithFields(logrus.Fields{
+				"token_id": id,
+				"error":    err.Error(),
+			}).Error("解密待迁移token失败")
+			continue
+		}
+		newID := TokenID(token)
+		if !secret.NeedsReencrypt(value) && newID == id {
+			continue
+		}
+		if !run.Change(logrus.Fields{"token_id": id, "new_token_id": newID}, "更新tokenID并使用当前密钥加密") {
+			continue
+		}
+
+		fields, err := tokenSecretFields(token)
+		if err != nil {
+			return err
+		}
+		if err := config.RedisHSetMap(key, fields); err != nil {
+			return fmt.Errorf("保存token %s 失败: %v", id, err)
+		}
+		if newID != id {
+			if err := renameTokenID(id, newID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renameTokenID 将token及其关联的计数、状态等键改为新的ID
+func renameTokenID(oldID, newID string) error {
+	if exists, err := config.RedisExists("token:" + newID); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("token %s 已存在，无法将 %s 改为该ID", newID, oldID)
+	}
+	if err := config.RedisRename("token:"+oldID, "token:"+newID); err != nil {
+		return fmt.Errorf("更新tokenID %s 失败: %v", oldID, err)
+	}
+	for _, prefix := range tokenKeyPrefixes {
+		if exists, err := config.RedisExists(prefix + oldID); err == nil && exists {
+			if err := config.RedisRename(prefix+oldID, prefix+newID); err != nil {
+				logger.Log.WithFields(logrus.Fields{
+					"key":   prefix + newID,
+					"error": err.Error(),
+				}).Error("更新token关联键失败")
+			}
+		}
+	}
+	return nil
+}
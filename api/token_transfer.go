@@ -0,0 +1,702 @@
+package api
+
+import (
+	"augment2api/config"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 导入接口请求体的最大长度，约可容纳数万个token
+const maxImportBodyBytes = 10 << 20
+
+// 导入时已存在token的处理方式
+const (
+	ImportModeSkip      = "skip"      // 跳过已存在的token
+	ImportModeOverwrite = "overwrite" // 使用导入数据覆盖全部字段，未提供的字段清空
+	ImportModeMerge     = "merge"     // 只更新导入数据中非空的字段
+)
+
+// 导入导出格式
+const (
+	TransferFormatJSON = "json"
+	TransferFormatCSV  = "csv"
+)
+
+// 导入结果
+const (
+	ImportActionCreated = "created"
+	ImportActionUpdated = "updated"
+	ImportActionSkipped = "skipped"
+	ImportActionInvalid = "invalid"
+)
+
+// TokenRecord 导入导出的完整token数据
+type TokenRecord struct {
+	Token           string     `json:"token"`
+	TenantURL       string     `json:"tenant_url"`
+	Status          string     `json:"status,omitempty"`
+	StatusReason    string     `json:"status_reason,omitempty"`
+	Remark          string     `json:"remark,omitempty"`
+	ChatUsageLimit  int        `json:"chat_usage_limit,omitempty"`  // 为0时使用全局配置
+	AgentUsageLimit int        `json:"agent_usage_limit,omitempty"` // 为0时使用全局配置
+	ChatUsage       int        `json:"chat_usage,omitempty"`
+	AgentUsage      int        `json:"agent_usage,omitempty"`
+	CoolEnd         *time.Time `json:"cool_end,omitempty"`
+	Tags            []string   `json:"tags,omitempty"`
+
+	// 兼容 /api/add/tokens 的旧格式
+	LegacyTenantURL string `json:"tenantUrl,omitempty"`
+
+	// 导入时的行号，JSON为数组下标+1，CSV为文件行号
+	row int
+}
+
+// tokenCSVHeader CSV的列，导入时按表头匹配，列顺序不限
+var tokenCSVHeader = []string{
+	"token", "tenant_url", "status", "status_reason", "remark",
+	"chat_usage_limit", "agent_usage_limit", "chat_usage", "agent_usage", "cool_end", "tags",
+}
+
+// ImportRowResult 单行导入结果
+type ImportRowResult struct {
+	Row     int      `json:"row"`
+	TokenID string   `json:"token_id,omitempty"`
+	Token   string   `json:"token,omitempty"` // 脱敏后的token
+	Action  string   `json:"action"`
+	Changes []string `json:"changes,omitempty"` // 更新的字段
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// ImportReport 导入报告
+type ImportReport struct {
+	Mode    string            `json:"mode"`
+	DryRun  bool              `json:"dry_run"`
+	Total   int               `json:"total"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Skipped int               `json:"skipped"`
+	Invalid int               `json:"invalid"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+// ImportOptions 导入选项
+type ImportOptions struct {
+	Mode     string
+	DryRun   bool
+	Operator string // 状态变更记录中的操作者
+}
+
+// validTag 标签只允许字母、数字和 ._:-
+var validTag = regexp.MustCompile(`^[A-Za-z0-9._:\-]{1,32}$`)
+
+// parseTags 解析逗号分隔的标签并去重
+func parseTags(value string) []string {
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// ExportTokens 导出所有token的完整数据，包含token原文
+func ExportTokens() ([]TokenRecord, error) {
+	tokens, err := ListTokens("all")
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]TokenRecord, 0, len(tokens))
+	for _, t := range tokens {
+		token, err := GetTokenSecret(t.ID)
+		if err != nil {
+			return nil, fmt.Errorf("读取token %s 失败: %v", t.ID, err)
+		}
+		record := TokenRecord{
+			Token:           token,
+			TenantURL:       t.TenantURL,
+			Status:          t.Status,
+			StatusReason:    t.StatusReason,
+			Remark:          t.Remark,
+			ChatUsageLimit:  t.ChatUsageLimit,
+			AgentUsageLimit: t.AgentUsageLimit,
+			ChatUsage:       t.ChatUsageCount,
+			AgentUsage:      t.AgentUsageCount,
+			Tags:            t.Tags,
+		}
+		if t.InCool {
+			coolEnd := t.CoolEnd
+			record.CoolEnd = &coolEnd
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// WriteTokenRecords 按指定格式写出token数据
+func WriteTokenRecords(w io.Writer, format string, records []TokenRecord) error {
+	if format == TransferFormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(tokenCSVHeader); err != nil {
+		return err
+	}
+	for _, r := range records {
+		coolEnd := ""
+		if r.CoolEnd != nil {
+			coolEnd = r.CoolEnd.Format(time.RFC3339)
+		}
+		row := []string{
+			r.Token, r.TenantURL, r.Status, r.StatusReason, r.Remark,
+			formatCount(r.ChatUsageLimit), formatCount(r.AgentUsageLimit),
+			formatCount(r.ChatUsage), formatCount(r.AgentUsage),
+			coolEnd, strings.Join(r.Tags, ","),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// formatCount 将0输出为空，便于区分未设置
+func formatCount(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// ReadTokenRecords 解析JSON或CSV格式的token数据，无法解析的行记录在返回的结果中
+func ReadTokenRecords(r io.Reader, format string) ([]TokenRecord, []ImportRowResult, error) {
+	if format == TransferFormatJSON {
+		var items []json.RawMessage
+		if err := json.NewDecoder(r).Decode(&items); err != nil {
+			return nil, nil, fmt.Errorf("解析JSON失败: %w", err)
+		}
+		// 逐项解析，单项格式错误不影响其他项
+		var records []TokenRecord
+		var invalid []ImportRowResult
+		for i, item := range items {
+			var record TokenRecord
+			if err := json.Unmarshal(item, &record); err != nil {
+				invalid = append(invalid, ImportRowResult{
+					Row:    i + 1,
+					Action: ImportActionInvalid,
+					Errors: []string{"格式错误: " + err.Error()},
+				})
+				continue
+			}
+			record.row = i + 1
+			records = append(records, record)
+		}
+		return records, invalid, nil
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取CSV表头失败: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, column := range tokenCSVHeader {
+			known = known || column == name
+		}
+		if !known {
+			return nil, nil, fmt.Errorf("CSV包含未知的列: %s", name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["token"]; !ok {
+		return nil, nil, fmt.Errorf("CSV缺少token列")
+	}
+
+	var records []TokenRecord
+	var invalid []ImportRowResult
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("读取CSV失败: %w", err)
+		}
+		// 字段中可能包含换行，使用解析器记录的行号
+		line, _ := reader.FieldPos(0)
+
+		value := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		record := TokenRecord{
+			Token:        value("token"),
+			TenantURL:    value("tenant_url"),
+			Status:       value("status"),
+			StatusReason: value("status_reason"),
+			Remark:       value("remark"),
+			Tags:         parseTags(value("tags")),
+			row:          line,
+		}
+
+		var errs []string
+		for name, target := range map[string]*int{
+			"chat_usage_limit":  &record.ChatUsageLimit,
+			"agent_usage_limit": &record.AgentUsageLimit,
+			"chat_usage":        &record.ChatUsage,
+			"agent_usage":       &record.AgentUsage,
+		} {
+			if raw := value(name); raw != "" {
+				n, err := strconv.Atoi(raw)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s 必须为整数", name))
+					continue
+				}
+				*target = n
+			}
+		}
+		if raw := value("cool_end"); raw != "" {
+			coolEnd, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				errs = append(errs, "cool_end 必须为RFC3339时间")
+			} else {
+				record.CoolEnd = &coolEnd
+			}
+		}
+
+		if len(errs) > 0 {
+			sort.Strings(errs)
+			invalid = append(invalid, ImportRowResult{
+				Row:    line,
+				Token:  MaskToken(record.Token),
+				Action: ImportActionInvalid,
+				Errors: errs,
+			})
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, invalid, nil
+}
+
+// validate 校验导入数据，exists 表示token已存在（已存在时可以不提供租户地址）
+func (r *TokenRecord) validate(exists bool) []string {
+	var errs []string
+	if r.TenantURL == "" {
+		r.TenantURL = r.LegacyTenantURL
+	}
+
+	if r.Token == "" {
+		errs = append(errs, "token 不能为空")
+	}
+	if r.TenantURL == "" {
+		if !exists {
+			errs = append(errs, "tenant_url 不能为空")
+		}
+	} else if parsed, err := url.Parse(r.TenantURL); err != nil || parsed.Host == "" ||
+		(parsed.Scheme != "http" && parsed.Scheme != "https") {
+		errs = append(errs, "tenant_url 必须为http或https地址")
+	}
+	if r.Status != "" && !isValidTokenStatus(r.Status) {
+		errs = append(errs, "status 必须为 active、disabled 或 quarantined")
+	}
+	if r.ChatUsageLimit < 0 || r.AgentUsageLimit < 0 {
+		errs = append(errs, "使用次数上限不能为负数")
+	}
+	if r.ChatUsage < 0 || r.AgentUsage < 0 {
+		errs = append(errs, "使用次数不能为负数")
+	}
+	for _, tag := range r.Tags {
+		if !validTag.MatchString(tag) {
+			errs = append(errs, fmt.Sprintf("标签 %q 无效，只允许字母、数字和 ._:-，最长32位", tag))
+		}
+	}
+	return errs
+}
+
+// ImportTokens 按冲突处理方式导入token，DryRun时只生成报告不写入
+func ImportTokens(records []TokenRecord, opts ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{
+		Mode:   opts.Mode,
+		DryRun: opts.DryRun,
+		Total:  len(records),
+		Rows:   make([]ImportRowResult, 0, len(records)),
+	}
+
+	seen := make(map[string]int)
+	for i := range records {
+		record := &records[i]
+		row := record.row
+		if row == 0 {
+			row = i + 1
+		}
+		result := ImportRowResult{
+			Row:   row,
+			Token: MaskToken(record.Token),
+		}
+
+		var existing map[string]string
+		if record.Token != "" {
+			result.TokenID = LookupTokenID(record.Token)
+			fields, err := config.RedisHGetAll("token:" + result.TokenID)
+			if err != nil {
+				return nil, fmt.Errorf("读取token失败: %v", err)
+			}
+			if len(fields) > 0 {
+				existing = fields
+			}
+		}
+
+		errs := record.validate(existing != nil)
+		if previous, ok := seen[result.TokenID]; ok && result.TokenID != "" {
+			errs = append(errs, fmt.Sprintf("与第 %d 行的token重复", previous))
+		}
+		if len(errs) > 0 {
+			result.Action = ImportActionInvalid
+			result.Errors = errs
+			report.add(result)
+			continue
+		}
+		seen[result.TokenID] = row
+
+		if existing != nil && opts.Mode == ImportModeSkip {
+			result.Action = ImportActionSkipped
+			report.add(result)
+			continue
+		}
+
+		fields, changes := record.fieldsFor(result.TokenID, existing, opts.Mode)
+		if existing == nil {
+			result.Action = ImportActionCreated
+		} else if len(changes) == 0 {
+			result.Action = ImportActionSkipped
+			report.add(result)
+			continue
+		} else {
+			result.Action = ImportActionUpdated
+			result.Changes = changes
+		}
+
+		if !opts.DryRun {
+			if err := applyTokenRecord(result.TokenID, record, fields, existing, opts); err != nil {
+				result.Action = ImportActionInvalid
+				result.Changes = nil
+				result.Errors = []string{err.Error()}
+			}
+		}
+		report.add(result)
+	}
+
+	return report, nil
+}
+
+func (r *ImportReport) add(result ImportRowResult) {
+	switch result.Action {
+	case ImportActionCreated:
+		r.Created++
+	case ImportActionUpdated:
+		r.Updated++
+	case ImportActionSkipped:
+		r.Skipped++
+	case ImportActionInvalid:
+		r.Invalid++
+	}
+	r.Rows = append(r.Rows, result)
+}
+
+// fieldsFor 计算需要写入的哈希字段和发生变化的字段名
+// 合并模式下只处理导入数据中非空的字段；覆盖模式和新建token处理全部字段
+func (r *TokenRecord) fieldsFor(id string, existing map[string]string, mode string) (map[string]string, []string) {
+	status := r.Status
+	if status == "" && (existing == nil || mode == ImportModeOverwrite) {
+		status = TokenStatusActive
+	}
+
+	wanted := map[string]string{
+		"tenant_url":        r.TenantURL,
+		"status":            status,
+		"remark":            r.Remark,
+		"chat_usage_limit":  formatCount(r.ChatUsageLimit),
+		"agent_usage_limit": formatCount(r.AgentUsageLimit),
+		"tags":              strings.Join(r.Tags, ","),
+		"chat_usage":        strconv.Itoa(r.ChatUsage),
+		"agent_usage":       strconv.Itoa(r.AgentUsage),
+		"cool_end":          "",
+	}
+	if r.CoolEnd != nil && r.CoolEnd.After(time.Now()) {
+		wanted["cool_end"] = r.CoolEnd.Format(time.RFC3339)
+	}
+
+	fields := make(map[string]string)
+	var changes []string
+	for _, name := range tokenCSVHeader {
+		value, ok := wanted[name]
+		if !ok {
+			continue
+		}
+		if existing != nil && mode == ImportModeMerge && (value == "" || value == "0") {
+			continue
+		}
+		// 租户地址为空时保留原值
+		if name == "tenant_url" && value == "" {
+			continue
+		}
+		if existing != nil && currentTokenField(id, existing, name) == value {
+			continue
+		}
+		fields[name] = value
+		changes = append(changes, name)
+	}
+	return fields, changes
+}
+
+// currentTokenField 读取已存在token的字段值，使用次数和冷却时间保存在单独的键中
+func currentTokenField(id string, existing map[string]string, name string) string {
+	switch name {
+	case "status":
+		if existing["status"] == "" {
+			return TokenStatusActive
+		}
+	case "chat_usage":
+		return strconv.Itoa(getTokenChatUsageCount(id))
+	case "agent_usage":
+		return strconv.Itoa(getTokenAgentUsageCount(id))
+	case "cool_end":
+		if cool, err := GetTokenCoolStatus(id); err == nil && cool.InCool {
+			return cool.CoolEnd.Format(time.RFC3339)
+		}
+		return ""
+	}
+	return existing[name]
+}
+
+// applyTokenRecord 写入导入的token数据
+func applyTokenRecord(id string, record *TokenRecord, fields, existing map[string]string, opts ImportOptions) error {
+	tokenKey := "token:" + id
+	hash := make(map[string]string)
+	if existing == nil {
+		secretFields, err := tokenSecretFields(record.Token)
+		if err != nil {
+			return err
+		}
+		for field, value := range secretFields {
+			hash[field] = value
+		}
+	}
+	for _, name := range []string{"tenant_url", "remark", "chat_usage_limit", "agent_usage_limit", "tags"} {
+		if value, ok := fields[name]; ok {
+			hash[name] = value
+		}
+	}
+	// 新建token直接写入状态，已有token通过SetTokenStatus记录变更历史
+	if status, ok := fields["status"]; ok && existing == nil {
+		hash["status"] = status
+		hash["status_reason"] = record.StatusReason
+	}
+	if len(hash) > 0 {
+		if err := config.RedisHSetMap(tokenKey, hash); err != nil {
+			return fmt.Errorf("保存token失败: %v", err)
+		}
+	}
+
+	if status, ok := fields["status"]; ok && existing != nil {
+		if err := SetTokenStatus(id, status, record.StatusReason, opts.Operator); err != nil {
+			return fmt.Errorf("更新token状态失败: %v", err)
+		}
+	}
+
+	_, chatChanged := fields["chat_usage"]
+	_, agentChanged := fields["agent_usage"]
+	if chatChanged || agentChanged {
+		chat, agent := getTokenChatUsageCount(id), getTokenAgentUsageCount(id)
+		if chatChanged {
+			chat, _ = strconv.Atoi(fields["chat_usage"])
+		}
+		if agentChanged {
+			agent, _ = strconv.Atoi(fields["agent_usage"])
+		}
+		for key, count := range map[string]int{
+			"token_usage_chat:" + id:  chat,
+			"token_usage_agent:" + id: agent,
+			"token_usage:" + id:       chat + agent,
+		} {
+			if err := config.RedisSet(key, strconv.Itoa(count), 0); err != nil {
+				return fmt.Errorf("保存使用次数失败: %v", err)
+			}
+		}
+	}
+
+	if coolEnd, ok := fields["cool_end"]; ok {
+		if coolEnd == "" {
+			if err := config.RedisDel("token_cool_status:" + id); err != nil {
+				return fmt.Errorf("清除冷却状态失败: %v", err)
+			}
+		} else if err := SetTokenCoolStatus(id, time.Until(*record.CoolEnd)); err != nil {
+			return fmt.Errorf("保存冷却状态失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// ParseTransferFormat 解析导入导出格式，未指定时根据文件名或Content-Type判断
+func ParseTransferFormat(format, hint string) (string, error) {
+	switch strings.ToLower(format) {
+	case TransferFormatJSON, TransferFormatCSV:
+		return strings.ToLower(format), nil
+	case "":
+		if strings.HasSuffix(strings.ToLower(hint), ".csv") || strings.Contains(hint, "text/csv") {
+			return TransferFormatCSV, nil
+		}
+		return TransferFormatJSON, nil
+	}
+	return "", fmt.Errorf("format 必须为 json 或 csv")
+}
+
+// ParseImportMode 解析冲突处理方式，默认跳过已存在的token
+func ParseImportMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ImportModeSkip, nil
+	case ImportModeSkip, ImportModeOverwrite, ImportModeMerge:
+		return mode, nil
+	}
+	return "", fmt.Errorf("mode 必须为 skip、overwrite 或 merge")
+}
+
+// ExportTokensHandler 导出全部token，支持参数 format（json/csv）
+func ExportTokensHandler(c *gin.Context) {
+	format, err := ParseTransferFormat(c.Query("format"), "")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	records, err := ExportTokens()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "导出token失败: " + err.Error(),
+		})
+		return
+	}
+
+	contentType := "application/json; charset=utf-8"
+	if format == TransferFormatCSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	filename := fmt.Sprintf("tokens-%s.%s", time.Now().Format("20060102150405"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	_ = WriteTokenRecords(c.Writer, format, records)
+}
+
+// ImportTokensHandler 导入token
+// 支持参数: format（json/csv，默认根据Content-Type判断）、mode（skip/overwrite/merge）、dry_run
+func ImportTokensHandler(c *gin.Context) {
+	format, err := ParseTransferFormat(c.Query("format"), c.ContentType())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	mode, err := ParseImportMode(c.Query("mode"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+
+	importTokensFrom(c, format, ImportOptions{
+		Mode:     mode,
+		DryRun:   dryRun,
+		Operator: adminOperator(c),
+	})
+}
+
+// importTokensFrom 解析请求体并导入，返回导入报告
+func importTokensFrom(c *gin.Context, format string, opts ImportOptions) {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBodyBytes)
+	records, invalid, err := ReadTokenRecords(body, format)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"status": "error",
+			"error":  fmt.Sprintf("导入数据超过%dMB", maxImportBodyBytes>>20),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	report, err := ImportTokens(records, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+			"error":  "导入token失败: " + err.Error(),
+		})
+		return
+	}
+	report.MergeInvalid(invalid)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"report": report,
+	})
+}
+
+// MergeInvalid 合并解析阶段发现的无效行，并按行号排序
+func (r *ImportReport) MergeInvalid(invalid []ImportRowResult) {
+	if len(invalid) == 0 {
+		return
+	}
+	r.Total += len(invalid)
+	r.Invalid += len(invalid)
+	r.Rows = append(r.Rows, invalid...)
+	sort.SliceStable(r.Rows, func(i, j int) bool {
+		return r.Rows[i].Row < r.Rows[j].Row
+	})
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadTokenRecords(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		input       string
+		wantErr     string
+		wantTokens  []string
+		wantRows    []int
+		wantInvalid []int
+	}{
+		{
+			name:       "json",
+			format:     TransferFormatJSON,
+			input:      `[{"token":"a","tenant_url":"https://x/"},{"token":"b","tenantUrl":"https://y/","tags":["t"]}]`,
+			wantTokens: []string{"a", "b"},
+			wantRows:   []int{1, 2},
+		},
+		{
+			name:        "json invalid item",
+			format:      TransferFormatJSON,
+			input:       `[{"token":"a"},{"token":1},{"token":"c"}]`,
+			wantTokens:  []string{"a", "c"},
+			wantRows:    []int{1, 3},
+			wantInvalid: []int{2},
+		},
+		{
+			name:    "json malformed",
+			format:  TransferFormatJSON,
+			input:   `{"token":"a"}`,
+			wantErr: "解析JSON失败",
+		},
+		{
+			name:       "csv",
+			format:     TransferFormatCSV,
+			input:      "Token,tenant_url,tags\na,https://x/,\"t1, t2\"\nb,https://y/,\n",
+			wantTokens: []string{"a", "b"},
+			wantRows:   []int{2, 3},
+		},
+		{
+			name:       "csv multiline field",
+			format:     TransferFormatCSV,
+			input:      "token,remark\na,\"line1\nline2\"\nb,\n",
+			wantTokens: []string{"a", "b"},
+			wantRows:   []int{2, 4},
+		},
+		{
+			name:        "csv invalid values",
+			format:      TransferFormatCSV,
+			input:       "token,chat_usage_limit,cool_end\na,x,\nb,5,2026-01-01T00:00:00Z\nc,,yesterday\n",
+			wantTokens:  []string{"b"},
+			wantRows:    []int{3},
+			wantInvalid: []int{2, 4},
+		},
+		{
+			name:    "csv unknown column",
+			format:  TransferFormatCSV,
+			input:   "token,password\na,b\n",
+			wantErr: "未知的列",
+		},
+		{
+			name:    "csv missing token column",
+			format:  TransferFormatCSV,
+			input:   "tenant_url\nhttps://x/\n",
+			wantErr: "缺少token列",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, invalid, err := ReadTokenRecords(strings.NewReader(tt.input), tt.format)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(tt.wantTokens) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.wantTokens))
+			}
+			for i, record := range records {
+				if record.Token != tt.wantTokens[i] || record.row != tt.wantRows[i] {
+					t.Errorf("record %d = %q row %d, want %q row %d", i, record.Token, record.row, tt.wantTokens[i], tt.wantRows[i])
+				}
+			}
+			if len(invalid) != len(tt.wantInvalid) {
+				t.Fatalf("invalid = %+v, want rows %v", invalid, tt.wantInvalid)
+			}
+			for i, row := range invalid {
+				if row.Row != tt.wantInvalid[i] || row.Action != ImportActionInvalid || len(row.Errors) == 0 {
+					t.Errorf("invalid %d = %+v, want row %d", i, row, tt.wantInvalid[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadTokenRecordsFields(t *testing.T) {
+	input := "token,tenant_url,status,chat_usage_limit,agent_usage,cool_end,tags\n" +
+		"a,https://x/,disabled,10,3,2026-01-01T00:00:00Z,\"t1,t2,t1\"\n"
+	records, _, err := ReadTokenRecords(strings.NewReader(input), TransferFormatCSV)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("ReadTokenRecords() = %v, %v", records, err)
+	}
+	record := records[0]
+	if record.TenantURL != "https://x/" || record.Status != "disabled" || record.ChatUsageLimit != 10 ||
+		record.AgentUsage != 3 || record.CoolEnd == nil || strings.Join(record.Tags, "|") != "t1|t2" {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// 工作区上下文中代码和指南的最大字节数
+	maxWorkspaceTextBytes = 512 << 10
+	// 文件路径的最大长度
+	maxWorkspacePathBytes = 4096
+)
+
+// WorkspaceContext 编辑器集成传入的工作区上下文，使回答能结合当前文件和光标位置
+type WorkspaceContext struct {
+	Path       string `json:"path,omitempty"`       // 当前文件相对工作区的路径
+	Prefix     string `json:"prefix,omitempty"`     // 光标前的代码
+	Suffix     string `json:"suffix,omitempty"`     // 光标后的代码
+	Lang       string `json:"lang,omitempty"`       // 当前文件的语言，不传时自动检测
+	Guidelines string `json:"guidelines,omitempty"` // 工作区指南，例如项目的编码规范
+}
+
+// validate 校验工作区上下文的大小
+func (w *WorkspaceContext) validate() error {
+	if len(w.Path) > maxWorkspacePathBytes {
+		return fmt.Errorf("workspace.path 超过%d字节", maxWorkspacePathBytes)
+	}
+	fields := []struct{ name, value string }{
+		{"prefix", w.Prefix},
+		{"suffix", w.Suffix},
+		{"guidelines", w.Guidelines},
+	}
+	for _, field := range fields {
+		if len(field.value) > maxWorkspaceTextBytes {
+			return fmt.Errorf("workspace.%s 超过%dKB", field.name, maxWorkspaceTextBytes>>10)
+		}
+	}
+	return nil
+}
+
+// applyWorkspaceContext 使用工作区上下文替换默认的路径、前缀、后缀和语言
+// 未传入的字段保持默认值
+func applyWorkspaceContext(augmentReq *AugmentRequest, w *WorkspaceContext) error {
+	if w == nil {
+		return nil
+	}
+	if err := w.validate(); err != nil {
+		return err
+	}
+
+	if path := strings.TrimSpace(w.Path); path != "" {
+		augmentReq.Path = strings.ReplaceAll(path, "\\", "/")
+	}
+	// 传入代码时不再使用默认的风格前缀
+	if w.Prefix != "" || w.Suffix != "" {
+		augmentReq.Prefix = w.Prefix
+		augmentReq.Suffix = w.Suffix
+	}
+	if lang := strings.TrimSpace(w.Lang); lang != "" {
+		augmentReq.Lang = lang
+	}
+	augmentReq.WorkspaceGuidelines = w.Guidelines
+	return nil
+}
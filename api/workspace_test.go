@@ -0,0 +1,63 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWorkspaceContextValidate(t *testing.T) {
+	atLimit := strings.Repeat("x", maxWorkspaceTextBytes)
+	overLimit := atLimit + "x"
+	tests := []struct {
+		name      string
+		workspace WorkspaceContext
+		wantErr   string
+	}{
+		{"empty", WorkspaceContext{}, ""},
+		{"at limits", WorkspaceContext{Path: strings.Repeat("p", maxWorkspacePathBytes), Prefix: atLimit, Suffix: atLimit, Guidelines: atLimit}, ""},
+		{"path", WorkspaceContext{Path: strings.Repeat("p", maxWorkspacePathBytes+1)}, "workspace.path"},
+		{"prefix", WorkspaceContext{Prefix: overLimit}, "workspace.prefix 超过512KB"},
+		{"suffix", WorkspaceContext{Suffix: overLimit}, "workspace.suffix"},
+		{"guidelines", WorkspaceContext{Guidelines: overLimit}, "workspace.guidelines"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.workspace.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyWorkspaceContext(t *testing.T) {
+	tests := []struct {
+		name       string
+		workspace  *WorkspaceContext
+		wantPath   string
+		wantPrefix string
+		wantLang   string
+	}{
+		{"nil keeps defaults", nil, "", defaultPrefix, "Go"},
+		{"path normalized", &WorkspaceContext{Path: ` src\main.py `}, "src/main.py", defaultPrefix, "Go"},
+		{"code replaces default prefix", &WorkspaceContext{Prefix: "x := 1"}, "", "x := 1", "Go"},
+		{"explicit lang", &WorkspaceContext{Lang: "Rust"}, "", defaultPrefix, "Rust"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			augmentReq := AugmentRequest{Prefix: defaultPrefix, Suffix: " ", Lang: "Go"}
+			if err := applyWorkspaceContext(&augmentReq, tt.workspace); err != nil {
+				t.Fatal(err)
+			}
+			if augmentReq.Path != tt.wantPath || augmentReq.Prefix != tt.wantPrefix || augmentReq.Lang != tt.wantLang {
+				t.Errorf("got path %q prefix %q lang %q", augmentReq.Path, augmentReq.Prefix, augmentReq.Lang)
+			}
+		})
+	}
+}
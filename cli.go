@@ -0,0 +1,532 @@
+package main
+
+import (
+	"augment2api/api"
+	"augment2api/config"
+	"augment2api/pkg/logger"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errUsage 参数错误，已打印用法
+var errUsage = errors.New("参数错误")
+
+// usage 打印命令行用法
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), `用法: augment2api [--config 配置文件] <命令> [参数]
+
+命令:
+  serve                              启动服务（默认）
+  tokens list [--status s] [--tag t] [--json]
+                                     列出token
+  tokens add <token> [tenant_url] [--remark r]
+                                     添加token，未指定租户地址时自动探测
+  tokens remove <token|id>...        删除token
+  tokens check [token|id]...         检测租户地址，未指定时检测全部
+  tokens enable <token|id> [--reason r]
+  tokens disable <token|id> [--reason r]
+                                     启用或禁用token
+  tokens import [文件] [--format json|csv] [--mode skip|overwrite|merge] [--dry-run]
+                                     导入token，未指定文件时读取标准输入
+  tokens export [文件] [--format json|csv]
+                                     导出全部token，未指定文件时输出到标准输出
+  reset-usage                        重置所有token的使用次数
+  migrate [--dry-run] [--status]     执行Redis数据迁移，--dry-run只输出将要发生的变更
+  reencrypt-tokens                   使用当前密钥重新加密所有token
+  oauth login                        通过OAuth授权添加token
+  config validate                    校验配置，不连接Redis
+
+全局参数:
+`)
+	flag.PrintDefaults()
+}
+
+// runCommand 执行命令行子命令
+func runCommand(configFile string, args []string) error {
+	switch args[0] {
+	case "tokens":
+		if len(args) < 2 {
+			flag.Usage()
+			return errUsage
+		}
+		return runTokensCommand(configFile, args[1], args[2:])
+	case "reset-usage":
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		if err := api.ResetTokenUsage(); err != nil {
+			return fmt.Errorf("重置使用次数失败: %v", err)
+		}
+		fmt.Println("已重置所有token的使用次数")
+		return nil
+	case "migrate":
+		return runMigrate(configFile, args[1:])
+	case "reencrypt-tokens":
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		count, err := api.ReencryptTokens()
+		if err != nil {
+			return fmt.Errorf("重新加密token失败: %v", err)
+		}
+		fmt.Printf("重新加密token完成，共处理 %d 个token\n", count)
+		return nil
+	case "oauth":
+		if len(args) < 2 || args[1] != "login" {
+			flag.Usage()
+			return errUsage
+		}
+		return runOAuthLogin(configFile)
+	case "config":
+		if len(args) < 2 || args[1] != "validate" {
+			flag.Usage()
+			return errUsage
+		}
+		if _, _, err := config.LoadConfig(configFile); err != nil {
+			return err
+		}
+		fmt.Println("配置有效")
+		return nil
+	}
+
+	flag.Usage()
+	return errUsage
+}
+
+// setupStore 加载配置并连接Redis，命令行模式下默认只输出警告及以上日志
+func setupStore(configFile string) error {
+	if err := config.InitConfig(configFile); err != nil {
+		return err
+	}
+	if config.Current().LogLevel == "info" {
+		_ = logger.SetLevel("warn")
+	}
+	return config.InitRedisClient()
+}
+
+// runMigrate 执行未完成的数据迁移或查看迁移状态
+func runMigrate(configFile string, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "只输出将要发生的变更，不写入")
+	status := fs.Bool("status", false, "查看各迁移的执行状态")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if err := setupStore(configFile); err != nil {
+		return err
+	}
+	// 迁移过程中的变更记录输出到日志
+	if *dryRun {
+		_ = logger.SetLevel(config.Current().LogLevel)
+	}
+
+	if !*status {
+		if err := api.RunMigrations(*dryRun); err != nil {
+			return err
+		}
+	}
+
+	version, err := api.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("读取数据版本失败: %v", err)
+	}
+	statuses, err := api.MigrationStatuses()
+	if err != nil {
+		return fmt.Errorf("读取迁移状态失败: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED\tCHANGES\tAPPLIED_AT")
+	for _, s := range statuses {
+		appliedAt := ""
+		if !s.AppliedAt.IsZero() {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%t\t%d\t%s\n", s.Version, s.Name, s.Applied, s.Changes, appliedAt)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("当前数据版本: %d，最新版本: %d\n", version, api.LatestSchemaVersion())
+	return nil
+}
+
+// cliOperator 返回命令行操作者标识，记录在token状态变更历史中
+func cliOperator() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	return "cli@" + user
+}
+
+// parseArgs 解析子命令参数，允许参数和位置参数混合出现
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// runTokensCommand 执行token管理子命令
+func runTokensCommand(configFile, command string, args []string) error {
+	fs := flag.NewFlagSet("tokens "+command, flag.ContinueOnError)
+	status := fs.String("status", "", "按状态过滤: active / disabled / quarantined")
+	tag := fs.String("tag", "", "按标签过滤")
+	asJSON := fs.Bool("json", false, "以JSON格式输出")
+	remark := fs.String("remark", "", "token备注")
+	reason := fs.String("reason", "", "状态变更原因")
+	format := fs.String("format", "", "导入导出格式: json / csv，默认根据文件扩展名判断")
+	mode := fs.String("mode", api.ImportModeSkip, "导入时已存在token的处理方式: skip / overwrite / merge")
+	dryRun := fs.Bool("dry-run", false, "只输出导入报告，不写入")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return errUsage
+	}
+
+	switch command {
+	case "list":
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		return listTokens(*status, *tag, *asJSON)
+	case "add":
+		if len(positional) < 1 || len(positional) > 2 {
+			return fmt.Errorf("用法: tokens add <token> [tenant_url] [--remark r]")
+		}
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		tenantURL := ""
+		if len(positional) == 2 {
+			tenantURL = positional[1]
+		}
+		return addToken(positional[0], tenantURL, *remark)
+	case "remove":
+		if len(positional) == 0 {
+			return fmt.Errorf("用法: tokens remove <token|id>...")
+		}
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		for _, param := range positional {
+			id := api.ResolveTokenID(param)
+			if err := api.DeleteToken(id); err != nil {
+				return fmt.Errorf("删除 %s 失败: %v", param, err)
+			}
+			fmt.Printf("已删除 %s\n", id)
+		}
+		return nil
+	case "check":
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		return checkTokens(positional)
+	case "enable", "disable":
+		if len(positional) != 1 {
+			return fmt.Errorf("用法: tokens %s <token|id> [--reason r]", command)
+		}
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		newStatus := api.TokenStatusActive
+		if command == "disable" {
+			newStatus = api.TokenStatusDisabled
+		}
+		return setTokenStatus(positional[0], newStatus, *reason)
+	case "import":
+		if len(positional) > 1 {
+			return fmt.Errorf("用法: tokens import [文件] [--format json|csv] [--mode skip|overwrite|merge] [--dry-run]")
+		}
+		importMode, err := api.ParseImportMode(*mode)
+		if err != nil {
+			return err
+		}
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		return importTokens(positional, *format, api.ImportOptions{
+			Mode:     importMode,
+			DryRun:   *dryRun,
+			Operator: cliOperator(),
+		}, *asJSON)
+	case "export":
+		if len(positional) > 1 {
+			return fmt.Errorf("用法: tokens export [文件] [--format json|csv]")
+		}
+		if err := setupStore(configFile); err != nil {
+			return err
+		}
+		return exportTokens(positional, *format)
+	}
+
+	flag.Usage()
+	return errUsage
+}
+
+// listTokens 以表格或JSON输出token列表
+func listTokens(status, tag string, asJSON bool) error {
+	tokens, err := api.ListTokens(status)
+	if err != nil {
+		return fmt.Errorf("获取token列表失败: %v", err)
+	}
+	tokens = api.FilterTokensByTag(tokens, tag)
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(tokens)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTOKEN\tTENANT_URL\tSTATUS\tCHAT\tAGENT\tTAGS\tREMARK")
+	for _, t := range tokens {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			t.ID, t.Token, t.TenantURL, t.Status, t.ChatUsageCount, t.AgentUsageCount, strings.Join(t.Tags, ","), t.Remark)
+	}
+	return w.Flush()
+}
+
+// addToken 添加单个token，未指定租户地址时探测候选地址
+func addToken(token, tenantURL, remark string) error {
+	id := api.LookupTokenID(token)
+	exists, err := config.RedisExists("token:" + id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("token %s 已存在", id)
+	}
+
+	if err := api.SaveTokenToRedis(token, tenantURL); err != nil {
+		return fmt.Errorf("保存token失败: %v", err)
+	}
+	if remark != "" {
+		if err := config.RedisHSet("token:"+id, "remark", remark); err != nil {
+			return fmt.Errorf("保存备注失败: %v", err)
+		}
+	}
+
+	if tenantURL == "" {
+		tenantURL, err = api.CheckTokenTenantURL(id)
+		if err != nil {
+			// 探测失败时不保留没有租户地址的token
+			_ = api.DeleteToken(id)
+			return fmt.Errorf("探测租户地址失败: %v", err)
+		}
+	}
+
+	fmt.Printf("已添加 %s (%s) %s\n", id, api.MaskToken(token), tenantURL)
+	return nil
+}
+
+// checkTokens 检测指定token的租户地址，未指定时检测全部token
+func checkTokens(params []string) error {
+	ids := make([]string, 0, len(params))
+	for _, param := range params {
+		ids = append(ids, api.ResolveTokenID(param))
+	}
+	if len(ids) == 0 {
+		tokens, err := api.ListTokens("")
+		if err != nil {
+			return fmt.Errorf("获取token列表失败: %v", err)
+		}
+		for _, t := range tokens {
+			ids = append(ids, t.ID)
+		}
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTOKEN\tRESULT\tTENANT_URL\tERROR")
+	for _, id := range ids {
+		result := api.CheckToken(context.Background(), id)
+		if result.Result == "failed" || result.Result == "disabled" {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			result.TokenID, result.Token, result.Result, result.NewTenantURL, result.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d 个token检测未通过", failed)
+	}
+	return nil
+}
+
+// setTokenStatus 修改token状态
+func setTokenStatus(param, status, reason string) error {
+	id := api.ResolveTokenID(param)
+	exists, err := config.RedisExists("token:" + id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return api.ErrTokenNotFound
+	}
+
+	if err := api.SetTokenStatus(id, status, reason, cliOperator()); err != nil {
+		return fmt.Errorf("更新token状态失败: %v", err)
+	}
+	fmt.Printf("%s 状态已更新为 %s\n", id, status)
+	return nil
+}
+
+// importTokens 从文件或标准输入导入token并输出导入报告
+func importTokens(args []string, format string, opts api.ImportOptions, asJSON bool) error {
+	var input io.Reader = os.Stdin
+	name := ""
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+		name = args[0]
+	}
+
+	format, err := api.ParseTransferFormat(format, name)
+	if err != nil {
+		return err
+	}
+	records, invalid, err := api.ReadTokenRecords(input, format)
+	if err != nil {
+		return err
+	}
+	report, err := api.ImportTokens(records, opts)
+	if err != nil {
+		return err
+	}
+	// 解析阶段的无效行一并计入报告
+	report.MergeInvalid(invalid)
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ROW\tID\tTOKEN\tACTION\tDETAIL")
+		for _, row := range report.Rows {
+			detail := strings.Join(row.Changes, ",")
+			if len(row.Errors) > 0 {
+				detail = strings.Join(row.Errors, "; ")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", row.Row, row.TokenID, row.Token, row.Action, detail)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	prefix := ""
+	if opts.DryRun {
+		prefix = "[dry-run] "
+	}
+	fmt.Fprintf(os.Stderr, "%s共 %d 项: 新增 %d，更新 %d，跳过 %d，无效 %d\n",
+		prefix, report.Total, report.Created, report.Updated, report.Skipped, report.Invalid)
+	if report.Invalid > 0 {
+		return fmt.Errorf("%d 项数据无效", report.Invalid)
+	}
+	return nil
+}
+
+// exportTokens 导出完整token数据，可直接用于导入
+func exportTokens(args []string, format string) error {
+	name := ""
+	if len(args) == 1 && args[0] != "-" {
+		name = args[0]
+	}
+	format, err := api.ParseTransferFormat(format, name)
+	if err != nil {
+		return err
+	}
+
+	records, err := api.ExportTokens()
+	if err != nil {
+		return fmt.Errorf("导出token失败: %v", err)
+	}
+
+	output := os.Stdout
+	if name != "" {
+		// 导出文件包含token原文，仅允许当前用户读取
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+
+	if err := api.WriteTokenRecords(output, format, records); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "已导出 %d 个token\n", len(records))
+	return nil
+}
+
+// runOAuthLogin 打印授权地址，读取授权后页面返回的JSON并保存token
+func runOAuthLogin(configFile string) error {
+	if err := setupStore(configFile); err != nil {
+		return err
+	}
+
+	oauthState := createOAuthState()
+	fmt.Println("请在浏览器中打开以下地址完成授权:")
+	fmt.Println()
+	fmt.Println(generateAuthorizeURL(oauthState))
+	fmt.Println()
+	fmt.Print("请粘贴授权后页面显示的JSON: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("读取授权码失败: %v", err)
+	}
+
+	var codeResp api.CodeResponse
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &codeResp); err != nil {
+		return fmt.Errorf("解析授权码失败: %v", err)
+	}
+	if codeResp.Code == "" || codeResp.TenantURL == "" {
+		return fmt.Errorf("授权数据缺少code或tenant_url")
+	}
+	if codeResp.State != oauthState.State {
+		return fmt.Errorf("授权state不匹配，请重新执行 oauth login")
+	}
+
+	token, err := getAccessToken(codeResp.TenantURL, oauthState.CodeVerifier, codeResp.Code)
+	if err != nil {
+		return err
+	}
+	if err := api.SaveTokenToRedis(token, codeResp.TenantURL); err != nil {
+		return fmt.Errorf("保存token到Redis失败: %v", err)
+	}
+
+	fmt.Printf("已添加 %s (%s) %s\n", api.TokenID(token), api.MaskToken(token), codeResp.TenantURL)
+	return nil
+}
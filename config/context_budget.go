@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 超出上下文预算时对历史的处理方式
+const (
+	ContextTruncationDrop      = "drop"      // 丢弃最早的轮次
+	ContextTruncationSummarize = "summarize" // 将最早的轮次总结为一段摘要
+)
+
+// ContextBudgetRule 按模型设置的上下文预算，格式为 <模型>=<token数>，模型支持 * 通配，不区分大小写
+//
+//	claude-3.7-*=150000
+//	*-chat=60000
+type ContextBudgetRule struct {
+	Model  string
+	Tokens int
+}
+
+// String 返回规则的配置格式
+func (r ContextBudgetRule) String() string {
+	return r.Model + "=" + strconv.Itoa(r.Tokens)
+}
+
+// ContextBudget 返回模型的上下文预算，按顺序匹配模型规则，没有匹配时使用默认预算，0表示不限制
+func (r *Reloadable) ContextBudget(model string) int {
+	model = strings.ToLower(model)
+	for _, rule := range r.ContextBudgets {
+		if matched, err := path.Match(rule.Model, model); err == nil && matched {
+			return rule.Tokens
+		}
+	}
+	return r.DefaultContextBudget
+}
+
+// ParseContextBudgets 解析按模型设置的上下文预算，返回所有格式错误
+func ParseContextBudgets(items []string) ([]ContextBudgetRule, []string) {
+	rules := make([]ContextBudgetRule, 0, len(items))
+	var errs []string
+	for _, item := range items {
+		index := strings.LastIndex(item, "=")
+		if index < 0 {
+			errs = append(errs, fmt.Sprintf("CONTEXT_BUDGETS 规则 %q 无效: 缺少 =", item))
+			continue
+		}
+		model := strings.ToLower(strings.TrimSpace(item[:index]))
+		tokens, err := strconv.Atoi(strings.TrimSpace(item[index+1:]))
+		if model == "" || err != nil || tokens < 0 {
+			errs = append(errs, fmt.Sprintf("CONTEXT_BUDGETS 规则 %q 无效: 格式必须为 <模型>=<非负整数>", item))
+			continue
+		}
+		if _, err := path.Match(model, ""); err != nil {
+			errs = append(errs, fmt.Sprintf("CONTEXT_BUDGETS 规则 %q 无效: 通配符格式错误", item))
+			continue
+		}
+		rules = append(rules, ContextBudgetRule{Model: model, Tokens: tokens})
+	}
+	return rules, errs
+}
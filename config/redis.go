@@ -3,7 +3,8 @@ package config
 import (
 	"augment2api/pkg/logger"
 	"context"
-	"os"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -22,7 +23,7 @@ func InitRedisClient() (err error) {
 
 	opt, err := redis.ParseURL(RedisConnString)
 	if err != nil {
-		logger.Log.Fatalln("failed to parse Redis connection string: " + err.Error())
+		return fmt.Errorf("failed to parse Redis connection string: %v", err)
 	}
 	RDB = redis.NewClient(opt)
 
@@ -31,17 +32,21 @@ func InitRedisClient() (err error) {
 
 	_, err = RDB.Ping(ctx).Result()
 	if err != nil {
-		logger.Log.Fatalln("Redis ping test failed: " + err.Error())
+		return fmt.Errorf("Redis ping test failed: %v", err)
 	}
-	return err
+	return nil
 }
 
-func ParseRedisOption() *redis.Options {
-	opt, err := redis.ParseURL(os.Getenv("REDIS_CONN_STRING"))
-	if err != nil {
-		logger.Log.Fatalln("failed to parse Redis connection string: " + err.Error())
+// CloseRedisClient 关闭Redis连接
+func CloseRedisClient() error {
+	if client, ok := RDB.(*redis.Client); ok {
+		return client.Close()
 	}
-	return opt
+	return nil
+}
+
+func ParseRedisOption() (*redis.Options, error) {
+	return redis.ParseURL(AppConfig.RedisConnString)
 }
 
 func RedisSet(key string, value string, expiration time.Duration) error {
@@ -100,6 +105,35 @@ func RedisIncr(key string) error {
 	return err
 }
 
+// RedisIncrExpire 增加计数器并在首次创建时设置过期时间，返回增加后的值
+func RedisIncrExpire(key string, expiration time.Duration) (int64, error) {
+	ctx := context.Background()
+	count, err := RDB.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		err = RDB.Expire(ctx, key, expiration).Err()
+	}
+	return count, err
+}
+
+// RedisZIncrBy 增加有序集合成员的分数
+func RedisZIncrBy(key string, increment float64, member string) error {
+	ctx := context.Background()
+	return RDB.ZIncrBy(ctx, key, increment, member).Err()
+}
+
+// RedisZScore 获取有序集合成员的分数，成员不存在时返回0
+func RedisZScore(key, member string) float64 {
+	ctx := context.Background()
+	score, err := RDB.ZScore(ctx, key, member).Result()
+	if err != nil {
+		return 0
+	}
+	return score
+}
+
 // RedisHExists 检查哈希表字段是否存在
 func RedisHExists(key, field string) (bool, error) {
 	ctx := context.Background()
@@ -111,3 +145,144 @@ func RedisHGetAll(key string) (map[string]string, error) {
 	ctx := context.Background()
 	return RDB.HGetAll(ctx, key).Result()
 }
+
+// RedisLPushTrim 将值插入列表头部，并只保留最新的 limit 个元素
+func RedisLPushTrim(key, value string, limit int64) error {
+	ctx := context.Background()
+	if err := RDB.LPush(ctx, key, value).Err(); err != nil {
+		return err
+	}
+	return RDB.LTrim(ctx, key, 0, limit-1).Err()
+}
+
+// RedisLRange 获取列表指定范围的元素
+func RedisLRange(key string, start, stop int64) ([]string, error) {
+	ctx := context.Background()
+	return RDB.LRange(ctx, key, start, stop).Result()
+}
+
+// RedisRename 重命名键
+func RedisRename(key, newKey string) error {
+	ctx := context.Background()
+	return RDB.Rename(ctx, key, newKey).Err()
+}
+
+// RedisHSetMap 一次设置哈希表的多个字段
+func RedisHSetMap(key string, fields map[string]string) error {
+	ctx := context.Background()
+	values := make(map[string]interface{}, len(fields))
+	for field, value := range fields {
+		values[field] = value
+	}
+	return RDB.HSet(ctx, key, values).Err()
+}
+
+// RedisZAddCapped 添加有序集合成员，并移除分数低于 minScore 的成员，只保留分数最高的 limit 个
+func RedisZAddCapped(key string, score float64, member string, limit int64, minScore float64) error {
+	ctx := context.Background()
+	pipe := RDB.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: score, Member: member})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatFloat(minScore, 'f', -1, 64))
+	if limit > 0 {
+		pipe.ZRemRangeByRank(ctx, key, 0, -limit-1)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RedisZRem 移除有序集合成员
+func RedisZRem(key string, members ...string) error {
+	ctx := context.Background()
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return RDB.ZRem(ctx, key, values...).Err()
+}
+
+// RedisZAddEvict 添加有序集合成员，成员数量超出 limit 时移除分数最低的成员并返回被移除的成员
+func RedisZAddEvict(key string, score float64, member string, limit int64) ([]string, error) {
+	ctx := context.Background()
+	if err := RDB.ZAdd(ctx, key, &redis.Z{Score: score, Member: member}).Err(); err != nil {
+		return nil, err
+	}
+	count, err := RDB.ZCard(ctx, key).Result()
+	if err != nil || count <= limit {
+		return nil, err
+	}
+	evicted, err := RDB.ZRange(ctx, key, 0, count-limit-1).Result()
+	if err != nil || len(evicted) == 0 {
+		return nil, err
+	}
+	values := make([]interface{}, len(evicted))
+	for i, member := range evicted {
+		values[i] = member
+	}
+	return evicted, RDB.ZRem(ctx, key, values...).Err()
+}
+
+// RedisZRevRangeByScore 按分数从高到低获取 [min, max] 范围内的成员
+func RedisZRevRangeByScore(key string, max, min float64, offset, count int64) ([]string, error) {
+	ctx := context.Background()
+	return RDB.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{
+		Max:    strconv.FormatFloat(max, 'f', -1, 64),
+		Min:    strconv.FormatFloat(min, 'f', -1, 64),
+		Offset: offset,
+		Count:  count,
+	}).Result()
+}
+
+// RedisHIncrByFields 批量增加哈希表字段的值并刷新过期时间
+func RedisHIncrByFields(key string, increments map[string]int64, expiration time.Duration) error {
+	ctx := context.Background()
+	pipe := RDB.TxPipeline()
+	for field, increment := range increments {
+		pipe.HIncrBy(ctx, key, field, increment)
+	}
+	pipe.Expire(ctx, key, expiration)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RedisPing 检查Redis连接是否可用
+func RedisPing(ctx context.Context) error {
+	if RDB == nil {
+		return fmt.Errorf("Redis未初始化")
+	}
+	return RDB.Ping(ctx).Err()
+}
+
+// RedisHMGet 获取哈希表多个字段的值，不存在的字段返回空字符串
+func RedisHMGet(key string, fields ...string) ([]string, error) {
+	ctx := context.Background()
+	values, err := RDB.HMGet(ctx, key, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			result[i] = s
+		}
+	}
+	return result, nil
+}
+
+// RedisSetNX 键不存在时设置值，返回是否设置成功，可用作分布式锁
+func RedisSetNX(key, value string, expiration time.Duration) (bool, error) {
+	ctx := context.Background()
+	return RDB.SetNX(ctx, key, value, expiration).Result()
+}
+
+// releaseScript 只有值与持有者一致时才删除，避免误删其他实例的锁
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// RedisDelIfValue 键的值等于 value 时删除
+func RedisDelIfValue(key, value string) error {
+	ctx := context.Background()
+	return releaseScript.Run(ctx, RDB, []string{key}, value).Err()
+}
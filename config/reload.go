@@ -0,0 +1,248 @@
+package config
+
+import (
+	"augment2api/pkg/logger"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 默认模型列表和指南
+const (
+	defaultModels             = "claude-3.7-agent,augment-chat"
+	defaultChatGuidelines     = "must answer in Chinese."
+	defaultAgentGuidelines    = "Answer in Chinese, do not use any tools, and for questions involving internet searches, please answer based on your existing knowledge."
+	defaultFallbackGuidelines = "使用中文回答"
+)
+
+// 配置文件变更检测周期
+const configWatchInterval = 5 * time.Second
+
+// Reloadable 可以在运行时热更新的配置，修改后新请求立即生效，不影响进行中的请求
+type Reloadable struct {
+	ProxyURL string
+	LogLevel string
+
+	Models               []string      // /v1/models 返回的模型列表
+	ChatUsageLimit       int           // 每个token CHAT模式的使用次数上限
+	AgentUsageLimit      int           // 每个token AGENT模式的使用次数上限
+	TokenRequestInterval time.Duration // 同一token两次请求的最小间隔
+
+	ChatGuidelines     string // CHAT模式的用户指南
+	AgentGuidelines    string // AGENT模式的用户指南
+	FallbackGuidelines string // 切换到CHAT模式重试时的用户指南
+
+	TokenGroupRules  []TokenGroupRule // 按API密钥、模型或请求头选择token分组的规则
+	TokenAffinityTTL time.Duration    // 同一会话优先使用同一token的有效期，为0时关闭
+
+	ConversationTTL      time.Duration // 服务端会话最后一次使用后的保留时间，为0时永久保留
+	ConversationMaxTurns int           // 服务端会话保留的最大轮数，超出时丢弃最早的轮次，为0时不限制
+
+	DefaultContextBudget int                 // 未单独配置的模型的上下文预算（估算token数），为0时不限制
+	ContextBudgets       []ContextBudgetRule // 按模型设置的上下文预算
+	ContextTruncation    string              // 超出预算时丢弃还是总结最早的轮次
+
+	ResponseCacheTTL        time.Duration // 相同请求的回复缓存时间，为0时关闭缓存
+	ResponseCacheMaxEntries int           // 最多缓存的回复数量，超出时淘汰最早的缓存
+	ResponseCacheMaxBytes   int           // 单条回复的最大缓存字节数，超出时不缓存
+
+	RequestCoalescing bool // 相同的聊天请求同时进行时合并为一次上游请求
+}
+
+var current atomic.Pointer[Reloadable]
+
+// Current 返回当前生效的可热更新配置
+func Current() *Reloadable {
+	if r := current.Load(); r != nil {
+		return r
+	}
+	// 未初始化时使用默认值
+	r := loadReloadable(&source{})
+	current.CompareAndSwap(nil, r)
+	return current.Load()
+}
+
+// SetCurrent 直接替换当前生效的可热更新配置，供测试使用，返回之前的配置
+func SetCurrent(r *Reloadable) *Reloadable {
+	previous := Current()
+	current.Store(r)
+	return previous
+}
+
+func loadReloadable(src *source) *Reloadable {
+	level := strings.ToLower(src.str("LOG_LEVEL", ""))
+	// 兼容旧的DEBUG开关
+	if level == "" && src.str("DEBUG", "") == "true" {
+		level = "debug"
+	}
+	if level == "" {
+		level = "info"
+	}
+
+	groupRules, errs := ParseTokenGroupRules(src.list("TOKEN_GROUP_RULES", ""))
+	src.errs = append(src.errs, errs...)
+	contextBudgets, errs := ParseContextBudgets(src.list("CONTEXT_BUDGETS", ""))
+	src.errs = append(src.errs, errs...)
+
+	return &Reloadable{
+		ProxyURL: src.str("PROXY_URL", ""), // 代理URL配置
+		LogLevel: level,
+
+		Models:               src.list("MODELS", defaultModels),
+		ChatUsageLimit:       src.integer("CHAT_USAGE_LIMIT", 3000),
+		AgentUsageLimit:      src.integer("AGENT_USAGE_LIMIT", 50),
+		TokenRequestInterval: src.duration("TOKEN_REQUEST_INTERVAL", 3*time.Second),
+
+		ChatGuidelines:     src.str("CHAT_GUIDELINES", defaultChatGuidelines),
+		AgentGuidelines:    src.str("AGENT_GUIDELINES", defaultAgentGuidelines),
+		FallbackGuidelines: src.str("FALLBACK_GUIDELINES", defaultFallbackGuidelines),
+
+		TokenGroupRules:  groupRules,
+		TokenAffinityTTL: src.duration("TOKEN_AFFINITY_TTL", 30*time.Minute),
+
+		ConversationTTL:      src.duration("CONVERSATION_TTL", 7*24*time.Hour),
+		ConversationMaxTurns: src.integer("CONVERSATION_MAX_TURNS", 100),
+
+		DefaultContextBudget: src.integer("CONTEXT_BUDGET", 100000),
+		ContextBudgets:       contextBudgets,
+		ContextTruncation:    strings.ToLower(src.str("CONTEXT_TRUNCATION", ContextTruncationDrop)),
+
+		ResponseCacheTTL:        src.duration("RESPONSE_CACHE_TTL", 0),
+		ResponseCacheMaxEntries: src.integer("RESPONSE_CACHE_MAX_ENTRIES", 1000),
+		ResponseCacheMaxBytes:   src.integer("RESPONSE_CACHE_MAX_BYTES", 256*1024),
+
+		RequestCoalescing: src.boolean("REQUEST_COALESCING", false),
+	}
+}
+
+// validate 校验可热更新配置，返回所有错误
+func (r *Reloadable) validate() []string {
+	var errs []string
+
+	if r.ProxyURL != "" {
+		parsed, err := url.Parse(r.ProxyURL)
+		if err != nil || parsed.Host == "" ||
+			(parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "socks5") {
+			errs = append(errs, "PROXY_URL 必须为 http、https 或 socks5 地址")
+		}
+	}
+	if _, err := logrus.ParseLevel(r.LogLevel); err != nil {
+		errs = append(errs, fmt.Sprintf("LOG_LEVEL 无效: %q", r.LogLevel))
+	}
+	if len(r.Models) == 0 {
+		errs = append(errs, "MODELS 不能为空")
+	}
+	if r.ChatUsageLimit < 0 {
+		errs = append(errs, "CHAT_USAGE_LIMIT 不能为负数")
+	}
+	if r.AgentUsageLimit < 0 {
+		errs = append(errs, "AGENT_USAGE_LIMIT 不能为负数")
+	}
+	if r.TokenRequestInterval < 0 {
+		errs = append(errs, "TOKEN_REQUEST_INTERVAL 不能为负数")
+	}
+	if r.TokenAffinityTTL < 0 {
+		errs = append(errs, "TOKEN_AFFINITY_TTL 不能为负数")
+	}
+	if r.ConversationTTL < 0 {
+		errs = append(errs, "CONVERSATION_TTL 不能为负数")
+	}
+	if r.ConversationMaxTurns < 0 {
+		errs = append(errs, "CONVERSATION_MAX_TURNS 不能为负数")
+	}
+	if r.DefaultContextBudget < 0 {
+		errs = append(errs, "CONTEXT_BUDGET 不能为负数")
+	}
+	if r.ContextTruncation != ContextTruncationDrop && r.ContextTruncation != ContextTruncationSummarize {
+		errs = append(errs, fmt.Sprintf("CONTEXT_TRUNCATION 必须为 %s 或 %s", ContextTruncationDrop, ContextTruncationSummarize))
+	}
+	if r.ResponseCacheTTL < 0 {
+		errs = append(errs, "RESPONSE_CACHE_TTL 不能为负数")
+	}
+	if r.ResponseCacheMaxEntries <= 0 {
+		errs = append(errs, "RESPONSE_CACHE_MAX_ENTRIES 必须大于0")
+	}
+	if r.ResponseCacheMaxBytes <= 0 {
+		errs = append(errs, "RESPONSE_CACHE_MAX_BYTES 必须大于0")
+	}
+	return errs
+}
+
+var reloadMu sync.Mutex
+
+// Reload 重新读取配置文件和环境变量，只更新可热更新的配置
+// 校验失败时保留当前配置；其他配置的修改需要重启后生效
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, reloadable, err := LoadConfig(AppConfig.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if err := logger.SetLevel(reloadable.LogLevel); err != nil {
+		return err
+	}
+	logger.RegisterSecret(reloadable.ProxyURL)
+	current.Store(reloadable)
+
+	// 提示需要重启才能生效的配置
+	cfg.ConfigFile = AppConfig.ConfigFile
+	if !reflect.DeepEqual(cfg, AppConfig) {
+		logger.Log.Warn("配置文件中部分非热更新配置已修改，需要重启服务后生效")
+	}
+
+	logger.Log.WithFields(logrus.Fields{
+		"models":    strings.Join(reloadable.Models, ","),
+		"log_level": reloadable.LogLevel,
+		"proxy_url": logger.RedactURL(reloadable.ProxyURL),
+	}).Info("配置已热更新")
+	return nil
+}
+
+// WatchConfig 在收到SIGHUP信号或配置文件修改时热更新配置
+func WatchConfig() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	var ticker <-chan time.Time
+	var lastModTime time.Time
+	if AppConfig.ConfigFile != "" {
+		if info, err := os.Stat(AppConfig.ConfigFile); err == nil {
+			lastModTime = info.ModTime()
+		}
+		ticker = time.NewTicker(configWatchInterval).C
+	}
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+				logger.Log.Info("收到SIGHUP信号，重新加载配置")
+			case <-ticker:
+				info, err := os.Stat(AppConfig.ConfigFile)
+				if err != nil || !info.ModTime().After(lastModTime) {
+					continue
+				}
+				lastModTime = info.ModTime()
+				logger.Log.Info("配置文件已修改，重新加载配置")
+			}
+
+			if err := Reload(); err != nil {
+				logger.Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("配置热更新失败，继续使用当前配置")
+			}
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// 配置项的读取顺序：环境变量 > 配置文件 > 默认值
+// 配置文件中的键名与环境变量相同，不区分大小写，例如 redis_conn_string、health_check_interval
+
+// source 读取配置项并收集格式错误
+type source struct {
+	file map[string]string
+	errs []string
+}
+
+// lookup 读取配置项原始值，未配置时返回空字符串
+func (s *source) lookup(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return s.file[key]
+}
+
+func (s *source) str(key, defaultValue string) string {
+	if value := s.lookup(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (s *source) boolean(key string, defaultValue bool) bool {
+	value := s.lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Sprintf("%s 必须为 true 或 false，当前为 %q", key, value))
+		return defaultValue
+	}
+	return parsed
+}
+
+func (s *source) integer(key string, defaultValue int) int {
+	value := s.lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Sprintf("%s 必须为整数，当前为 %q", key, value))
+		return defaultValue
+	}
+	return parsed
+}
+
+// duration 读取时长配置，支持 "30m"、"1h" 等格式
+func (s *source) duration(key string, defaultValue time.Duration) time.Duration {
+	value := s.lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Sprintf("%s 必须为时长（如 30s、5m、1h），当前为 %q", key, value))
+		return defaultValue
+	}
+	return parsed
+}
+
+// list 读取逗号分隔的配置项，配置文件中也可以使用数组
+func (s *source) list(key, defaultValue string) []string {
+	return splitList(s.str(key, defaultValue))
+}
+
+// splitList 解析逗号分隔的配置项
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// loadConfigFile 读取YAML或TOML配置文件，返回以大写键名索引的配置项
+func loadConfigFile(path string) (map[string]string, error) {
+	values := make(map[string]string)
+	if path == "" {
+		return values, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
+	}
+
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("不支持的配置文件格式 %s，仅支持 .yaml、.yml 和 .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析配置文件 %s 失败: %v", path, err)
+	}
+
+	var unknown []string
+	for key, value := range raw {
+		name := strings.ToUpper(key)
+		if !isKnownConfigKey(name) {
+			unknown = append(unknown, key)
+			continue
+		}
+		formatted, err := formatConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("配置项 %s %v", key, err)
+		}
+		values[name] = formatted
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("配置文件 %s 包含未知的配置项: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return values, nil
+}
+
+// formatConfigValue 将配置文件中的值转换为与环境变量一致的字符串格式
+func formatConfigValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			formatted, err := formatConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, formatted)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("的值类型不受支持: %T", value)
+	}
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourcePrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   string
+		file  string
+		want  string
+		unset bool
+	}{
+		{"env over file", "from-env", "from-file", "from-env", false},
+		{"file over default", "", "from-file", "from-file", false},
+		{"default", "", "", "default", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_SOURCE_KEY", tt.env)
+			src := &source{file: map[string]string{}}
+			if !tt.unset {
+				src.file["TEST_SOURCE_KEY"] = tt.file
+			}
+			if got := src.str("TEST_SOURCE_KEY", "default"); got != tt.want {
+				t.Errorf("str() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceParsing(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		read    func(src *source) interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"bool", "true", func(s *source) interface{} { return s.boolean("KEY", false) }, true, false},
+		{"bool invalid", "yes", func(s *source) interface{} { return s.boolean("KEY", false) }, false, true},
+		{"int", "42", func(s *source) interface{} { return s.integer("KEY", 1) }, 42, false},
+		{"int invalid", "4x", func(s *source) interface{} { return s.integer("KEY", 1) }, 1, true},
+		{"duration", "5m", func(s *source) interface{} { return s.duration("KEY", time.Second) }, 5 * time.Minute, false},
+		{"duration invalid", "5", func(s *source) interface{} { return s.duration("KEY", time.Second) }, time.Second, true},
+		{"duration empty", "", func(s *source) interface{} { return s.duration("KEY", time.Second) }, time.Second, false},
+		{"list", " a, ,b ", func(s *source) interface{} { return strings.Join(s.list("KEY", ""), "|") }, "a|b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &source{file: map[string]string{"KEY": tt.value}}
+			if got := tt.read(src); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if gotErr := len(src.errs) > 0; gotErr != tt.wantErr {
+				t.Errorf("errs = %v, wantErr %v", src.errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "yaml",
+			file:    "config.yaml",
+			content: "port: 8080\nlog_stdout: true\nchat_guidelines: hi\ntenant_candidates:\n  - https://a/\n  - https://b/\n",
+			want:    map[string]string{"PORT": "8080", "LOG_STDOUT": "true", "CHAT_GUIDELINES": "hi", "TENANT_CANDIDATES": "https://a/,https://b/"},
+		},
+		{
+			name:    "toml",
+			file:    "config.toml",
+			content: "PORT = 8080\nhealth_check_interval = \"5m\"\n",
+			want:    map[string]string{"PORT": "8080", "HEALTH_CHECK_INTERVAL": "5m"},
+		},
+		{"unknown key", "config.yaml", "port: 1\nno_such_key: 1\n", nil, "no_such_key"},
+		{"unsupported value", "config.yaml", "port:\n  a: 1\n", nil, "port"},
+		{"unsupported format", "config.json", "{}", nil, ".json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadConfigFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Errorf("%s = %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() Config {
+		return Config{
+			Port:                   27080,
+			RedisConnString:        "redis://localhost:6379",
+			AccessPwd:              "pwd",
+			CodingMode:             "false",
+			TokenEncryptionKey:     "key",
+			LogFormat:              "text",
+			TenantCandidates:       []string{"https://d1.api.augmentcode.com/"},
+			HealthCheckConcurrency: 1,
+			TenantProbeConcurrency: 1,
+			RequestLogMaxEntries:   1,
+			RequestLogRetention:    time.Hour,
+
+			AnalyticsHourlyRetention: time.Hour,
+			AnalyticsDailyRetention:  time.Hour,
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		wantErr string
+	}{
+		{"valid", func(cfg *Config) {}, ""},
+		{"port", func(cfg *Config) { cfg.Port = 0 }, "PORT"},
+		{"redis missing", func(cfg *Config) { cfg.RedisConnString = "" }, "REDIS_CONN_STRING"},
+		{"redis invalid", func(cfg *Config) { cfg.RedisConnString = "mysql://x" }, "REDIS_CONN_STRING"},
+		{"access pwd", func(cfg *Config) { cfg.AccessPwd = "" }, "ACCESS_PWD"},
+		{"encryption key", func(cfg *Config) { cfg.TokenEncryptionKey = "" }, "TOKEN_ENCRYPTION_KEY"},
+		{"plaintext allowed", func(cfg *Config) { cfg.TokenEncryptionKey = ""; cfg.AllowPlaintextTokens = true }, ""},
+		{"coding mode", func(cfg *Config) { cfg.CodingMode = "true" }, "CODING_TOKEN"},
+		{"log format", func(cfg *Config) { cfg.LogFormat = "xml" }, "LOG_FORMAT"},
+		{"tenant candidate", func(cfg *Config) { cfg.TenantCandidates = []string{"ftp://x"} }, "TENANT_CANDIDATES"},
+		{"concurrency", func(cfg *Config) { cfg.HealthCheckConcurrency = 0 }, "HEALTH_CHECK_CONCURRENCY"},
+		{"negative interval", func(cfg *Config) { cfg.HealthCheckInterval = -time.Second }, "HEALTH_CHECK_INTERVAL"},
+		{"retention", func(cfg *Config) { cfg.RequestLogRetention = 0 }, "REQUEST_LOG_RETENTION"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(&cfg)
+			errs := cfg.validate()
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0], tt.wantErr) {
+				t.Errorf("errors = %v, want one containing %q", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTenantCandidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"plain", "https://a, https://b/", []string{"https://a/", "https://b/"}, false},
+		{"range", "https://d{1..3}.x/", []string{"https://d1.x/", "https://d2.x/", "https://d3.x/"}, false},
+		{"descending", "https://d{2..1}.x/", []string{"https://d2.x/", "https://d1.x/"}, false},
+		{"dedupe", "https://d{1..2}.x/,https://d1.x/", []string{"https://d1.x/", "https://d2.x/"}, false},
+		{"limit", "https://d{1..1000}.x/", nil, false},
+		{"too large", "https://d{1..1001}.x/,https://a/", []string{"https://a/"}, true},
+		{"too large product", "https://d{1..100}.{1..11}.x/", []string{}, true},
+		{"overflow", "https://d{1..99999999999999999999}.x/", []string{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := ParseTenantCandidates(tt.value)
+			if gotErr := len(errs) > 0; gotErr != tt.wantErr {
+				t.Fatalf("errs = %v, wantErr %v", errs, tt.wantErr)
+			}
+			if tt.want == nil {
+				if len(got) != maxTenantPatternExpansion {
+					t.Errorf("got %d candidates, want %d", len(got), maxTenantPatternExpansion)
+				}
+				return
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
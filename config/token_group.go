@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// TokenGroupAll 表示不限分组，使用全部token
+const TokenGroupAll = "*"
+
+// 分组规则的匹配条件
+const (
+	TokenGroupMatchKey    = "key"    // 按API密钥匹配，值为密钥原文或指纹
+	TokenGroupMatchModel  = "model"  // 按模型名称匹配，不区分大小写
+	TokenGroupMatchHeader = "header" // 按请求头匹配
+)
+
+// TokenGroupRule 将请求路由到指定token分组的规则
+// 格式为 <条件>=<分组>[><备用分组>...]，例如：
+//
+//	model:*-agent=agent-capable>paid
+//	key:fp:1a2b3c4d=team-a>*
+//	header:X-Team:a=team-a
+//
+// 分组对应token的标签，前面的分组没有可用token时依次尝试后面的分组，* 表示全部token
+type TokenGroupRule struct {
+	Match  string
+	Header string // 按请求头匹配时的请求头名称
+	Value  string // 匹配的值，支持 * 通配
+	Groups []string
+}
+
+// MatchValue 判断值是否满足规则，支持 * 通配
+func (r TokenGroupRule) MatchValue(value string) bool {
+	if value == "" {
+		return false
+	}
+	pattern := r.Value
+	if r.Match == TokenGroupMatchModel {
+		pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// String 返回规则的配置格式
+func (r TokenGroupRule) String() string {
+	condition := r.Match + ":" + r.Value
+	if r.Match == TokenGroupMatchHeader {
+		condition = r.Match + ":" + r.Header + ":" + r.Value
+	}
+	return condition + "=" + strings.Join(r.Groups, ">")
+}
+
+// ParseTokenGroupRules 解析分组规则，返回所有格式错误
+func ParseTokenGroupRules(items []string) ([]TokenGroupRule, []string) {
+	rules := make([]TokenGroupRule, 0, len(items))
+	var errs []string
+	for _, item := range items {
+		rule, err := parseTokenGroupRule(item)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("TOKEN_GROUP_RULES 规则 %q 无效: %v", item, err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, errs
+}
+
+func parseTokenGroupRule(item string) (TokenGroupRule, error) {
+	index := strings.LastIndex(item, "=")
+	if index < 0 {
+		return TokenGroupRule{}, fmt.Errorf("缺少 =")
+	}
+	condition, groups := strings.TrimSpace(item[:index]), strings.TrimSpace(item[index+1:])
+
+	var rule TokenGroupRule
+	for _, group := range strings.Split(groups, ">") {
+		if group = strings.TrimSpace(group); group != "" {
+			rule.Groups = append(rule.Groups, group)
+		}
+	}
+	if len(rule.Groups) == 0 {
+		return TokenGroupRule{}, fmt.Errorf("未指定分组")
+	}
+
+	parts := strings.SplitN(condition, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return TokenGroupRule{}, fmt.Errorf("条件必须为 key:<值>、model:<值> 或 header:<名称>:<值>")
+	}
+	rule.Match, rule.Value = strings.ToLower(parts[0]), parts[1]
+
+	switch rule.Match {
+	case TokenGroupMatchKey, TokenGroupMatchModel:
+	case TokenGroupMatchHeader:
+		header := strings.SplitN(rule.Value, ":", 2)
+		if len(header) != 2 || header[0] == "" || header[1] == "" {
+			return TokenGroupRule{}, fmt.Errorf("请求头条件必须为 header:<名称>:<值>")
+		}
+		rule.Header, rule.Value = header[0], header[1]
+	default:
+		return TokenGroupRule{}, fmt.Errorf("未知的条件类型 %s", parts[0])
+	}
+
+	if _, err := path.Match(rule.Value, ""); err != nil {
+		return TokenGroupRule{}, fmt.Errorf("通配符格式错误")
+	}
+	return rule, nil
+}
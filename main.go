@@ -5,15 +5,21 @@ import (
 	"augment2api/config"
 	"augment2api/middleware"
 	"augment2api/pkg/logger"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -54,7 +60,7 @@ func createOAuthState() OAuthState {
 	codeVerifierBytes := make([]byte, 32)
 	_, err := rand.Read(codeVerifierBytes)
 	if err != nil {
-		log.Fatalf("生成随机字节失败: %v", err)
+		logger.Log.Fatalf("生成随机字节失败: %v", err)
 	}
 
 	codeVerifier := base64URLEncode(codeVerifierBytes)
@@ -63,7 +69,7 @@ func createOAuthState() OAuthState {
 	stateBytes := make([]byte, 8)
 	_, err = rand.Read(stateBytes)
 	if err != nil {
-		log.Fatalf("生成随机状态失败: %v", err)
+		logger.Log.Fatalf("生成随机状态失败: %v", err)
 	}
 	state := base64URLEncode(stateBytes)
 
@@ -124,7 +130,10 @@ func getAccessToken(tenantURL, codeVerifier, code string) (string, error) {
 
 // 初始化路由
 func setupRouter() *gin.Engine {
-	r := gin.Default()
+	r := gin.New()
+
+	// panic恢复、请求关联ID和访问日志
+	r.Use(middleware.Recovery(), middleware.RequestID(), middleware.AccessLog())
 
 	// 跨域
 	r.Use(middleware.CORS())
@@ -132,6 +141,10 @@ func setupRouter() *gin.Engine {
 	// 初始化OAuth状态
 	globalOAuthState = createOAuthState()
 
+	// 存活和就绪检查，供容器编排探测
+	r.GET("/healthz", api.HealthzHandler)
+	r.GET("/readyz", api.ReadyzHandler)
+
 	// 静态文件服务
 	r.Static("/static", "./static")
 	r.LoadHTMLGlob("templates/*")
@@ -186,14 +199,36 @@ func setupRouter() *gin.Engine {
 	// 获取token - 需要会话验证
 	r.GET("/api/tokens", api.AuthTokenMiddleware(), api.GetRedisTokenHandler)
 
+	// 导出、导入token - 需要会话验证
+	r.GET("/api/tokens/export", api.AuthTokenMiddleware(), api.ExportTokensHandler)
+	r.POST("/api/tokens/import", api.AuthTokenMiddleware(), api.ImportTokensHandler)
+
 	// 删除token - 需要会话验证
 	r.DELETE("/api/token/:token", api.AuthTokenMiddleware(), api.DeleteTokenHandler)
 
 	// 更新token备注 - 需要会话验证
 	r.PUT("/api/token/:token/remark", api.AuthTokenMiddleware(), api.UpdateTokenRemark)
 
+	// 更新token状态（启用/禁用/隔离） - 需要会话验证
+	r.PUT("/api/token/:token/status", api.AuthTokenMiddleware(), api.UpdateTokenStatusHandler)
+
+	// 获取token状态变更历史 - 需要会话验证
+	r.GET("/api/token/:token/status", api.AuthTokenMiddleware(), api.GetTokenStatusHistoryHandler)
+
+	// 检测单个token - 需要会话验证
+	r.POST("/api/token/:token/check", api.AuthTokenMiddleware(), api.CheckTokenHandler)
+
 	// 批量检测token - 需要会话验证
-	r.GET("/api/check-tokens", api.AuthTokenMiddleware(), api.CheckAllTokensHandler)
+	r.POST("/api/check-tokens", api.AuthTokenMiddleware(), api.CreateCheckJobHandler)
+	r.GET("/api/check-tokens/:id", api.AuthTokenMiddleware(), api.GetCheckJobHandler)
+	r.GET("/api/check-tokens/:id/events", api.AuthTokenMiddleware(), api.CheckJobEventsHandler)
+	r.DELETE("/api/check-tokens/:id", api.AuthTokenMiddleware(), api.CancelCheckJobHandler)
+
+	// 查询请求日志 - 需要会话验证
+	r.GET("/api/request-logs", api.AuthTokenMiddleware(), api.GetRequestLogsHandler)
+
+	// 查询使用统计 - 需要会话验证
+	r.GET("/api/analytics", api.AuthTokenMiddleware(), api.GetUsageAnalyticsHandler)
 
 	// 回调端点，用于处理授权码 - 需要会话验证
 	r.POST("/callback", api.AuthTokenMiddleware(), func(c *gin.Context) {
@@ -208,12 +243,27 @@ func setupRouter() *gin.Engine {
 	{
 		// OpenAI兼容的聊天端点
 		chatGroup := authGroup.Group("/")
-		// 并发控制
-		chatGroup.Use(middleware.TokenConcurrencyMiddleware())
+		// 请求日志、回复缓存、请求合并、并发控制，命中缓存或合并到相同请求时不占用token
+		chatGroup.Use(api.RequestLogMiddleware(), api.ResponseCacheMiddleware(), api.RequestCoalescingMiddleware(),
+			middleware.TokenConcurrencyMiddleware())
+		{
+			for _, route := range api.ChatCompletionsRoutes {
+				chatGroup.POST(route, api.ChatCompletionsHandler)
+			}
+			chatGroup.POST("/v1/completions", api.CompletionsHandler)
+		}
+
+		// 服务端会话，客户端每轮只需发送新消息
+		conversationGroup := authGroup.Group("/v1/conversations")
 		{
-			chatGroup.POST("/v1/chat/completions", api.ChatCompletionsHandler)
-			chatGroup.POST("/v1", api.ChatCompletionsHandler)
-			chatGroup.POST("/v1/chat", api.ChatCompletionsHandler)
+			conversationGroup.POST("", api.CreateConversationHandler)
+			conversationGroup.GET("", api.ListConversationsHandler)
+			conversationGroup.GET("/:id", api.GetConversationHandler)
+			conversationGroup.DELETE("/:id", api.DeleteConversationHandler)
+			conversationGroup.POST("/:id/fork", api.ForkConversationHandler)
+			// 先加载会话再选择token，按会话绑定token
+			conversationGroup.POST("/:id/messages", api.RequestLogMiddleware(), api.ConversationMiddleware(),
+				middleware.TokenConcurrencyMiddleware(), api.ConversationMessageHandler)
 		}
 
 		authGroup.GET("/v1/models", api.ModelsHandler)
@@ -249,15 +299,40 @@ func main() {
 	// 设置 Gin 为发布模式
 	gin.SetMode(gin.ReleaseMode)
 
+	// 命令行参数，配置文件路径也可以通过 CONFIG_FILE 环境变量指定
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "配置文件路径，支持 YAML 和 TOML")
+	flag.Usage = usage
+	flag.Parse()
+
 	// 初始化日志
 	logger.Init()
 
+	// 未指定命令时启动服务
+	args := flag.Args()
+	if len(args) == 0 || args[0] == "serve" {
+		serve(*configFile)
+		return
+	}
+
+	err := runCommand(*configFile, args)
+	config.CloseRedisClient()
+	if err != nil {
+		if !errors.Is(err, errUsage) {
+			fmt.Fprintln(os.Stderr, "错误:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// serve 初始化配置和Redis后启动HTTP服务，收到停止信号后优雅退出
+func serve(configFile string) {
 	// 初始化配置
-	err := config.InitConfig()
+	err := config.InitConfig(configFile)
 	if err != nil {
 		logger.Log.Fatalln("failed to initialize config: " + err.Error())
 		return
 	}
+	config.PrintSummary()
 
 	// 初始化Redis
 	err = config.InitRedisClient()
@@ -265,24 +340,77 @@ func main() {
 		logger.Log.Fatalln("failed to initialize Redis: " + err.Error())
 	}
 
-	// token备注字段迁移
-	err = api.MigrateTokensRemark()
+	// 执行未完成的Redis数据迁移
+	err = api.RunMigrations(false)
 	if err != nil {
-		logger.Log.Error("Token备注字段迁移失败: %v", err)
+		logger.Log.Fatalln("数据迁移失败: " + err.Error())
 	}
 
 	// 启动token使用次数重置调度器
-	go api.StartTokenUsageResetScheduler()
+	api.StartTokenUsageResetScheduler()
+
+	// 启动token后台健康检查调度器
+	api.StartTokenHealthCheckScheduler()
+
+	// SIGHUP或配置文件修改时热更新配置
+	config.WatchConfig()
 
 	r := setupRouter()
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(config.AppConfig.Port),
+		Handler: r,
+	}
 
 	// 启动服务器
-	if err := r.Run(":27080"); err != nil {
-		logger.Log.Fatalf("启动服务失败: %v", err)
-	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Log.Fatalf("启动服务失败: %v", err)
+		}
+	}()
 
 	logger.Log.WithFields(map[string]interface{}{
-		"port": 27080,
+		"port": config.AppConfig.Port,
 		"mode": gin.Mode(),
 	}).Info("Augment2API 服务启动成功")
+
+	// 等待停止信号
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+
+	logger.Log.WithFields(map[string]interface{}{
+		"signal":  sig.String(),
+		"timeout": config.AppConfig.ShutdownTimeout.String(),
+	}).Info("开始停止服务，等待进行中的请求完成")
+
+	shutdown(srv)
+}
+
+// shutdown 停止接收新请求，等待进行中的请求完成后释放token并关闭Redis
+func shutdown(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.AppConfig.ShutdownTimeout)
+	defer cancel()
+
+	// 取消批量检测任务
+	api.CancelCheckJobs()
+
+	// 停止接收新请求，等待流式响应结束
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Log.Warnf("等待请求完成超时，强制断开剩余连接: %v", err)
+		srv.Close()
+	}
+
+	// 停止定时任务
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stopCancel()
+	api.StopSchedulers(stopCtx)
+
+	// 释放仍被占用的token
+	api.ReleaseAllTokenLeases()
+
+	if err := config.CloseRedisClient(); err != nil {
+		logger.Log.Errorf("关闭Redis连接失败: %v", err)
+	}
+
+	logger.Log.Info("Augment2API 服务已停止")
 }
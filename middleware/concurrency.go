@@ -6,38 +6,29 @@ import (
 	"augment2api/pkg/logger"
 	"net/http"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
-// 全局锁映射，用于控制每个 token 的并发请求
-var (
-	tokenLocks      = make(map[string]*sync.Mutex)
-	tokenLocksGuard = sync.Mutex{}
-)
-
-// getTokenLock 获取指定 token 的锁
-func getTokenLock(token string) *sync.Mutex {
-	tokenLocksGuard.Lock()
-	defer tokenLocksGuard.Unlock()
-
-	if lock, exists := tokenLocks[token]; exists {
-		return lock
+// affinityResult 返回会话绑定的命中情况，用于日志
+func affinityResult(preferred, tokenID string) string {
+	switch {
+	case preferred == "":
+		return "none"
+	case preferred == tokenID:
+		return "hit"
+	default:
+		return "miss"
 	}
-
-	lock := &sync.Mutex{}
-	tokenLocks[token] = lock
-	return lock
 }
 
 // TokenConcurrencyMiddleware 控制Redis中token的使用频率
 func TokenConcurrencyMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 只对聊天完成请求进行并发控制
-		if !strings.HasSuffix(c.Request.URL.Path, "/chat/completions") {
+		// 只对聊天完成、文本补全和会话消息请求进行并发控制
+		path := c.Request.URL.Path
+		if !strings.HasSuffix(path, "/completions") && !strings.HasSuffix(path, "/messages") {
 			c.Next()
 			return
 		}
@@ -47,50 +38,64 @@ func TokenConcurrencyMiddleware() gin.HandlerFunc {
 			token := config.AppConfig.CodingToken
 			tenantURL := config.AppConfig.TenantURL
 			c.Set("token", token)
+			c.Set("token_id", api.TokenID(token))
 			c.Set("tenant_url", tenantURL)
 			c.Next()
 		}
 
-		// 获取一个可用的token
-		token, tenantURL := api.GetAvailableToken()
-		if token == "No token" {
+		// 按分组规则获取一个可用的token，同一会话优先使用上次的token
+		groups := api.TokenGroupsFor(c)
+		conversationKey := api.ConversationKey(c)
+		preferred := api.AffinityToken(conversationKey)
+		tokenID, tenantURL, group := api.GetAvailableToken(groups, preferred)
+		if tokenID == "No token" {
 			c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前无可用token，请在页面添加"})
 			c.Abort()
 			return
 		}
-		if token == "No available token" || tenantURL == "" {
+		if tokenID == "No available token" || tenantURL == "" {
+			logger.WithContext(c).WithFields(logrus.Fields{
+				"token_groups": strings.Join(groups, ">"),
+			}).Warn("没有可用的token")
 			c.JSON(http.StatusTooManyRequests, gin.H{"error": "当前请求过多，请稍后再试"})
 			c.Abort()
 			return
 		}
 
-		// 获取该token的锁
-		lock := getTokenLock(token)
-
-		// 尝试获取锁，会阻塞直到获取到锁
-		lock.Lock()
-
-		// 更新请求状态
-		err := api.SetTokenRequestStatus(token, api.TokenRequestStatus{
-			InProgress:    true,
-			LastRequestAt: time.Now(),
-		})
+		// 解密获取原始token
+		token, err := api.GetTokenSecret(tokenID)
+		if err != nil {
+			logger.WithContext(c).WithFields(logrus.Fields{
+				"token_id": tokenID,
+				"error":    err.Error(),
+			}).Error("读取token失败")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取token失败"})
+			c.Abort()
+			return
+		}
 
+		// 占用token，会阻塞直到该token的上一个请求结束
+		lock, err := api.AcquireToken(tokenID)
 		if err != nil {
-			lock.Unlock()
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新token请求状态失败"})
 			c.Abort()
 			return
 		}
+		api.SetTokenAffinity(conversationKey, tokenID)
 
-		logger.Log.WithFields(logrus.Fields{
-			"token": token,
+		logger.WithContext(c).WithFields(logrus.Fields{
+			"token_id":          tokenID,
+			"token_fingerprint": logger.Fingerprint(token),
+			"token_group":       group,
+			"token_affinity":    affinityResult(preferred, tokenID),
 		}).Info("本次请求使用的token: ")
 
 		// 在请求完成后释放锁
 		c.Set("token_lock", lock)
 		c.Set("token", token)
+		c.Set("token_id", tokenID)
 		c.Set("tenant_url", tenantURL)
+		c.Set("token_group", group)
 
 		c.Next()
 	}
@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"augment2api/api"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -11,5 +13,6 @@ func CORS() gin.HandlerFunc {
 	config.AllowCredentials = true
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"*"}
+	config.ExposeHeaders = []string{RequestIDHeader, api.ConversationHeader, api.ContextTruncatedHeader, api.ContextSummarizedHeader, api.ResponseCacheHeader}
 	return cors.New(config)
 }
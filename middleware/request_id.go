@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"augment2api/pkg/logger"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader 请求关联ID的请求头和响应头
+const RequestIDHeader = "X-Request-ID"
+
+// ClientRequestIDKey 客户端传入的关联ID在gin上下文中的键名
+const ClientRequestIDKey = "client_request_id"
+
+// 客户端传入的关联ID只接受安全字符，避免日志注入
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+// RequestID 为每个请求生成关联ID，写入响应头并附加到请求期间的日志中，同时作为上游请求的x-request-id
+// 客户端传入的X-Request-ID可能在多次请求中重复，不作为关联ID，只记录在访问日志中
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := uuid.New().String()
+		if clientID := c.GetHeader(RequestIDHeader); validRequestID.MatchString(clientID) {
+			c.Set(ClientRequestIDKey, clientID)
+		}
+
+		c.Set(logger.RequestIDKey, requestID)
+		c.Request = c.Request.WithContext(logger.ContextWithRequestID(c.Request.Context(), requestID))
+		c.Header(RequestIDHeader, requestID)
+
+		c.Next()
+	}
+}
+
+// AccessLog 通过统一的日志记录请求访问日志
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		entry := logger.WithContext(c).WithFields(logrus.Fields{
+			"method":     c.Request.Method,
+			"path":       path,
+			"status":     c.Writer.Status(),
+			"latency_ms": time.Since(start).Milliseconds(),
+			"client_ip":  c.ClientIP(),
+		})
+		if clientID := c.GetString(ClientRequestIDKey); clientID != "" {
+			entry = entry.WithField(ClientRequestIDKey, clientID)
+		}
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("error", c.Errors.String())
+		}
+
+		switch status := c.Writer.Status(); {
+		case path == "/healthz" || path == "/readyz":
+			// 探测请求频繁，只在调试级别记录
+			entry.Debug("请求处理完成")
+		case status >= 500:
+			entry.Error("请求处理完成")
+		case status >= 400:
+			entry.Warn("请求处理完成")
+		default:
+			entry.Info("请求处理完成")
+		}
+	}
+}
+
+// Recovery 捕获请求处理中的panic并记录到统一日志
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(logger.Log.WriterLevel(logrus.ErrorLevel), func(c *gin.Context, err any) {
+		logger.WithContext(c).WithFields(logrus.Fields{
+			"error": err,
+			"path":  c.Request.URL.Path,
+		}).Error("请求处理时发生panic")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "服务器内部错误"})
+	})
+}
@@ -0,0 +1,53 @@
+package logger
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDKey 请求关联ID在gin上下文中的键名
+const RequestIDKey = "request_id"
+
+type requestIDContextKey struct{}
+
+// ContextWithRequestID 将请求关联ID写入context
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// RequestIDFromContext 读取context中的请求关联ID，兼容gin.Context
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		return id
+	}
+	if id, ok := ctx.Value(RequestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// WithContext 返回携带请求上下文的日志条目，输出时自动附加请求关联ID
+func WithContext(ctx context.Context) *logrus.Entry {
+	return Log.WithContext(ctx)
+}
+
+// RequestIDHook 为请求处理过程中产生的日志附加请求关联ID
+type RequestIDHook struct{}
+
+func (h *RequestIDHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *RequestIDHook) Fire(entry *logrus.Entry) error {
+	if _, exists := entry.Data[RequestIDKey]; exists {
+		return nil
+	}
+	if id := RequestIDFromContext(entry.Context); id != "" {
+		entry.Data[RequestIDKey] = id
+	}
+	return nil
+}
@@ -2,10 +2,14 @@ package logger
 
 import (
 	"fmt"
-	"github.com/sirupsen/logrus"
+	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // CustomFormatter 自定义格式化器
@@ -20,12 +24,23 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	timestamp := localTime.Format(f.TimestampFormat)
 	level := strings.ToUpper(entry.Level.String())
 
-	// 将所有字段合并到一个字符串中，添加适当的分隔
+	// 将所有字段合并到一个字符串中，按字段名排序保证输出稳定，请求关联ID放在最前
 	var fieldsStr string
 	if len(entry.Data) > 0 {
-		pairs := make([]string, 0, len(entry.Data))
-		for k, v := range entry.Data {
-			pairs = append(pairs, fmt.Sprintf("%s: %v", k, v))
+		keys := make([]string, 0, len(entry.Data))
+		for k := range entry.Data {
+			if k != RequestIDKey {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		if _, ok := entry.Data[RequestIDKey]; ok {
+			keys = append([]string{RequestIDKey}, keys...)
+		}
+
+		pairs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s: %v", k, entry.Data[k]))
 		}
 		fieldsStr = " | " + strings.Join(pairs, " | ")
 	}
@@ -41,21 +56,117 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return []byte(logMsg), nil
 }
 
+// Options 日志配置
+type Options struct {
+	Format     string // text 或 json
+	Level      string // debug、info、warn、error
+	File       string // 日志文件路径，为空时输出到标准输出
+	Stdout     bool   // 配置日志文件时是否同时输出到标准输出
+	MaxSizeMB  int    // 单个日志文件大小上限
+	MaxBackups int    // 保留的历史日志文件数量
+}
+
 var Log = logrus.New()
 
+// 当前打开的日志文件，重新配置时关闭
+var logFile *rotatingFile
+
+// OptionsFromEnv 从环境变量读取日志配置
+func OptionsFromEnv() Options {
+	opts := Options{
+		Format:     strings.ToLower(os.Getenv("LOG_FORMAT")),
+		Level:      strings.ToLower(os.Getenv("LOG_LEVEL")),
+		File:       os.Getenv("LOG_FILE"),
+		Stdout:     os.Getenv("LOG_STDOUT") == "true",
+		MaxSizeMB:  100,
+		MaxBackups: 5,
+	}
+	// 兼容旧的DEBUG开关
+	if opts.Level == "" && os.Getenv("DEBUG") == "true" {
+		opts.Level = "debug"
+	}
+	if value, err := strconv.Atoi(os.Getenv("LOG_MAX_SIZE_MB")); err == nil {
+		opts.MaxSizeMB = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("LOG_MAX_BACKUPS")); err == nil {
+		opts.MaxBackups = value
+	}
+	return opts
+}
+
 func Init() {
-	// 使用自定义格式化器
-	Log.SetFormatter(&CustomFormatter{
-		TimestampFormat: "2006-01-02 15:04:05",
-	})
+	// 输出前隐藏敏感信息，并附加请求关联ID
+	Log.AddHook(&RequestIDHook{})
+	Log.AddHook(&RedactHook{})
+
+	if err := Configure(OptionsFromEnv()); err != nil {
+		Log.SetOutput(os.Stdout)
+		Log.Errorf("日志配置无效，使用默认配置: %v", err)
+	}
+}
+
+// SetLevel 修改日志级别，用于配置热更新
+func SetLevel(level string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("无效的日志级别: %s", level)
+	}
+	Log.SetLevel(parsed)
+	return nil
+}
+
+// Configure 应用日志格式、级别和输出位置
+func Configure(opts Options) error {
+	level := logrus.InfoLevel
+	if opts.Level != "" {
+		parsed, err := logrus.ParseLevel(opts.Level)
+		if err != nil {
+			return fmt.Errorf("无效的日志级别: %s", opts.Level)
+		}
+		level = parsed
+	}
+
+	var formatter logrus.Formatter
+	switch opts.Format {
+	case "", "text":
+		// 使用自定义格式化器
+		formatter = &CustomFormatter{
+			TimestampFormat: "2006-01-02 15:04:05",
+		}
+	case "json":
+		formatter = &logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime: "time",
+				logrus.FieldKeyMsg:  "message",
+			},
+		}
+	default:
+		return fmt.Errorf("无效的日志格式: %s", opts.Format)
+	}
+
+	// 设置输出位置，默认输出到标准输出
+	var output io.Writer = os.Stdout
+	var file *rotatingFile
+	if opts.File != "" {
+		var err error
+		file, err = newRotatingFile(opts.File, opts.MaxSizeMB, opts.MaxBackups)
+		if err != nil {
+			return err
+		}
+		output = file
+		if opts.Stdout {
+			output = io.MultiWriter(file, os.Stdout)
+		}
+	}
 
-	// 设置输出到标准输出
-	Log.SetOutput(os.Stdout)
+	Log.SetFormatter(formatter)
+	Log.SetLevel(level)
+	Log.SetOutput(output)
 
-	// 设置日志级别
-	if os.Getenv("DEBUG") == "true" {
-		Log.SetLevel(logrus.DebugLevel)
-	} else {
-		Log.SetLevel(logrus.InfoLevel)
+	if logFile != nil {
+		logFile.Close()
 	}
+	logFile = file
+	return nil
 }
@@ -0,0 +1,178 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 密文格式: enc:<密钥ID>:<base64(nonce+密文)>
+// 未配置密钥时使用明文格式: plain:<原文>
+const (
+	encPrefix   = "enc:"
+	plainPrefix = "plain:"
+)
+
+type key struct {
+	id    string
+	aead  cipher.AEAD
+	idKey []byte // 计算不透明ID的HMAC密钥
+}
+
+var (
+	current *key
+	keys    = make(map[string]*key)
+	oldKeys []*key // 按配置顺序保存的旧密钥，用于查找旧密钥下的ID
+)
+
+// ErrUnknownKey 密文使用的密钥未配置
+var ErrUnknownKey = errors.New("未找到解密所需的密钥")
+
+// newKey 由任意长度的密钥字符串派生AES-256密钥
+func newKey(material string) (*key, error) {
+	sum := sha256.Sum256([]byte(material))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// 密钥ID取派生密钥哈希的前8位，用于识别密文由哪个密钥加密
+	idSum := sha256.Sum256(sum[:])
+	// ID使用独立派生的HMAC密钥，与加密密钥分离
+	idKey := sha256.Sum256([]byte("augment2api token id\x00" + material))
+	return &key{id: hex.EncodeToString(idSum[:4]), aead: aead, idKey: idKey[:]}, nil
+}
+
+// Init 设置当前加密密钥和用于解密的旧密钥
+// currentKey 为空时不加密，仅以明文格式存储，只应在显式允许明文存储时使用
+func Init(currentKey string, oldKeyMaterials []string) error {
+	current = nil
+	keys = make(map[string]*key)
+	oldKeys = nil
+
+	for _, material := range oldKeyMaterials {
+		if material == "" {
+			continue
+		}
+		k, err := newKey(material)
+		if err != nil {
+			return err
+		}
+		keys[k.id] = k
+		oldKeys = append(oldKeys, k)
+	}
+
+	if currentKey == "" {
+		return nil
+	}
+	k, err := newKey(currentKey)
+	if err != nil {
+		return err
+	}
+	keys[k.id] = k
+	current = k
+	return nil
+}
+
+// Enabled 是否配置了加密密钥
+func Enabled() bool {
+	return current != nil
+}
+
+// ID 计算原文的不透明ID，同一原文在同一密钥下始终得到相同的ID
+// 配置了密钥时使用HMAC-SHA256，没有密钥无法通过ID离线验证猜测的原文；未配置密钥时退化为SHA-256
+func ID(plaintext string) string {
+	if current == nil {
+		return unkeyedID(plaintext)
+	}
+	return current.hmacID(plaintext)
+}
+
+// LegacyIDs 返回原文在旧密钥和未配置密钥时对应的ID，用于查找尚未更新ID的数据
+func LegacyIDs(plaintext string) []string {
+	var ids []string
+	for _, k := range oldKeys {
+		ids = append(ids, k.hmacID(plaintext))
+	}
+	if current != nil {
+		ids = append(ids, unkeyedID(plaintext))
+	}
+	return ids
+}
+
+func (k *key) hmacID(plaintext string) string {
+	mac := hmac.New(sha256.New, k.idKey)
+	mac.Write([]byte(plaintext))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func unkeyedID(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Encrypt 使用当前密钥加密
+func Encrypt(plaintext string) (string, error) {
+	if current == nil {
+		return plainPrefix + plaintext, nil
+	}
+
+	nonce := make([]byte, current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := current.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encPrefix + current.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt 解密由 Encrypt 生成的字符串，支持任意已配置的密钥
+func Decrypt(value string) (string, error) {
+	if strings.HasPrefix(value, plainPrefix) {
+		return strings.TrimPrefix(value, plainPrefix), nil
+	}
+	if !strings.HasPrefix(value, encPrefix) {
+		return "", fmt.Errorf("无法识别的密文格式")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("无法识别的密文格式")
+	}
+	k, ok := keys[parts[0]]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("密文长度错误")
+	}
+	plaintext, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// NeedsReencrypt 判断密文是否不是由当前密钥加密
+func NeedsReencrypt(value string) bool {
+	if current == nil {
+		return !strings.HasPrefix(value, plainPrefix)
+	}
+	return !strings.HasPrefix(value, encPrefix+current.id+":")
+}
@@ -0,0 +1,122 @@
+package secret
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		oldKeys    []string
+		wantPrefix string
+	}{
+		{"plaintext", "", nil, plainPrefix},
+		{"encrypted", "current-key", nil, encPrefix},
+		{"encrypted with old keys", "current-key", []string{"old-key"}, encPrefix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Init(tt.key, tt.oldKeys); err != nil {
+				t.Fatal(err)
+			}
+			defer Init("", nil)
+
+			value, err := Encrypt("token-value")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(value, tt.wantPrefix) {
+				t.Fatalf("Encrypt() = %q, want prefix %q", value, tt.wantPrefix)
+			}
+			if tt.key != "" && strings.Contains(value, "token-value") {
+				t.Fatalf("ciphertext contains plaintext: %q", value)
+			}
+			got, err := Decrypt(value)
+			if err != nil || got != "token-value" {
+				t.Fatalf("Decrypt() = %q, %v", got, err)
+			}
+			if NeedsReencrypt(value) {
+				t.Error("value encrypted with current key should not need reencrypt")
+			}
+		})
+	}
+}
+
+func TestDecryptAfterRotation(t *testing.T) {
+	if err := Init("old-key", nil); err != nil {
+		t.Fatal(err)
+	}
+	value, err := Encrypt("token-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Init("new-key", []string{"old-key"}); err != nil {
+		t.Fatal(err)
+	}
+	defer Init("", nil)
+	if got, err := Decrypt(value); err != nil || got != "token-value" {
+		t.Fatalf("Decrypt() with old key = %q, %v", got, err)
+	}
+	if !NeedsReencrypt(value) {
+		t.Error("value encrypted with old key should need reencrypt")
+	}
+
+	if err := Init("new-key", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(value); err != ErrUnknownKey {
+		t.Errorf("Decrypt() without old key error = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	if err := Init("key", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Init("", nil)
+
+	for _, value := range []string{"", "raw-token", "enc:", "enc:abc", "enc:" + current.id + ":not-base64!", "enc:" + current.id + ":AAAA"} {
+		if _, err := Decrypt(value); err == nil {
+			t.Errorf("Decrypt(%q) should fail", value)
+		}
+	}
+}
+
+func TestID(t *testing.T) {
+	if err := Init("", nil); err != nil {
+		t.Fatal(err)
+	}
+	unkeyed := ID("token-value")
+	if len(unkeyed) != 32 || LegacyIDs("token-value") != nil {
+		t.Fatalf("unexpected unkeyed id %q", unkeyed)
+	}
+
+	if err := Init("key-a", nil); err != nil {
+		t.Fatal(err)
+	}
+	keyedA := ID("token-value")
+	if keyedA == unkeyed || len(keyedA) != 32 {
+		t.Fatalf("keyed id %q should differ from unkeyed id %q", keyedA, unkeyed)
+	}
+	if ID("token-value") != keyedA {
+		t.Error("id should be stable for the same key")
+	}
+	if ID("other-token") == keyedA {
+		t.Error("different tokens should have different ids")
+	}
+
+	if err := Init("key-b", []string{"key-a"}); err != nil {
+		t.Fatal(err)
+	}
+	defer Init("", nil)
+	if ID("token-value") == keyedA {
+		t.Error("id should change with the key")
+	}
+	legacy := LegacyIDs("token-value")
+	if len(legacy) != 2 || legacy[0] != keyedA || legacy[1] != unkeyed {
+		t.Errorf("LegacyIDs() = %v, want [%s %s]", legacy, keyedA, unkeyed)
+	}
+}